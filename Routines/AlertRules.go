@@ -0,0 +1,509 @@
+package Routines
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+)
+
+/*
+Alert rules watch the SystemMetric statistics routed by the reporting server
+and are read from its AlertConfig section
+
+	{ "AlertConfig": { "<RuleName>": { "StatName": "TimeChunk_Client_*_Lag", "Measure": "PercentOfCapacity",
+	  "Condition": "Above", "Threshold": "80", "DurationSeconds": "5", "Hysteresis": "5", "Severity": "Warning" } } }
+
+A rule fires once its condition has held for the duration and resolves as
+soon as the value is back past the threshold by the hysteresis, so a value
+sitting on the threshold does not flap. Every change is sent as a
+SystemAlert message, logged and listed on GET /alerts
+
+Rules are checked when a metric arrives and again on the reporting routine's
+ticker, so durations elapse and statistics that stop being reported are
+noticed without further messages. A statistic not reported for a while is
+stale and counts as zero for Below rules, so a producer that stops fires
+them, while Above rules resolve. Statistics stale for longer are forgotten
+*/
+
+type AlertCondition string
+
+const (
+	AlertConditionAbove AlertCondition = "Above"
+	AlertConditionBelow AlertCondition = "Below"
+)
+
+type AlertMeasure string
+
+const (
+	AlertMeasureValue             AlertMeasure = "Value"             // The statistic's value
+	AlertMeasurePercentOfCapacity AlertMeasure = "PercentOfCapacity" // The value as a percentage of its capacity
+)
+
+type AlertState string
+
+const (
+	AlertStateFiring   AlertState = "Firing"
+	AlertStateResolved AlertState = "Resolved"
+)
+
+const (
+	recentAlertCount        = 100              // Number of fired and resolved alerts kept for /alerts
+	alertEvaluationInterval = 1 * time.Second  // How often the reporting routine checks every statistic
+	alertSeriesStaleTimeout = 10 * time.Second // Statistics not reported for this long are stale
+	alertSeriesExpiry       = 5 * time.Minute  // Statistics not reported for this long are forgotten
+)
+
+/*
+AlertRule is a condition on every statistic whose environment and name
+match its patterns, which may use * wildcards
+*/
+type AlertRule struct {
+	Name            string
+	StatEnvironment string         // Pattern of environments the rule applies to
+	StatName        string         // Pattern of statistic names the rule applies to
+	Measure         AlertMeasure   // What is compared against the threshold
+	Condition       AlertCondition // Which side of the threshold fires
+	Threshold       float64
+	Duration        time.Duration  // How long the condition has to hold before firing
+	Hysteresis      float64        // How far back past the threshold the value has to go to resolve
+	Severity        MetricSeverity // Severity of the alert when it fires
+}
+
+/*
+ParseAlertConfig reads the alert rules of a config section, sorted by name.
+Rules need at least a StatName and a Threshold
+*/
+func ParseAlertConfig(configSection map[string]interface{}) ([]AlertRule, error) {
+
+	ruleNames := make([]string, 0, len(configSection))
+	for ruleName := range configSection {
+		ruleNames = append(ruleNames, ruleName)
+	}
+	sort.Strings(ruleNames)
+
+	alertRules := make([]AlertRule, 0, len(ruleNames))
+	for _, ruleName := range ruleNames {
+		RuleConfig, isSection := GetConfigSection(configSection, ruleName)
+		if !isSection {
+			return nil, errors.New(ruleName + " should be a config section")
+		}
+
+		alertRule, err := parseAlertRule(ruleName, RuleConfig)
+		if err != nil {
+			return nil, errors.New(ruleName + ": " + err.Error())
+		}
+		alertRules = append(alertRules, alertRule)
+	}
+
+	return alertRules, nil
+}
+
+func parseAlertRule(ruleName string, configSection map[string]interface{}) (AlertRule, error) {
+
+	alertRule := AlertRule{Name: ruleName}
+	var err error
+
+	if alertRule.StatEnvironment, err = GetConfigString(configSection, "StatEnvironment", "*"); err != nil {
+		return alertRule, err
+	}
+	if alertRule.StatName, err = GetConfigString(configSection, "StatName", ""); err != nil {
+		return alertRule, err
+	}
+	if alertRule.StatName == "" {
+		return alertRule, errors.New("StatName not found")
+	}
+	// Check the patterns now rather than failing to match later
+	if _, err = path.Match(alertRule.StatEnvironment, ""); err != nil {
+		return alertRule, errors.New("StatEnvironment is not a valid pattern")
+	}
+	if _, err = path.Match(alertRule.StatName, ""); err != nil {
+		return alertRule, errors.New("StatName is not a valid pattern")
+	}
+
+	measureString, err := GetConfigString(configSection, "Measure", string(AlertMeasureValue))
+	if err != nil {
+		return alertRule, err
+	}
+	switch strings.ToUpper(measureString) {
+	case "VALUE":
+		alertRule.Measure = AlertMeasureValue
+	case "PERCENTOFCAPACITY":
+		alertRule.Measure = AlertMeasurePercentOfCapacity
+	default:
+		return alertRule, errors.New("Measure should be Value or PercentOfCapacity, got " + measureString)
+	}
+
+	conditionString, err := GetConfigString(configSection, "Condition", string(AlertConditionAbove))
+	if err != nil {
+		return alertRule, err
+	}
+	switch strings.ToUpper(conditionString) {
+	case "ABOVE":
+		alertRule.Condition = AlertConditionAbove
+	case "BELOW":
+		alertRule.Condition = AlertConditionBelow
+	default:
+		return alertRule, errors.New("Condition should be Above or Below, got " + conditionString)
+	}
+
+	if _, exists := configSection["Threshold"]; !exists {
+		return alertRule, errors.New("Threshold not found")
+	}
+	if alertRule.Threshold, err = GetConfigFloat(configSection, "Threshold", 0); err != nil {
+		return alertRule, err
+	}
+
+	durationSeconds, err := GetConfigInt(configSection, "DurationSeconds", 0)
+	if err != nil {
+		return alertRule, err
+	}
+	if durationSeconds < 0 {
+		return alertRule, errors.New("DurationSeconds should not be negative")
+	}
+	alertRule.Duration = time.Duration(durationSeconds) * time.Second
+
+	if alertRule.Hysteresis, err = GetConfigFloat(configSection, "Hysteresis", 0); err != nil {
+		return alertRule, err
+	}
+	if alertRule.Hysteresis < 0 {
+		return alertRule, errors.New("Hysteresis should not be negative")
+	}
+
+	severityString, err := GetConfigString(configSection, "Severity", string(MetricSeverityWarning))
+	if err != nil {
+		return alertRule, err
+	}
+	switch strings.ToUpper(severityString) {
+	case "INFO":
+		alertRule.Severity = MetricSeverityInfo
+	case "WARNING":
+		alertRule.Severity = MetricSeverityWarning
+	case "ERROR":
+		alertRule.Severity = MetricSeverityError
+	default:
+		return alertRule, errors.New("Severity should be Info, Warning or Error, got " + severityString)
+	}
+
+	return alertRule, nil
+}
+
+func (r AlertRule) Matches(metric MetricStatistic) bool {
+	environmentMatches, _ := path.Match(r.StatEnvironment, metric.StatEnvironment)
+	nameMatches, _ := path.Match(r.StatName, metric.StatName)
+	return environmentMatches && nameMatches
+}
+
+/*
+GetMeasuredValue returns what the rule compares against its threshold, or
+false for percentages of metrics without a capacity
+*/
+func (r AlertRule) GetMeasuredValue(metric MetricStatistic) (float64, bool) {
+	if r.Measure == AlertMeasurePercentOfCapacity {
+		if metric.Capacity == nil || *metric.Capacity <= 0 {
+			return 0, false
+		}
+		return metric.Value / *metric.Capacity * 100, true
+	}
+	return metric.Value, true
+}
+
+func (r AlertRule) IsBreached(value float64) bool {
+	if r.Condition == AlertConditionBelow {
+		return value < r.Threshold
+	}
+	return value > r.Threshold
+}
+
+func (r AlertRule) IsRecovered(value float64) bool {
+	if r.Condition == AlertConditionBelow {
+		return value >= r.Threshold+r.Hysteresis
+	}
+	return value <= r.Threshold-r.Hysteresis
+}
+
+type AlertEvent struct {
+	Rule            string         `json:"Rule"`
+	StatEnvironment string         `json:"StatEnvironment"`
+	StatName        string         `json:"StatName"`
+	State           AlertState     `json:"State"`
+	Severity        MetricSeverity `json:"Severity"`
+	Condition       AlertCondition `json:"Condition"`
+	Threshold       float64        `json:"Threshold"`
+	Value           float64        `json:"Value"`     // Measured value that caused the change
+	Since           int64          `json:"Since"`     // Unix time in milliseconds the condition started
+	Timestamp       int64          `json:"Timestamp"` // Unix time in milliseconds of the change
+	Message         string         `json:"Message"`
+}
+
+type SystemAlert struct {
+	Alert AlertEvent `json:"SystemAlert"`
+}
+
+type AlertListing struct {
+	Firing []AlertEvent `json:"Firing"` // Alerts firing now, oldest first
+	Recent []AlertEvent `json:"Recent"` // Most recent changes, newest first
+}
+
+type alertSeriesState struct {
+	alertRule     AlertRule       // Rule the statistic is checked against
+	lastMetric    MetricStatistic // Latest metric of the statistic
+	lastValue     float64         // Measured value of the latest metric
+	lastSeen      time.Time       // When the latest metric arrived
+	breachedSince time.Time       // When the condition started holding, zero while it does not
+	firingEvent   *AlertEvent     // Event the alert fired with, nil while not firing
+}
+
+/*
+AlertEvaluator keeps the state of every rule for every statistic it matched
+*/
+type AlertEvaluator struct {
+	alertRules   []AlertRule
+	seriesMap    map[string]*alertSeriesState // Map of rule, environment and statistic name and their state
+	recentAlerts []AlertEvent                 // Most recent changes, oldest first
+	mu           sync.Mutex                   // Mutex to protect access to the state
+}
+
+func NewAlertEvaluator(alertRules []AlertRule) *AlertEvaluator {
+	p := new(AlertEvaluator)
+	p.alertRules = alertRules
+	p.seriesMap = make(map[string]*alertSeriesState)
+	return p
+}
+
+/*
+Evaluate checks a metric against every rule
+
+returns the alerts that fired or resolved
+*/
+func (a *AlertEvaluator) Evaluate(metric MetricStatistic, now time.Time) []AlertEvent {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var alertEvents []AlertEvent
+	for _, alertRule := range a.alertRules {
+		if !alertRule.Matches(metric) {
+			continue
+		}
+		value, measurable := alertRule.GetMeasuredValue(metric)
+		if !measurable {
+			continue
+		}
+
+		seriesKey := alertRule.Name + "/" + metric.StatEnvironment + "/" + metric.StatName
+		seriesState, exists := a.seriesMap[seriesKey]
+		if !exists {
+			seriesState = &alertSeriesState{alertRule: alertRule}
+			a.seriesMap[seriesKey] = seriesState
+		}
+		seriesState.lastMetric = metric
+		seriesState.lastValue = value
+		seriesState.lastSeen = now
+
+		if alertEvent, changed := seriesState.evaluate(value, now); changed {
+			alertEvents = append(alertEvents, alertEvent)
+		}
+	}
+
+	a.recordAlerts(alertEvents)
+	return alertEvents
+}
+
+/*
+EvaluateSeries checks every statistic the rules have matched against its
+latest value, treating those not reported within the stale timeout as stale
+and forgetting those not reported within the expiry
+
+returns the alerts that fired or resolved
+*/
+func (a *AlertEvaluator) EvaluateSeries(now time.Time) []AlertEvent {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var alertEvents []AlertEvent
+	for seriesKey, seriesState := range a.seriesMap {
+		alertRule := seriesState.alertRule
+		sinceLastSeen := now.Sub(seriesState.lastSeen)
+
+		switch {
+		case sinceLastSeen >= alertSeriesExpiry:
+			// Nothing will resolve the alert once the statistic is forgotten
+			if seriesState.firingEvent != nil {
+				alertEvents = append(alertEvents, seriesState.resolveStale(now))
+			}
+			delete(a.seriesMap, seriesKey)
+
+		case sinceLastSeen < alertSeriesStaleTimeout:
+			if alertEvent, changed := seriesState.evaluate(seriesState.lastValue, now); changed {
+				alertEvents = append(alertEvents, alertEvent)
+			}
+
+		case alertRule.Condition == AlertConditionBelow:
+			// A statistic that stopped being reported, like the rate of a producer that stopped, counts as zero
+			if alertEvent, changed := seriesState.evaluate(0, now); changed {
+				if alertEvent.State == AlertStateFiring {
+					alertEvent.Message = alertRule.Name + ": " + seriesState.lastMetric.StatName + " not reported for " + alertSeriesStaleTimeout.String()
+					seriesState.firingEvent = &alertEvent
+				}
+				alertEvents = append(alertEvents, alertEvent)
+			}
+
+		default:
+			if seriesState.firingEvent != nil {
+				alertEvents = append(alertEvents, seriesState.resolveStale(now))
+			}
+			seriesState.breachedSince = time.Time{}
+		}
+	}
+
+	a.recordAlerts(alertEvents)
+	return alertEvents
+}
+
+/*
+evaluate checks a measured value of the statistic against its rule
+
+returns the alert if it fired or resolved
+*/
+func (s *alertSeriesState) evaluate(value float64, now time.Time) (AlertEvent, bool) {
+	alertRule := s.alertRule
+
+	if s.firingEvent != nil {
+		if !alertRule.IsRecovered(value) {
+			return AlertEvent{}, false
+		}
+		alertEvent := createAlertEvent(alertRule, s.lastMetric, AlertStateResolved, value, s.breachedSince, now)
+		s.breachedSince = time.Time{}
+		s.firingEvent = nil
+		return alertEvent, true
+	}
+
+	if !alertRule.IsBreached(value) {
+		s.breachedSince = time.Time{}
+		return AlertEvent{}, false
+	}
+	if s.breachedSince.IsZero() {
+		s.breachedSince = now
+	}
+	if now.Sub(s.breachedSince) < alertRule.Duration {
+		return AlertEvent{}, false
+	}
+
+	alertEvent := createAlertEvent(alertRule, s.lastMetric, AlertStateFiring, value, s.breachedSince, now)
+	s.firingEvent = &alertEvent
+	return alertEvent, true
+}
+
+/*
+resolveStale resolves the firing alert of a statistic that is no longer
+reported
+*/
+func (s *alertSeriesState) resolveStale(now time.Time) AlertEvent {
+	alertEvent := createAlertEvent(s.alertRule, s.lastMetric, AlertStateResolved, s.firingEvent.Value, s.breachedSince, now)
+	alertEvent.Message = s.alertRule.Name + ": " + s.lastMetric.StatName + " no longer reported"
+	s.breachedSince = time.Time{}
+	s.firingEvent = nil
+	return alertEvent
+}
+
+// recordAlerts keeps alerts for GET /alerts. The caller must hold the mutex
+func (a *AlertEvaluator) recordAlerts(alertEvents []AlertEvent) {
+	a.recentAlerts = append(a.recentAlerts, alertEvents...)
+	if len(a.recentAlerts) > recentAlertCount {
+		a.recentAlerts = append([]AlertEvent(nil), a.recentAlerts[len(a.recentAlerts)-recentAlertCount:]...)
+	}
+}
+
+func createAlertEvent(alertRule AlertRule, metric MetricStatistic, state AlertState, value float64, breachedSince time.Time, now time.Time) AlertEvent {
+
+	valueString := strconv.FormatFloat(value, 'f', -1, 64)
+	thresholdString := strconv.FormatFloat(alertRule.Threshold, 'f', -1, 64)
+	if alertRule.Measure == AlertMeasurePercentOfCapacity {
+		valueString = strconv.FormatFloat(value, 'f', 1, 64) + "%"
+		thresholdString += "%"
+	}
+
+	message := metric.StatName + " " + strings.ToLower(string(alertRule.Condition)) + " " + thresholdString
+	if alertRule.Duration > 0 {
+		message += " for " + alertRule.Duration.String()
+	}
+	message += " at " + valueString
+	severity := alertRule.Severity
+	if state == AlertStateResolved {
+		message = metric.StatName + " back within " + thresholdString + " at " + valueString
+		severity = MetricSeverityInfo
+	}
+
+	return AlertEvent{
+		Rule:            alertRule.Name,
+		StatEnvironment: metric.StatEnvironment,
+		StatName:        metric.StatName,
+		State:           state,
+		Severity:        severity,
+		Condition:       alertRule.Condition,
+		Threshold:       alertRule.Threshold,
+		Value:           value,
+		Since:           breachedSince.UnixMilli(),
+		Timestamp:       now.UnixMilli(),
+		Message:         alertRule.Name + ": " + message,
+	}
+}
+
+func (a *AlertEvaluator) GetAlerts() AlertListing {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	alertListing := AlertListing{Firing: []AlertEvent{}, Recent: make([]AlertEvent, 0, len(a.recentAlerts))}
+	for _, seriesState := range a.seriesMap {
+		if seriesState.firingEvent != nil {
+			alertListing.Firing = append(alertListing.Firing, *seriesState.firingEvent)
+		}
+	}
+	sort.Slice(alertListing.Firing, func(i, j int) bool {
+		return alertListing.Firing[i].Timestamp < alertListing.Firing[j].Timestamp
+	})
+
+	for alertIndex := len(a.recentAlerts) - 1; alertIndex >= 0; alertIndex-- {
+		alertListing.Recent = append(alertListing.Recent, a.recentAlerts[alertIndex])
+	}
+	return alertListing
+}
+
+/*
+PublishAlerts logs alerts at their severity and routes them to clients of
+the SystemAlert stream and of the environment that raised them
+*/
+func PublishAlerts(loggingChannel chan map[zerolog.Level]string, alertEvents []AlertEvent, chunkTypeRoutingMap *ChunkTypeToChannelMap, environmentRoutingMap *ChunkTypeToChannelMap) {
+
+	for _, alertEvent := range alertEvents {
+		logLevel := zerolog.InfoLevel
+		switch alertEvent.Severity {
+		case MetricSeverityWarning:
+			logLevel = zerolog.WarnLevel
+		case MetricSeverityError:
+			logLevel = zerolog.ErrorLevel
+		}
+		loggingChannel <- CreateLogMessage(logLevel, "Alert "+string(alertEvent.State)+" - "+alertEvent.Message)
+
+		RouteReportingMessage(loggingChannel, NewAlertReportingMessage(alertEvent), chunkTypeRoutingMap, environmentRoutingMap)
+	}
+}
+
+/*
+RegisterAlertsRoute adds GET /alerts to the reporting server. With
+authentication on the token has to allow the "alerts" reporting stream
+*/
+func RegisterAlertsRoute(router *gin.Engine, alertEvaluator *AlertEvaluator, serverConfig WebSocketServerConfig) {
+	requireAuthorization := serverConfig.Authenticator.RequireAuthorization(AuthorizationScopeReportingStreams, "alerts")
+
+	router.GET("/alerts", requireAuthorization, func(c *gin.Context) {
+		c.JSON(http.StatusOK, alertEvaluator.GetAlerts())
+	})
+}
@@ -0,0 +1,107 @@
+package Routines
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestAlertRule(condition AlertCondition, threshold float64, duration time.Duration) AlertRule {
+	return AlertRule{
+		Name:            "Test_Rule",
+		StatEnvironment: "*",
+		StatName:        "*",
+		Measure:         AlertMeasureValue,
+		Condition:       condition,
+		Threshold:       threshold,
+		Duration:        duration,
+		Severity:        MetricSeverityWarning,
+	}
+}
+
+func getAlertStates(alertEvents []AlertEvent) []AlertState {
+	alertStates := make([]AlertState, 0, len(alertEvents))
+	for _, alertEvent := range alertEvents {
+		alertStates = append(alertStates, alertEvent.State)
+	}
+	return alertStates
+}
+
+func TestAlertsFireOnTheTickerOnceTheirDurationHasPassed(t *testing.T) {
+	alertEvaluator := NewAlertEvaluator([]AlertRule{newTestAlertRule(AlertConditionAbove, 80, 5*time.Second)})
+	startTime := time.Now()
+
+	if alertEvents := alertEvaluator.Evaluate(NewMetricStatistic("TimeChunk_Channel", 90, MetricUnitChunks), startTime); len(alertEvents) != 0 {
+		t.Fatalf("fired before the duration: %v", getAlertStates(alertEvents))
+	}
+	if alertEvents := alertEvaluator.EvaluateSeries(startTime.Add(4 * time.Second)); len(alertEvents) != 0 {
+		t.Fatalf("fired before the duration: %v", getAlertStates(alertEvents))
+	}
+
+	alertEvents := alertEvaluator.EvaluateSeries(startTime.Add(5 * time.Second))
+	if len(alertEvents) != 1 || alertEvents[0].State != AlertStateFiring || alertEvents[0].Value != 90 {
+		t.Fatalf("got %+v, want the alert firing at 90", alertEvents)
+	}
+	if alertEvents := alertEvaluator.EvaluateSeries(startTime.Add(6 * time.Second)); len(alertEvents) != 0 {
+		t.Errorf("fired again: %v", getAlertStates(alertEvents))
+	}
+}
+
+func TestBelowAlertsFireWhenAStatisticStopsBeingReported(t *testing.T) {
+	alertEvaluator := NewAlertEvaluator([]AlertRule{newTestAlertRule(AlertConditionBelow, 1, 0)})
+	startTime := time.Now()
+
+	alertEvaluator.Evaluate(NewMetricStatistic("TimeChunk_Chunk_Rate", 50, MetricUnitChunksPerSecond), startTime)
+	if alertEvents := alertEvaluator.EvaluateSeries(startTime.Add(alertSeriesStaleTimeout / 2)); len(alertEvents) != 0 {
+		t.Fatalf("fired while the statistic is reported: %v", getAlertStates(alertEvents))
+	}
+
+	alertEvents := alertEvaluator.EvaluateSeries(startTime.Add(alertSeriesStaleTimeout))
+	if len(alertEvents) != 1 || alertEvents[0].State != AlertStateFiring {
+		t.Fatalf("got %v, want the alert firing once the statistic is stale", getAlertStates(alertEvents))
+	}
+	if firing := alertEvaluator.GetAlerts().Firing; len(firing) != 1 || firing[0].Message != alertEvents[0].Message {
+		t.Errorf("firing alerts %+v, want the stale alert", firing)
+	}
+
+	// and resolves when the producer comes back
+	alertEvents = alertEvaluator.Evaluate(NewMetricStatistic("TimeChunk_Chunk_Rate", 50, MetricUnitChunksPerSecond), startTime.Add(alertSeriesStaleTimeout+time.Second))
+	if len(alertEvents) != 1 || alertEvents[0].State != AlertStateResolved {
+		t.Errorf("got %v, want the alert resolved", getAlertStates(alertEvents))
+	}
+}
+
+func TestAboveAlertsResolveWhenAStatisticStopsBeingReported(t *testing.T) {
+	alertEvaluator := NewAlertEvaluator([]AlertRule{newTestAlertRule(AlertConditionAbove, 80, 0)})
+	startTime := time.Now()
+
+	if alertEvents := alertEvaluator.Evaluate(NewMetricStatistic("TimeChunk_Client_10.0.0.5_Lag", 90, MetricUnitChunks), startTime); len(alertEvents) != 1 {
+		t.Fatalf("got %v, want the alert firing", getAlertStates(alertEvents))
+	}
+
+	alertEvents := alertEvaluator.EvaluateSeries(startTime.Add(alertSeriesStaleTimeout))
+	if len(alertEvents) != 1 || alertEvents[0].State != AlertStateResolved {
+		t.Fatalf("got %v, want the alert resolved once the statistic is stale", getAlertStates(alertEvents))
+	}
+	if firing := alertEvaluator.GetAlerts().Firing; len(firing) != 0 {
+		t.Errorf("alerts still firing: %+v", firing)
+	}
+}
+
+func TestStaleSeriesAreForgotten(t *testing.T) {
+	alertEvaluator := NewAlertEvaluator([]AlertRule{newTestAlertRule(AlertConditionBelow, 1, 0)})
+	startTime := time.Now()
+
+	alertEvaluator.Evaluate(NewMetricStatistic("TimeChunk_Chunk_Rate", 50, MetricUnitChunksPerSecond), startTime)
+	alertEvaluator.Evaluate(NewMetricStatistic("FFTChunk_Chunk_Rate", 50, MetricUnitChunksPerSecond), startTime)
+	alertEvaluator.EvaluateSeries(startTime.Add(alertSeriesStaleTimeout))
+
+	// A series still firing when it is forgotten is resolved so clients are not left with it
+	alertEvaluator.Evaluate(NewMetricStatistic("FFTChunk_Chunk_Rate", 50, MetricUnitChunksPerSecond), startTime.Add(alertSeriesExpiry-time.Second))
+	alertEvents := alertEvaluator.EvaluateSeries(startTime.Add(alertSeriesExpiry))
+	if len(alertEvents) != 1 || alertEvents[0].State != AlertStateResolved || alertEvents[0].StatName != "TimeChunk_Chunk_Rate" {
+		t.Fatalf("got %+v, want the TimeChunk alert resolved", alertEvents)
+	}
+	if len(alertEvaluator.seriesMap) != 1 {
+		t.Errorf("evaluator holds %d series, want only the one still reported", len(alertEvaluator.seriesMap))
+	}
+}
@@ -0,0 +1,88 @@
+package Routines
+
+import (
+	"encoding/json"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+)
+
+/*
+Clients of /DataTypes/all receive every chunk the router sees, whatever its
+type, each wrapped in an envelope naming the type
+
+	{ "ChunkType": "TimeChunk", "Chunk": { "TimeChunk": { ... } } }
+
+Subscribers are kept under the reserved "all" chunk type. The router queues
+every chunk for them as it routes it, so chunk types registered after the
+client connected are included, and a single dispatcher copies them out in
+the order they were received
+*/
+
+// Reserved name of the route streaming every chunk type
+const AllChunkTypesName = "all"
+
+type ChunkEnvelope struct {
+	ChunkType string          `json:"ChunkType"`
+	Chunk     json.RawMessage `json:"Chunk"`
+}
+
+/*
+CreateChunkEnvelope wraps a chunk for clients of every chunk type. The
+envelope keeps the chunk's sequence number and receive time
+*/
+func CreateChunkEnvelope(chunkTypeString string, chunk *RoutedChunk) *RoutedChunk {
+	data, _ := json.Marshal(ChunkEnvelope{
+		ChunkType: chunkTypeString,
+		Chunk:     json.RawMessage(chunk.JSONString),
+	})
+
+	envelopeChunk := NewRoutedChunk(string(data))
+	envelopeChunk.SequenceNumber = chunk.SequenceNumber
+	envelopeChunk.ReceivedTime = chunk.ReceivedTime
+	return envelopeChunk
+}
+
+/*
+RegisterAllChunkTypesRoute adds the /DataTypes/all WebSocket route. A token
+has to allow the "all" chunk type, or "*", to use it
+*/
+func (s *ChunkTypeToChannelMap) RegisterAllChunkTypesRoute(loggingChannel chan map[zerolog.Level]string, router *gin.Engine) {
+
+	go s.RunAllChunkTypesDispatcher(loggingChannel)
+
+	requireAuthorization := s.serverConfig.Authenticator.RequireAuthorization(s.serverConfig.AuthorizationScope, AllChunkTypesName)
+
+	router.GET(s.routePrefix+AllChunkTypesName, requireAuthorization, func(c *gin.Context) {
+		s.HandleWebSocketSubscription(loggingChannel, c, AllChunkTypesName)
+	})
+}
+
+/*
+queueForAllChunkTypesSubscribers queues a chunk for the clients of
+/DataTypes/all, only building the envelope if there is someone to send it to.
+The queue follows the overflow policy configured for "all" and its drops are
+counted against it
+*/
+func (s *ChunkTypeToChannelMap) queueForAllChunkTypesSubscribers(chunkTypeString string, chunk *RoutedChunk) {
+
+	if len(s.GetSubscribers(AllChunkTypesName)) == 0 {
+		return
+	}
+
+	s.EnqueueChunk(AllChunkTypesName, s.allChunkTypesQueue, CreateChunkEnvelope(chunkTypeString, chunk))
+}
+
+/*
+RunAllChunkTypesDispatcher copies every queued envelope to the clients of
+/DataTypes/all. Being the only routine delivering to them keeps their queues
+in the order chunks were received and their lag tracking to one goroutine
+*/
+func (s *ChunkTypeToChannelMap) RunAllChunkTypesDispatcher(loggingChannel chan map[zerolog.Level]string) {
+
+	overflowPolicy := s.serverConfig.ChunkRouting.GetChunkTypeConfig(AllChunkTypesName).OverflowPolicy
+
+	for envelope := range s.allChunkTypesQueue {
+		s.deliverToSubscribers(loggingChannel, AllChunkTypesName, envelope, overflowPolicy)
+	}
+}
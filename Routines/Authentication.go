@@ -0,0 +1,381 @@
+package Routines
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+AuthorizationScope names the list in a token's claims that is checked for a
+stream. The data server checks chunk types and control sources and the
+reporting server checks reporting streams and environments. Environments
+have their own list as their names come from producers and could otherwise
+match a reporting stream
+*/
+type AuthorizationScope string
+
+const (
+	AuthorizationScopeChunkTypes       AuthorizationScope = "ChunkTypes"
+	AuthorizationScopeReportingStreams AuthorizationScope = "ReportingStreams"
+	AuthorizationScopeControlSources   AuthorizationScope = "ControlSources"
+	AuthorizationScopeEnvironments     AuthorizationScope = "Environments"
+)
+
+// Query parameter for clients, like browsers opening WebSockets, that cannot set headers
+const accessTokenQueryParameter = "access_token"
+
+/*
+AccessClaims lists what the holder of a token may subscribe to. A "*" entry
+allows everything in that list
+*/
+type AccessClaims struct {
+	ChunkTypes       []string `json:"ChunkTypes"`
+	ReportingStreams []string `json:"ReportingStreams"`
+	ControlSources   []string `json:"ControlSources"`
+	Environments     []string `json:"Environments"`
+	ExpiresAt        *int64   `json:"exp,omitempty"`
+	NotBefore        *int64   `json:"nbf,omitempty"`
+}
+
+/*
+Allows reports whether the claims allow a stream. Source identifiers are hex
+so control sources match whatever their case, everything else must match
+exactly
+*/
+func (c AccessClaims) Allows(scope AuthorizationScope, streamName string) bool {
+
+	allowedStreams := c.ChunkTypes
+	switch scope {
+	case AuthorizationScopeReportingStreams:
+		allowedStreams = c.ReportingStreams
+	case AuthorizationScopeControlSources:
+		allowedStreams = c.ControlSources
+	case AuthorizationScopeEnvironments:
+		allowedStreams = c.Environments
+	}
+
+	for _, allowedStream := range allowedStreams {
+		if allowedStream == "*" || allowedStream == streamName {
+			return true
+		}
+		if scope == AuthorizationScopeControlSources && strings.EqualFold(allowedStream, streamName) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Authenticator verifies bearer tokens locally. Tokens are either static
+tokens listed in the config or HMAC signed JWTs whose keys are in the config
+*/
+type Authenticator struct {
+	Enabled        bool                    // When false every request is allowed
+	bearerTokens   map[string]AccessClaims // Static tokens and what they may access
+	jwtSigningKeys map[string][]byte       // JWT key id and HMAC secret pairs
+}
+
+/*
+placeholderSecretPrefix starts the tokens and keys in the sample config,
+which are public and so are refused while authentication is enabled
+*/
+const placeholderSecretPrefix = "change-me"
+
+/*
+ParseAuthenticationConfig reads the optional AuthenticationConfig section
+
+	"AuthenticationConfig": {
+		"Enabled": "True",
+		"BearerTokens": [ { "Token": "...", "ChunkTypes": ["*"], "ReportingStreams": ["SystemInfo"], "ControlSources": ["0a0b0c0d0e0f"], "Environments": ["Node1"] } ],
+		"JWTSigningKeys": { "<key id>": "<secret>" }
+	}
+*/
+func ParseAuthenticationConfig(configJson map[string]interface{}) (*Authenticator, error) {
+
+	authenticator := &Authenticator{
+		bearerTokens:   make(map[string]AccessClaims),
+		jwtSigningKeys: make(map[string][]byte),
+	}
+
+	AuthenticationConfig, exists := GetConfigSection(configJson, "AuthenticationConfig")
+	if !exists {
+		return authenticator, nil
+	}
+
+	var err error
+	if authenticator.Enabled, err = GetConfigBool(AuthenticationConfig, "Enabled", false); err != nil {
+		return authenticator, err
+	}
+
+	if bearerTokens, exists := AuthenticationConfig["BearerTokens"]; exists {
+		bearerTokenList, isList := bearerTokens.([]interface{})
+		if !isList {
+			return authenticator, errors.New("BearerTokens should be a list")
+		}
+
+		for _, bearerToken := range bearerTokenList {
+			BearerTokenConfig, isSection := bearerToken.(map[string]interface{})
+			if !isSection {
+				return authenticator, errors.New("BearerTokens entries should be config sections")
+			}
+
+			token, err := GetConfigString(BearerTokenConfig, "Token", "")
+			if err != nil || token == "" {
+				return authenticator, errors.New("BearerTokens entries need a Token")
+			}
+			if authenticator.Enabled && strings.HasPrefix(token, placeholderSecretPrefix) {
+				return authenticator, errors.New("BearerTokens still has the sample Token, replace it before enabling authentication")
+			}
+
+			var claims AccessClaims
+			if claims.ChunkTypes, err = GetConfigStringList(BearerTokenConfig, "ChunkTypes", nil); err != nil {
+				return authenticator, err
+			}
+			if claims.ReportingStreams, err = GetConfigStringList(BearerTokenConfig, "ReportingStreams", nil); err != nil {
+				return authenticator, err
+			}
+			if claims.ControlSources, err = GetConfigStringList(BearerTokenConfig, "ControlSources", nil); err != nil {
+				return authenticator, err
+			}
+			if claims.Environments, err = GetConfigStringList(BearerTokenConfig, "Environments", nil); err != nil {
+				return authenticator, err
+			}
+			authenticator.bearerTokens[token] = claims
+		}
+	}
+
+	if JWTSigningKeys, exists := GetConfigSection(AuthenticationConfig, "JWTSigningKeys"); exists {
+		for keyID := range JWTSigningKeys {
+			secret, err := GetConfigString(JWTSigningKeys, keyID, "")
+			if err != nil || secret == "" {
+				return authenticator, errors.New("JWTSigningKeys " + keyID + " should be a non empty string")
+			}
+			if authenticator.Enabled && strings.HasPrefix(secret, placeholderSecretPrefix) {
+				return authenticator, errors.New("JWTSigningKeys " + keyID + " is still the sample key, replace it before enabling authentication")
+			}
+			authenticator.jwtSigningKeys[keyID] = []byte(secret)
+		}
+	}
+
+	if authenticator.Enabled && len(authenticator.bearerTokens) == 0 && len(authenticator.jwtSigningKeys) == 0 {
+		return authenticator, errors.New("Authentication is enabled but no BearerTokens or JWTSigningKeys are configured")
+	}
+
+	return authenticator, nil
+}
+
+/*
+GetRequestToken reads the bearer token from the Authorization header or,
+failing that, the access_token query parameter
+*/
+func GetRequestToken(request *http.Request) string {
+	authorizationHeader := request.Header.Get("Authorization")
+	if len(authorizationHeader) > 7 && strings.EqualFold(authorizationHeader[:7], "Bearer ") {
+		return strings.TrimSpace(authorizationHeader[7:])
+	}
+	return request.URL.Query().Get(accessTokenQueryParameter)
+}
+
+/*
+NewHTTPRouter creates a router with the same logging and panic recovery as
+gin.Default, except that tokens passed in the access_token query parameter
+are redacted from the request log
+*/
+func NewHTTPRouter() *gin.Engine {
+	router := gin.New()
+	router.Use(gin.LoggerWithFormatter(formatRequestLog), gin.Recovery())
+	return router
+}
+
+func formatRequestLog(param gin.LogFormatterParams) string {
+	return fmt.Sprintf("[GIN] %v | %3d | %13v | %15s | %-7s %#v\n%s",
+		param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+		param.StatusCode,
+		param.Latency,
+		param.ClientIP,
+		param.Method,
+		RedactAccessToken(param.Path),
+		param.ErrorMessage,
+	)
+}
+
+/*
+RedactAccessToken hides the access_token query parameter of a request path.
+Queries that cannot be parsed are left out entirely
+*/
+func RedactAccessToken(requestPath string) string {
+
+	path, rawQuery, hasQuery := strings.Cut(requestPath, "?")
+	if !hasQuery {
+		return requestPath
+	}
+
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return path + "?REDACTED"
+	}
+	if !query.Has(accessTokenQueryParameter) {
+		return requestPath
+	}
+
+	query.Set(accessTokenQueryParameter, "REDACTED")
+	return path + "?" + query.Encode()
+}
+
+/*
+VerifyToken checks a token and returns the claims it carries
+*/
+func (a *Authenticator) VerifyToken(token string) (AccessClaims, error) {
+
+	if token == "" {
+		return AccessClaims{}, errors.New("no token provided")
+	}
+
+	for bearerToken, claims := range a.bearerTokens {
+		if subtle.ConstantTimeCompare([]byte(bearerToken), []byte(token)) == 1 {
+			return claims, nil
+		}
+	}
+
+	if strings.Count(token, ".") == 2 && len(a.jwtSigningKeys) > 0 {
+		return a.verifyJWT(token)
+	}
+
+	return AccessClaims{}, errors.New("unknown token")
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+func (a *Authenticator) verifyJWT(token string) (AccessClaims, error) {
+
+	var claims AccessClaims
+	tokenParts := strings.Split(token, ".")
+
+	headerBytes, err := base64.RawURLEncoding.DecodeString(tokenParts[0])
+	if err != nil {
+		return claims, errors.New("malformed token header")
+	}
+	var header jwtHeader
+	if err := json.Unmarshal(headerBytes, &header); err != nil {
+		return claims, errors.New("malformed token header")
+	}
+
+	// Only HMAC algorithms are accepted, which also rules out "none"
+	var hashFunction func() hash.Hash
+	switch header.Algorithm {
+	case "HS256":
+		hashFunction = sha256.New
+	case "HS384":
+		hashFunction = sha512.New384
+	case "HS512":
+		hashFunction = sha512.New
+	default:
+		return claims, errors.New("unsupported token algorithm " + header.Algorithm)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(tokenParts[2])
+	if err != nil {
+		return claims, errors.New("malformed token signature")
+	}
+
+	// Use the named key if there is one, otherwise try them all
+	candidateKeys := a.jwtSigningKeys
+	if header.KeyID != "" {
+		key, exists := a.jwtSigningKeys[header.KeyID]
+		if !exists {
+			return claims, errors.New("unknown token key id " + header.KeyID)
+		}
+		candidateKeys = map[string][]byte{header.KeyID: key}
+	}
+
+	signatureValid := false
+	signedContent := []byte(tokenParts[0] + "." + tokenParts[1])
+	for _, key := range candidateKeys {
+		mac := hmac.New(hashFunction, key)
+		mac.Write(signedContent)
+		if hmac.Equal(mac.Sum(nil), signature) {
+			signatureValid = true
+			break
+		}
+	}
+	if !signatureValid {
+		return claims, errors.New("invalid token signature")
+	}
+
+	payloadBytes, err := base64.RawURLEncoding.DecodeString(tokenParts[1])
+	if err != nil {
+		return claims, errors.New("malformed token payload")
+	}
+	if err := json.Unmarshal(payloadBytes, &claims); err != nil {
+		return claims, errors.New("malformed token payload")
+	}
+
+	now := time.Now().Unix()
+	if claims.ExpiresAt != nil && now >= *claims.ExpiresAt {
+		return claims, errors.New("token expired")
+	}
+	if claims.NotBefore != nil && now < *claims.NotBefore {
+		return claims, errors.New("token not valid yet")
+	}
+
+	return claims, nil
+}
+
+/*
+RequireAuthorization returns gin middleware that rejects requests whose token
+does not allow the named stream. It is a no-op while authentication is
+disabled
+*/
+func (a *Authenticator) RequireAuthorization(scope AuthorizationScope, streamName string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		a.authorizeRequest(c, scope, streamName)
+	}
+}
+
+/*
+RequireParamAuthorization is RequireAuthorization for routes where the
+stream is named by a path parameter
+*/
+func (a *Authenticator) RequireParamAuthorization(scope AuthorizationScope, paramName string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		a.authorizeRequest(c, scope, c.Param(paramName))
+	}
+}
+
+func (a *Authenticator) authorizeRequest(c *gin.Context, scope AuthorizationScope, streamName string) {
+
+	if a == nil || !a.Enabled {
+		c.Next()
+		return
+	}
+
+	claims, err := a.VerifyToken(GetRequestToken(c.Request))
+	if err != nil {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"Error": err.Error()})
+		return
+	}
+
+	if !claims.Allows(scope, streamName) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"Error": "token does not allow " + streamName})
+		return
+	}
+
+	c.Next()
+}
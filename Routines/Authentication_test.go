@@ -0,0 +1,302 @@
+package Routines
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRedactAccessToken(t *testing.T) {
+	testCases := []struct {
+		requestPath string
+		want        string
+	}{
+		{"/DataTypes/TimeChunk", "/DataTypes/TimeChunk"},
+		{"/DataTypes/TimeChunk?encoding=cbor", "/DataTypes/TimeChunk?encoding=cbor"},
+		{"/DataTypes/TimeChunk?access_token=secret", "/DataTypes/TimeChunk?access_token=REDACTED"},
+		{"/DataTypes/TimeChunk?encoding=cbor&access_token=secret", "/DataTypes/TimeChunk?access_token=REDACTED&encoding=cbor"},
+		{"/DataTypes/TimeChunk?access_token=a&access_token=b", "/DataTypes/TimeChunk?access_token=REDACTED"},
+		{"/DataTypes/TimeChunk?access_token=secret;x", "/DataTypes/TimeChunk?REDACTED"},
+	}
+
+	for _, testCase := range testCases {
+		if got := RedactAccessToken(testCase.requestPath); got != testCase.want {
+			t.Errorf("RedactAccessToken(%q) = %q, want %q", testCase.requestPath, got, testCase.want)
+		}
+	}
+}
+
+func TestHTTPRouterKeepsTokensOutOfItsLog(t *testing.T) {
+	var requestLog bytes.Buffer
+	defaultWriter := gin.DefaultWriter
+	gin.DefaultWriter = &requestLog
+	defer func() { gin.DefaultWriter = defaultWriter }()
+
+	router := NewHTTPRouter()
+	router.GET("/status", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/status?access_token=secret-token", nil))
+
+	if !strings.Contains(requestLog.String(), "/status") {
+		t.Fatalf("request was not logged: %q", requestLog.String())
+	}
+	if strings.Contains(requestLog.String(), "secret-token") {
+		t.Errorf("token was written to the request log: %q", requestLog.String())
+	}
+}
+
+func newTestAuthenticator(t *testing.T) *Authenticator {
+	t.Helper()
+
+	authenticator, err := ParseAuthenticationConfig(map[string]interface{}{
+		"AuthenticationConfig": map[string]interface{}{
+			"Enabled": "True",
+			"BearerTokens": []interface{}{
+				map[string]interface{}{"Token": "static-token", "ChunkTypes": []interface{}{"TimeChunk"}},
+			},
+			"JWTSigningKeys": map[string]interface{}{
+				"primary":   "primary-secret",
+				"secondary": "secondary-secret",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("parsing authentication config: %v", err)
+	}
+	return authenticator
+}
+
+/*
+signTestJWT builds a JWT from raw header and claims JSON, signing it with
+the HMAC hash named by signingAlgorithm so the header can lie about it
+*/
+func signTestJWT(headerJSON string, claimsJSON string, signingAlgorithm string, secret string) string {
+	signedContent := base64.RawURLEncoding.EncodeToString([]byte(headerJSON)) + "." + base64.RawURLEncoding.EncodeToString([]byte(claimsJSON))
+
+	hashFunction := sha256.New
+	switch signingAlgorithm {
+	case "":
+		return signedContent + "."
+	case "HS384":
+		hashFunction = sha512.New384
+	case "HS512":
+		hashFunction = sha512.New
+	}
+
+	mac := hmac.New(hashFunction, []byte(secret))
+	mac.Write([]byte(signedContent))
+	return signedContent + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyToken(t *testing.T) {
+	authenticator := newTestAuthenticator(t)
+
+	now := time.Now().Unix()
+	allowedClaims := `{"ChunkTypes":["TimeChunk"]}`
+	expiredClaims := `{"ChunkTypes":["TimeChunk"],"exp":` + strconv.FormatInt(now-60, 10) + `}`
+	currentClaims := `{"ChunkTypes":["TimeChunk"],"exp":` + strconv.FormatInt(now+60, 10) + `,"nbf":` + strconv.FormatInt(now-60, 10) + `}`
+	futureClaims := `{"ChunkTypes":["TimeChunk"],"nbf":` + strconv.FormatInt(now+60, 10) + `}`
+
+	validToken := signTestJWT(`{"alg":"HS256","kid":"primary"}`, allowedClaims, "HS256", "primary-secret")
+	validTokenParts := strings.Split(validToken, ".")
+	tamperedToken := validTokenParts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"ChunkTypes":["*"]}`)) + "." + validTokenParts[2]
+
+	testCases := []struct {
+		name    string
+		token   string
+		wantErr string
+	}{
+		{"static token", "static-token", ""},
+		{"HS256 with key id", validToken, ""},
+		{"HS384 with key id", signTestJWT(`{"alg":"HS384","kid":"secondary"}`, allowedClaims, "HS384", "secondary-secret"), ""},
+		{"HS512 without key id", signTestJWT(`{"alg":"HS512"}`, allowedClaims, "HS512", "secondary-secret"), ""},
+		{"exp and nbf in range", signTestJWT(`{"alg":"HS256","kid":"primary"}`, currentClaims, "HS256", "primary-secret"), ""},
+
+		{"no token", "", "no token provided"},
+		{"unknown static token", "other-token", "unknown token"},
+		{"alg none", signTestJWT(`{"alg":"none","kid":"primary"}`, allowedClaims, "", ""), "unsupported token algorithm none"},
+		{"alg none upper case", signTestJWT(`{"alg":"NONE"}`, allowedClaims, "", ""), "unsupported token algorithm NONE"},
+		{"asymmetric alg", signTestJWT(`{"alg":"RS256","kid":"primary"}`, allowedClaims, "HS256", "primary-secret"), "unsupported token algorithm RS256"},
+		{"alg other than signed with", signTestJWT(`{"alg":"HS512","kid":"primary"}`, allowedClaims, "HS256", "primary-secret"), "invalid token signature"},
+		{"missing alg", signTestJWT(`{"kid":"primary"}`, allowedClaims, "HS256", "primary-secret"), "unsupported token algorithm "},
+		{"unknown key id", signTestJWT(`{"alg":"HS256","kid":"retired"}`, allowedClaims, "HS256", "primary-secret"), "unknown token key id retired"},
+		{"key id of other key", signTestJWT(`{"alg":"HS256","kid":"secondary"}`, allowedClaims, "HS256", "primary-secret"), "invalid token signature"},
+		{"unknown secret", signTestJWT(`{"alg":"HS256"}`, allowedClaims, "HS256", "guessed-secret"), "invalid token signature"},
+		{"tampered claims", tamperedToken, "invalid token signature"},
+		{"expired", signTestJWT(`{"alg":"HS256","kid":"primary"}`, expiredClaims, "HS256", "primary-secret"), "token expired"},
+		{"not valid yet", signTestJWT(`{"alg":"HS256","kid":"primary"}`, futureClaims, "HS256", "primary-secret"), "token not valid yet"},
+		{"malformed header", "%%%." + validTokenParts[1] + "." + validTokenParts[2], "malformed token header"},
+		{"header not JSON", base64.RawURLEncoding.EncodeToString([]byte("HS256")) + "." + validTokenParts[1] + "." + validTokenParts[2], "malformed token header"},
+		{"malformed signature", validTokenParts[0] + "." + validTokenParts[1] + ".%%%", "malformed token signature"},
+		{"claims not JSON", signTestJWT(`{"alg":"HS256","kid":"primary"}`, `ChunkTypes`, "HS256", "primary-secret"), "malformed token payload"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			_, err := authenticator.VerifyToken(testCase.token)
+			if testCase.wantErr == "" {
+				if err != nil {
+					t.Errorf("got error %q, want none", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != testCase.wantErr {
+				t.Errorf("got error %v, want %q", err, testCase.wantErr)
+			}
+		})
+	}
+}
+
+func TestAccessClaimsAllows(t *testing.T) {
+	claims := AccessClaims{
+		ChunkTypes:       []string{"TimeChunk", "all"},
+		ReportingStreams: []string{"*"},
+		ControlSources:   []string{"0a0b0c0d0e0f", "0A0B0C0D0E1F"},
+	}
+
+	testCases := []struct {
+		scope      AuthorizationScope
+		streamName string
+		want       bool
+	}{
+		{AuthorizationScopeChunkTypes, "TimeChunk", true},
+		{AuthorizationScopeChunkTypes, "all", true},
+		{AuthorizationScopeChunkTypes, "FFTChunk", false},
+		{AuthorizationScopeChunkTypes, "timechunk", false},
+		{AuthorizationScopeChunkTypes, "*", false},
+		{AuthorizationScopeReportingStreams, "SystemInfo", true},
+		{AuthorizationScopeReportingStreams, "metrics", true},
+		{AuthorizationScopeControlSources, "0a0b0c0d0e0f", true},
+		{AuthorizationScopeControlSources, "0A0B0C0D0E0F", true},
+		{AuthorizationScopeControlSources, "0a0b0c0d0e1f", true},
+		{AuthorizationScopeControlSources, "0A0b0C0d0E1f", true},
+		{AuthorizationScopeControlSources, "0a0b0c0d0e0e", false},
+		{AuthorizationScopeControlSources, "TimeChunk", false},
+	}
+
+	for _, testCase := range testCases {
+		if got := claims.Allows(testCase.scope, testCase.streamName); got != testCase.want {
+			t.Errorf("Allows(%s, %q) = %v, want %v", testCase.scope, testCase.streamName, got, testCase.want)
+		}
+	}
+
+	if (AccessClaims{}).Allows(AuthorizationScopeChunkTypes, "TimeChunk") {
+		t.Error("claims without lists should allow nothing")
+	}
+}
+
+func TestRequireAuthorization(t *testing.T) {
+	authenticator := newTestAuthenticator(t)
+	reportingToken := signTestJWT(`{"alg":"HS256","kid":"primary"}`, `{"ReportingStreams":["SystemInfo"]}`, "HS256", "primary-secret")
+	chunkToken := signTestJWT(`{"alg":"HS256","kid":"primary"}`, `{"ChunkTypes":["TimeChunk"]}`, "HS256", "primary-secret")
+
+	testCases := []struct {
+		name          string
+		authenticator *Authenticator
+		scope         AuthorizationScope
+		streamName    string
+		authorization string
+		query         string
+		wantStatus    int
+	}{
+		{"allowed by header", authenticator, AuthorizationScopeChunkTypes, "TimeChunk", "Bearer " + chunkToken, "", http.StatusOK},
+		{"allowed by query", authenticator, AuthorizationScopeChunkTypes, "TimeChunk", "", "?access_token=" + chunkToken, http.StatusOK},
+		{"lower case bearer", authenticator, AuthorizationScopeChunkTypes, "TimeChunk", "bearer " + chunkToken, "", http.StatusOK},
+		{"other chunk type", authenticator, AuthorizationScopeChunkTypes, "FFTChunk", "Bearer " + chunkToken, "", http.StatusForbidden},
+		{"chunk claims on reporting stream", authenticator, AuthorizationScopeReportingStreams, "TimeChunk", "Bearer " + chunkToken, "", http.StatusForbidden},
+		{"reporting claims on chunk type", authenticator, AuthorizationScopeChunkTypes, "SystemInfo", "Bearer " + reportingToken, "", http.StatusForbidden},
+		{"reporting claims on reporting stream", authenticator, AuthorizationScopeReportingStreams, "SystemInfo", "Bearer " + reportingToken, "", http.StatusOK},
+		{"no token", authenticator, AuthorizationScopeChunkTypes, "TimeChunk", "", "", http.StatusUnauthorized},
+		{"basic auth", authenticator, AuthorizationScopeChunkTypes, "TimeChunk", "Basic " + chunkToken, "", http.StatusUnauthorized},
+		{"disabled", &Authenticator{}, AuthorizationScopeChunkTypes, "TimeChunk", "", "", http.StatusOK},
+		{"not configured", nil, AuthorizationScopeChunkTypes, "TimeChunk", "", "", http.StatusOK},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			router := gin.New()
+			router.GET("/stream", testCase.authenticator.RequireAuthorization(testCase.scope, testCase.streamName), func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+
+			request := httptest.NewRequest(http.MethodGet, "/stream"+testCase.query, nil)
+			if testCase.authorization != "" {
+				request.Header.Set("Authorization", testCase.authorization)
+			}
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, request)
+
+			if recorder.Code != testCase.wantStatus {
+				t.Errorf("got status %d, want %d: %s", recorder.Code, testCase.wantStatus, recorder.Body.String())
+			}
+		})
+	}
+}
+
+func TestRequireParamAuthorizationIgnoresTheCaseOfSources(t *testing.T) {
+	authenticator := newTestAuthenticator(t)
+	controlToken := signTestJWT(`{"alg":"HS256","kid":"primary"}`, `{"ControlSources":["0A0B0C0D0E0F"]}`, "HS256", "primary-secret")
+
+	router := gin.New()
+	router.POST("/Control/:source", authenticator.RequireParamAuthorization(AuthorizationScopeControlSources, "source"), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	testCases := []struct {
+		source     string
+		wantStatus int
+	}{
+		{"0a0b0c0d0e0f", http.StatusOK},
+		{"0A0B0C0D0E0F", http.StatusOK},
+		{"0a0B0c0D0e0F", http.StatusOK},
+		{"0a0b0c0d0e1f", http.StatusForbidden},
+	}
+	for _, testCase := range testCases {
+		request := httptest.NewRequest(http.MethodPost, "/Control/"+testCase.source, nil)
+		request.Header.Set("Authorization", "Bearer "+controlToken)
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		if recorder.Code != testCase.wantStatus {
+			t.Errorf("source %s: got status %d, want %d", testCase.source, recorder.Code, testCase.wantStatus)
+		}
+	}
+}
+
+func TestParseAuthenticationConfigRefusesSampleSecrets(t *testing.T) {
+	testCases := []struct {
+		name      string
+		enabled   string
+		token     string
+		secret    string
+		wantError bool
+	}{
+		{"sample token", "True", "change-me", "primary-secret", true},
+		{"sample key", "True", "static-token", "change-me-too", true},
+		{"replaced secrets", "True", "static-token", "primary-secret", false},
+		{"sample secrets while disabled", "False", "change-me", "change-me-too", false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			_, err := ParseAuthenticationConfig(map[string]interface{}{
+				"AuthenticationConfig": map[string]interface{}{
+					"Enabled":        testCase.enabled,
+					"BearerTokens":   []interface{}{map[string]interface{}{"Token": testCase.token, "ChunkTypes": []interface{}{"*"}}},
+					"JWTSigningKeys": map[string]interface{}{"default": testCase.secret},
+				},
+			})
+			if (err != nil) != testCase.wantError {
+				t.Errorf("got error %v, want error %v", err, testCase.wantError)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package Routines
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/ugorji/go/codec"
+)
+
+/*
+ChunkEncoding names a wire format a WebSocket client can ask for. The
+names double as the Sec-WebSocket-Protocol values we advertise
+*/
+type ChunkEncoding string
+
+const (
+	ChunkEncodingJSON        ChunkEncoding = "json"
+	ChunkEncodingMessagePack ChunkEncoding = "msgpack"
+	ChunkEncodingCBOR        ChunkEncoding = "cbor"
+)
+
+// Subprotocols offered during the WebSocket upgrade, in order of preference
+var supportedChunkEncodings = []string{
+	string(ChunkEncodingJSON),
+	string(ChunkEncodingMessagePack),
+	string(ChunkEncodingCBOR),
+}
+
+// Query parameter a client can use instead of Sec-WebSocket-Protocol
+const chunkEncodingQueryParameter = "encoding"
+
+var (
+	jsonDecodeHandle  = newJSONDecodeHandle()
+	messagePackHandle = &codec.MsgpackHandle{WriteExt: true}
+	cborHandle        = &codec.CborHandle{}
+)
+
+func newJSONDecodeHandle() *codec.JsonHandle {
+	handle := &codec.JsonHandle{}
+	// Keep string keyed maps so the binary encodings use string keys too
+	handle.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	return handle
+}
+
+/*
+RoutedChunk is a single JSON chunk on its way to WebSocket clients.
+Binary encodings are only produced when a client first asks for them and
+are then cached on the chunk so every client using the same encoding
+shares one transcode
+*/
+type RoutedChunk struct {
+	JSONString     string                   // Chunk as it was received
+	SequenceNumber uint64                   // Position of this chunk within its chunk type, starting at 1
+	ReceivedTime   time.Time                // When the adapter received this chunk
+	encodedData    map[ChunkEncoding][]byte // Cache of transcoded chunk data
+	mu             sync.Mutex               // Mutex to protect access to the cache
+}
+
+func NewRoutedChunk(JSONString string) *RoutedChunk {
+	p := new(RoutedChunk)
+	p.JSONString = JSONString
+	p.ReceivedTime = time.Now()
+	return p
+}
+
+/*
+GetEncodedData returns the chunk in the requested encoding, transcoding
+and caching it if this is the first request for that encoding
+*/
+func (c *RoutedChunk) GetEncodedData(encoding ChunkEncoding) ([]byte, error) {
+
+	if encoding == ChunkEncodingJSON {
+		return []byte(c.JSONString), nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if encodedData, exists := c.encodedData[encoding]; exists {
+		return encodedData, nil
+	}
+
+	var handle codec.Handle
+	switch encoding {
+	case ChunkEncodingMessagePack:
+		handle = messagePackHandle
+	case ChunkEncodingCBOR:
+		handle = cborHandle
+	default:
+		return nil, errors.New("unsupported chunk encoding: " + string(encoding))
+	}
+
+	// Go via a generic value so the output mirrors the JSON document
+	var chunkValue interface{}
+	if err := codec.NewDecoderString(c.JSONString, jsonDecodeHandle).Decode(&chunkValue); err != nil {
+		return nil, err
+	}
+
+	var encodedData []byte
+	if err := codec.NewEncoderBytes(&encodedData, handle).Encode(chunkValue); err != nil {
+		return nil, err
+	}
+
+	if c.encodedData == nil {
+		c.encodedData = make(map[ChunkEncoding][]byte)
+	}
+	c.encodedData[encoding] = encodedData
+
+	return encodedData, nil
+}
+
+/*
+GetWebSocketMessageType returns the frame type a chunk encoding is sent in.
+JSON stays a text frame, everything else is binary
+*/
+func GetWebSocketMessageType(encoding ChunkEncoding) int {
+	if encoding == ChunkEncodingJSON {
+		return websocket.TextMessage
+	}
+	return websocket.BinaryMessage
+}
+
+/*
+ParseChunkEncoding converts a client supplied encoding name into a ChunkEncoding
+
+returns whether the name is supported
+*/
+func ParseChunkEncoding(encodingString string) (ChunkEncoding, bool) {
+	encodingString = strings.ToLower(strings.TrimSpace(encodingString))
+	for _, supportedEncoding := range supportedChunkEncodings {
+		if encodingString == supportedEncoding {
+			return ChunkEncoding(encodingString), true
+		}
+	}
+	return "", false
+}
+
+/*
+GetRequestedChunkEncoding looks for an encoding in the request query. A missing
+parameter falls back to JSON
+
+returns whether the requested encoding is supported
+*/
+func GetRequestedChunkEncoding(request *http.Request) (ChunkEncoding, bool) {
+	encodingString := request.URL.Query().Get(chunkEncodingQueryParameter)
+	if encodingString == "" {
+		return ChunkEncodingJSON, true
+	}
+	return ParseChunkEncoding(encodingString)
+}
+
+/*
+SelectChunkEncoding picks the encoding for an upgraded connection. A negotiated
+subprotocol wins over the query parameter
+*/
+func SelectChunkEncoding(WebSocketConnection *websocket.Conn, requestedEncoding ChunkEncoding) ChunkEncoding {
+	if negotiatedEncoding, supported := ParseChunkEncoding(WebSocketConnection.Subprotocol()); supported {
+		return negotiatedEncoding
+	}
+	return requestedEncoding
+}
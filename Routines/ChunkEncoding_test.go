@@ -0,0 +1,143 @@
+package Routines
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/ugorji/go/codec"
+)
+
+func newTestMessagePackHandle() *codec.MsgpackHandle {
+	handle := &codec.MsgpackHandle{}
+	// Strings come back as strings rather than raw bytes
+	handle.RawToString = true
+	return handle
+}
+
+func TestGetEncodedDataTranscodesOncePerEncoding(t *testing.T) {
+	chunk := NewRoutedChunk(`{"TimeChunk":{"SourceIdentifier":"0a0b","Samples":[1,2,3]}}`)
+
+	if JSONData, err := chunk.GetEncodedData(ChunkEncodingJSON); err != nil || string(JSONData) != chunk.JSONString {
+		t.Fatalf("JSON encoding returned %q, %v, want the chunk unchanged", JSONData, err)
+	}
+
+	testCases := []struct {
+		encoding ChunkEncoding
+		handle   codec.Handle
+	}{
+		{ChunkEncodingMessagePack, newTestMessagePackHandle()},
+		{ChunkEncodingCBOR, &codec.CborHandle{}},
+	}
+	for _, testCase := range testCases {
+		t.Run(string(testCase.encoding), func(t *testing.T) {
+			encodedData, err := chunk.GetEncodedData(testCase.encoding)
+			if err != nil {
+				t.Fatalf("transcoding failed: %v", err)
+			}
+
+			// Every client using the encoding shares the first transcode
+			cachedData, _ := chunk.GetEncodedData(testCase.encoding)
+			if &cachedData[0] != &encodedData[0] {
+				t.Error("second request transcoded the chunk again")
+			}
+
+			var decodedChunk map[string]interface{}
+			if err := codec.NewDecoderBytes(encodedData, testCase.handle).Decode(&decodedChunk); err != nil {
+				t.Fatalf("could not decode the transcoded chunk: %v", err)
+			}
+			timeChunk, isMap := decodedChunk["TimeChunk"].(map[interface{}]interface{})
+			if !isMap {
+				t.Fatalf("decoded %#v, want a TimeChunk map", decodedChunk)
+			}
+			if sourceIdentifier, _ := timeChunk["SourceIdentifier"].(string); sourceIdentifier != "0a0b" {
+				t.Errorf("decoded SourceIdentifier %#v, want 0a0b", timeChunk["SourceIdentifier"])
+			}
+			if samples := reflect.ValueOf(timeChunk["Samples"]); samples.Kind() != reflect.Slice || samples.Len() != 3 {
+				t.Errorf("decoded Samples %#v, want three samples", timeChunk["Samples"])
+			}
+		})
+	}
+
+	if _, err := chunk.GetEncodedData(ChunkEncoding("xml")); err == nil {
+		t.Error("unsupported encoding did not fail")
+	}
+}
+
+func TestParseChunkEncoding(t *testing.T) {
+	testCases := []struct {
+		encodingString string
+		wantEncoding   ChunkEncoding
+		wantSupported  bool
+	}{
+		{"json", ChunkEncodingJSON, true},
+		{"msgpack", ChunkEncodingMessagePack, true},
+		{" CBOR ", ChunkEncodingCBOR, true},
+		{"xml", "", false},
+		{"", "", false},
+	}
+	for _, testCase := range testCases {
+		encoding, supported := ParseChunkEncoding(testCase.encodingString)
+		if encoding != testCase.wantEncoding || supported != testCase.wantSupported {
+			t.Errorf("ParseChunkEncoding(%q) = %q, %v, want %q, %v", testCase.encodingString, encoding, supported, testCase.wantEncoding, testCase.wantSupported)
+		}
+	}
+}
+
+func TestSelectChunkEncodingNegotiatesWithTheClient(t *testing.T) {
+	upgrader := websocket.Upgrader{Subprotocols: supportedChunkEncodings}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestedEncoding, supported := GetRequestedChunkEncoding(r)
+		if !supported {
+			http.Error(w, "Unsupported encoding", http.StatusBadRequest)
+			return
+		}
+		WebSocketConnection, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer WebSocketConnection.Close()
+		WebSocketConnection.WriteMessage(websocket.TextMessage, []byte(SelectChunkEncoding(WebSocketConnection, requestedEncoding)))
+	}))
+	defer server.Close()
+
+	testCases := []struct {
+		name         string
+		query        string
+		subprotocols []string
+		wantEncoding ChunkEncoding
+	}{
+		{"default", "", nil, ChunkEncodingJSON},
+		{"query parameter", "?encoding=msgpack", nil, ChunkEncodingMessagePack},
+		{"subprotocol", "", []string{"cbor"}, ChunkEncodingCBOR},
+		{"subprotocol wins over query parameter", "?encoding=msgpack", []string{"cbor"}, ChunkEncodingCBOR},
+		{"unknown subprotocol", "", []string{"xml"}, ChunkEncodingJSON},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			dialer := websocket.Dialer{Subprotocols: testCase.subprotocols}
+			WebSocketConnection, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+testCase.query, nil)
+			if err != nil {
+				t.Fatalf("could not connect: %v", err)
+			}
+			defer WebSocketConnection.Close()
+
+			_, encoding, err := WebSocketConnection.ReadMessage()
+			if err != nil || ChunkEncoding(encoding) != testCase.wantEncoding {
+				t.Errorf("got encoding %q, %v, want %q", encoding, err, testCase.wantEncoding)
+			}
+		})
+	}
+
+	response, err := http.Get(server.URL + "?encoding=xml")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusBadRequest {
+		t.Errorf("unsupported encoding got status %d, want %d", response.StatusCode, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,201 @@
+package Routines
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+ChunkRingBuffer keeps the most recent chunks of a single chunk type. Once
+full, each new chunk overwrites the oldest one
+*/
+type ChunkRingBuffer struct {
+	chunks     []*RoutedChunk // Fixed size storage for the chunks
+	startIndex int            // Index of the oldest chunk
+	count      int            // Number of chunks currently stored
+	mu         sync.Mutex     // Mutex to protect access to the buffer
+}
+
+func NewChunkRingBuffer(capacity int) *ChunkRingBuffer {
+	p := new(ChunkRingBuffer)
+	if capacity < 1 {
+		capacity = 1
+	}
+	p.chunks = make([]*RoutedChunk, capacity)
+	return p
+}
+
+func (b *ChunkRingBuffer) Push(chunk *RoutedChunk) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.count < len(b.chunks) {
+		b.chunks[(b.startIndex+b.count)%len(b.chunks)] = chunk
+		b.count++
+		return
+	}
+
+	// Full so overwrite the oldest
+	b.chunks[b.startIndex] = chunk
+	b.startIndex = (b.startIndex + 1) % len(b.chunks)
+}
+
+/*
+GetLatest returns the newest chunk
+
+returns false if no chunks have been stored
+*/
+func (b *ChunkRingBuffer) GetLatest() (*RoutedChunk, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.count == 0 {
+		return nil, false
+	}
+	return b.chunks[(b.startIndex+b.count-1)%len(b.chunks)], true
+}
+
+/*
+GetRecent returns up to the last n chunks, oldest first
+*/
+func (b *ChunkRingBuffer) GetRecent(n int) []*RoutedChunk {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if n > b.count {
+		n = b.count
+	}
+	if n < 0 {
+		n = 0
+	}
+
+	recentChunks := make([]*RoutedChunk, 0, n)
+	for i := b.count - n; i < b.count; i++ {
+		recentChunks = append(recentChunks, b.chunks[(b.startIndex+i)%len(b.chunks)])
+	}
+	return recentChunks
+}
+
+/*
+GetHistory returns the chunks a new subscriber should be replayed, oldest
+first. Either limit can be zero to disable it
+*/
+func (b *ChunkRingBuffer) GetHistory(maxChunks int, maxAge time.Duration) []*RoutedChunk {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	firstIndex := 0
+	if maxChunks > 0 && maxChunks < b.count {
+		firstIndex = b.count - maxChunks
+	}
+
+	historyChunks := make([]*RoutedChunk, 0, b.count-firstIndex)
+	for i := firstIndex; i < b.count; i++ {
+		chunk := b.chunks[(b.startIndex+i)%len(b.chunks)]
+		if maxAge > 0 && time.Since(chunk.ReceivedTime) > maxAge {
+			continue
+		}
+		historyChunks = append(historyChunks, chunk)
+	}
+	return historyChunks
+}
+
+/*
+GetAfterSequenceNumber returns the stored chunks newer than a sequence
+number, oldest first
+*/
+func (b *ChunkRingBuffer) GetAfterSequenceNumber(sequenceNumber uint64) []*RoutedChunk {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	newerChunks := make([]*RoutedChunk, 0)
+	for i := 0; i < b.count; i++ {
+		chunk := b.chunks[(b.startIndex+i)%len(b.chunks)]
+		if chunk.SequenceNumber > sequenceNumber {
+			newerChunks = append(newerChunks, chunk)
+		}
+	}
+	return newerChunks
+}
+
+func (b *ChunkRingBuffer) Capacity() int {
+	return len(b.chunks)
+}
+
+/*
+GetReplayChunks returns the history configured for a chunk type that should
+be sent to a subscriber before any live data, or its last known values when
+those are kept
+*/
+func (s *ChunkTypeToChannelMap) GetReplayChunks(chunkTypeString string) []*RoutedChunk {
+
+	if lastKnownValues, enabled := s.GetLastKnownValues(chunkTypeString); enabled {
+		return lastKnownValues
+	}
+
+	chunkTypeConfig := s.serverConfig.ChunkRouting.GetChunkTypeConfig(chunkTypeString)
+	if chunkTypeConfig.HistoryChunks == 0 && chunkTypeConfig.HistoryMaxAge == 0 {
+		return nil
+	}
+
+	chunkHistory, exists := s.TryGetChunkHistory(chunkTypeString)
+	if !exists {
+		return nil
+	}
+
+	return chunkHistory.GetHistory(chunkTypeConfig.HistoryChunks, chunkTypeConfig.HistoryMaxAge)
+}
+
+/*
+HandleLatestChunkRequest responds with the most recent chunk of a type as it
+was received
+*/
+func (s *ChunkTypeToChannelMap) HandleLatestChunkRequest(c *gin.Context, chunkTypeString string) {
+
+	chunkHistory, exists := s.TryGetChunkHistory(chunkTypeString)
+	if !exists {
+		c.String(http.StatusNotFound, "No chunks received for "+chunkTypeString)
+		return
+	}
+
+	chunk, exists := chunkHistory.GetLatest()
+	if !exists {
+		c.String(http.StatusNotFound, "No chunks received for "+chunkTypeString)
+		return
+	}
+
+	c.Data(http.StatusOK, "application/json", []byte(chunk.JSONString))
+}
+
+/*
+HandleRecentChunksRequest responds with a JSON array of the last n chunks of
+a type, oldest first. n defaults to 10 and is limited by the buffer size
+*/
+func (s *ChunkTypeToChannelMap) HandleRecentChunksRequest(c *gin.Context, chunkTypeString string) {
+
+	chunkCount, err := strconv.Atoi(c.DefaultQuery("n", "10"))
+	if err != nil || chunkCount < 1 {
+		c.String(http.StatusBadRequest, "n should be a positive integer")
+		return
+	}
+
+	chunkHistory, exists := s.TryGetChunkHistory(chunkTypeString)
+	if !exists {
+		c.String(http.StatusNotFound, "No chunks received for "+chunkTypeString)
+		return
+	}
+
+	// The chunks are already JSON so join them rather than re-encoding
+	recentChunks := chunkHistory.GetRecent(chunkCount)
+	JSONStrings := make([]string, 0, len(recentChunks))
+	for _, chunk := range recentChunks {
+		JSONStrings = append(JSONStrings, chunk.JSONString)
+	}
+
+	c.Data(http.StatusOK, "application/json", []byte("["+strings.Join(JSONStrings, ",")+"]"))
+}
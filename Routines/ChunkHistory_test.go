@@ -0,0 +1,276 @@
+package Routines
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func newTestHistoryChunk(index int) *RoutedChunk {
+	chunk := NewRoutedChunk(`{"TimeChunk":{"Index":` + strconv.Itoa(index) + `}}`)
+	chunk.SequenceNumber = uint64(index)
+	return chunk
+}
+
+func getSequenceNumbers(chunks []*RoutedChunk) []uint64 {
+	sequenceNumbers := make([]uint64, 0, len(chunks))
+	for _, chunk := range chunks {
+		sequenceNumbers = append(sequenceNumbers, chunk.SequenceNumber)
+	}
+	return sequenceNumbers
+}
+
+func TestChunkRingBufferKeepsTheMostRecentChunks(t *testing.T) {
+	chunkHistory := NewChunkRingBuffer(3)
+	if _, exists := chunkHistory.GetLatest(); exists {
+		t.Fatal("empty buffer returned a latest chunk")
+	}
+
+	for index := 1; index <= 5; index++ {
+		chunkHistory.Push(newTestHistoryChunk(index))
+	}
+
+	if latestChunk, exists := chunkHistory.GetLatest(); !exists || latestChunk.SequenceNumber != 5 {
+		t.Errorf("latest chunk is %v, want chunk 5", latestChunk)
+	}
+
+	testCases := []struct {
+		n                   int
+		wantSequenceNumbers []uint64
+	}{
+		{2, []uint64{4, 5}},
+		{3, []uint64{3, 4, 5}},
+		{10, []uint64{3, 4, 5}},
+		{0, []uint64{}},
+	}
+	for _, testCase := range testCases {
+		sequenceNumbers := getSequenceNumbers(chunkHistory.GetRecent(testCase.n))
+		if len(sequenceNumbers) != len(testCase.wantSequenceNumbers) {
+			t.Errorf("GetRecent(%d) = %v, want %v", testCase.n, sequenceNumbers, testCase.wantSequenceNumbers)
+			continue
+		}
+		for i := range sequenceNumbers {
+			if sequenceNumbers[i] != testCase.wantSequenceNumbers[i] {
+				t.Errorf("GetRecent(%d) = %v, want %v", testCase.n, sequenceNumbers, testCase.wantSequenceNumbers)
+				break
+			}
+		}
+	}
+}
+
+func TestRecentChunkEndpoints(t *testing.T) {
+	chunkRouter := newTestChunkRouter(t, newTestServerConfig(t, map[string]interface{}{"RecentChunkBufferSize": "3"}))
+	for index := 1; index <= 5; index++ {
+		chunkRouter.sendChunk("TimeChunk", `{"TimeChunk":{"Index":`+strconv.Itoa(index)+`}}`)
+	}
+
+	testCases := []struct {
+		path        string
+		wantStatus  int
+		wantIndexes []int
+	}{
+		{"/DataTypes/TimeChunk/latest", http.StatusOK, []int{5}},
+		{"/DataTypes/TimeChunk/recent", http.StatusOK, []int{3, 4, 5}},
+		{"/DataTypes/TimeChunk/recent?n=2", http.StatusOK, []int{4, 5}},
+		{"/DataTypes/TimeChunk/recent?n=0", http.StatusBadRequest, nil},
+		{"/DataTypes/TimeChunk/recent?n=abc", http.StatusBadRequest, nil},
+		{"/DataTypes/FFTChunk/latest", http.StatusNotFound, nil},
+	}
+	for _, testCase := range testCases {
+		response := httptest.NewRecorder()
+		chunkRouter.router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, testCase.path, nil))
+		if response.Code != testCase.wantStatus {
+			t.Errorf("%s got status %d, want %d", testCase.path, response.Code, testCase.wantStatus)
+			continue
+		}
+		if testCase.wantStatus != http.StatusOK {
+			continue
+		}
+
+		// The latest chunk comes back on its own and recent ones as an array
+		var chunks []map[string]struct{ Index int }
+		body := response.Body.Bytes()
+		if strings.HasSuffix(testCase.path, "/latest") {
+			body = append(append([]byte("["), body...), ']')
+		}
+		if err := json.Unmarshal(body, &chunks); err != nil {
+			t.Fatalf("%s returned %s: %v", testCase.path, response.Body.String(), err)
+		}
+		indexes := make([]int, 0, len(chunks))
+		for _, chunk := range chunks {
+			indexes = append(indexes, chunk["TimeChunk"].Index)
+		}
+		if len(indexes) != len(testCase.wantIndexes) {
+			t.Errorf("%s returned chunks %v, want %v", testCase.path, indexes, testCase.wantIndexes)
+			continue
+		}
+		for i := range indexes {
+			if indexes[i] != testCase.wantIndexes[i] {
+				t.Errorf("%s returned chunks %v, want %v", testCase.path, indexes, testCase.wantIndexes)
+				break
+			}
+		}
+	}
+}
+
+func TestChunkRingBufferGetHistoryByDepthAndAge(t *testing.T) {
+	chunkHistory := NewChunkRingBuffer(10)
+
+	// Chunk 1 is four minutes old and chunk 5 was received just now
+	now := time.Now()
+	for index := 1; index <= 5; index++ {
+		chunk := newTestHistoryChunk(index)
+		chunk.ReceivedTime = now.Add(time.Duration(index-5) * time.Minute)
+		chunkHistory.Push(chunk)
+	}
+
+	testCases := []struct {
+		name                string
+		maxChunks           int
+		maxAge              time.Duration
+		wantSequenceNumbers []uint64
+	}{
+		{"no limits", 0, 0, []uint64{1, 2, 3, 4, 5}},
+		{"by depth", 3, 0, []uint64{3, 4, 5}},
+		{"by age", 0, 90 * time.Second, []uint64{4, 5}},
+		{"age within depth", 4, 150 * time.Second, []uint64{3, 4, 5}},
+		{"depth within age", 1, time.Hour, []uint64{5}},
+	}
+	for _, testCase := range testCases {
+		sequenceNumbers := getSequenceNumbers(chunkHistory.GetHistory(testCase.maxChunks, testCase.maxAge))
+		if !equalSequenceNumbers(sequenceNumbers, testCase.wantSequenceNumbers) {
+			t.Errorf("%s: got %v, want %v", testCase.name, sequenceNumbers, testCase.wantSequenceNumbers)
+		}
+	}
+
+	if sequenceNumbers := getSequenceNumbers(chunkHistory.GetAfterSequenceNumber(3)); !equalSequenceNumbers(sequenceNumbers, []uint64{4, 5}) {
+		t.Errorf("chunks after 3 are %v, want [4 5]", sequenceNumbers)
+	}
+}
+
+func equalSequenceNumbers(sequenceNumbers []uint64, wantSequenceNumbers []uint64) bool {
+	if len(sequenceNumbers) != len(wantSequenceNumbers) {
+		return false
+	}
+	for i := range sequenceNumbers {
+		if sequenceNumbers[i] != wantSequenceNumbers[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestReplayChunksFollowTheChunkTypeConfig(t *testing.T) {
+	chunkRouter := newTestChunkRouter(t, newTestServerConfig(t, map[string]interface{}{
+		"ChunkRoutingConfig": map[string]interface{}{
+			"TimeChunk": map[string]interface{}{"HistorySeconds": "1"},
+			"FFTChunk":  map[string]interface{}{"HistoryChunks": "2"},
+		},
+	}))
+
+	for index := 1; index <= 5; index++ {
+		chunkRouter.sendChunk("TimeChunk", `{"TimeChunk":{"Index":`+strconv.Itoa(index)+`}}`)
+		chunkRouter.sendChunk("FFTChunk", `{"FFTChunk":{"Index":`+strconv.Itoa(index)+`}}`)
+		chunkRouter.sendChunk("GPSChunk", `{"GPSChunk":{"Index":`+strconv.Itoa(index)+`}}`)
+	}
+
+	if replayChunks := chunkRouter.chunkTypeRoutingMap.GetReplayChunks("FFTChunk"); len(replayChunks) != 2 {
+		t.Errorf("FFTChunk replays %d chunks, want 2", len(replayChunks))
+	}
+	if replayChunks := chunkRouter.chunkTypeRoutingMap.GetReplayChunks("GPSChunk"); len(replayChunks) != 0 {
+		t.Errorf("GPSChunk replays %d chunks without any history configured", len(replayChunks))
+	}
+
+	// Only the chunk sent after the others aged out is replayed
+	time.Sleep(1100 * time.Millisecond)
+	chunkRouter.sendChunk("TimeChunk", `{"TimeChunk":{"Index":6}}`)
+	replayChunks := chunkRouter.chunkTypeRoutingMap.GetReplayChunks("TimeChunk")
+	if len(replayChunks) != 1 || !strings.Contains(replayChunks[0].JSONString, `"Index":6`) {
+		t.Errorf("TimeChunk replays %d chunks, want only the newest", len(replayChunks))
+	}
+}
+
+func TestNewSubscribersAreReplayedHistory(t *testing.T) {
+	chunkRouter := newTestChunkRouter(t, newTestServerConfig(t, map[string]interface{}{
+		"ChunkRoutingConfig": map[string]interface{}{
+			"TimeChunk": map[string]interface{}{"HistoryChunks": "2"},
+		},
+	}))
+	for index := 1; index <= 5; index++ {
+		chunkRouter.sendChunk("TimeChunk", `{"TimeChunk":{"Index":`+strconv.Itoa(index)+`}}`)
+	}
+	newestSequenceNumber := chunkRouter.chunkTypeRoutingMap.GetSequenceNumber("TimeChunk")
+
+	server := httptest.NewServer(chunkRouter.router)
+	defer server.Close()
+
+	t.Run("WebSocket", func(t *testing.T) {
+		WebSocketConnection, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/DataTypes/TimeChunk", nil)
+		if err != nil {
+			t.Fatalf("could not connect: %v", err)
+		}
+		defer WebSocketConnection.Close()
+
+		for _, wantIndex := range []int{4, 5} {
+			WebSocketConnection.SetReadDeadline(time.Now().Add(time.Second))
+			var chunk map[string]struct{ Index int }
+			if err := WebSocketConnection.ReadJSON(&chunk); err != nil || chunk["TimeChunk"].Index != wantIndex {
+				t.Fatalf("got chunk %v, %v, want chunk %d replayed", chunk, err, wantIndex)
+			}
+		}
+	})
+
+	t.Run("Server-Sent Events", func(t *testing.T) {
+		testCases := []struct {
+			name                string
+			lastEventID         uint64
+			wantSequenceNumbers []uint64
+		}{
+			{"new client", 0, []uint64{newestSequenceNumber - 1, newestSequenceNumber}},
+			{"resuming client", newestSequenceNumber - 3, []uint64{newestSequenceNumber - 2, newestSequenceNumber - 1, newestSequenceNumber}},
+		}
+		for _, testCase := range testCases {
+			sequenceNumbers := receiveServerSentEventIDs(t, server.URL+"/sse/TimeChunk", testCase.lastEventID, len(testCase.wantSequenceNumbers))
+			if !equalSequenceNumbers(sequenceNumbers, testCase.wantSequenceNumbers) {
+				t.Errorf("%s was replayed events %v, want %v", testCase.name, sequenceNumbers, testCase.wantSequenceNumbers)
+			}
+		}
+	})
+}
+
+/*
+receiveServerSentEventIDs opens an event stream and returns the ids of the
+first count events
+*/
+func receiveServerSentEventIDs(t *testing.T, URL string, lastEventID uint64, count int) []uint64 {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	request, _ := http.NewRequestWithContext(ctx, http.MethodGet, URL, nil)
+	if lastEventID > 0 {
+		request.Header.Set("Last-Event-ID", strconv.FormatUint(lastEventID, 10))
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("could not open event stream: %v", err)
+	}
+	defer response.Body.Close()
+
+	sequenceNumbers := make([]uint64, 0, count)
+	scanner := bufio.NewScanner(response.Body)
+	for len(sequenceNumbers) < count && scanner.Scan() {
+		if eventID, isID := strings.CutPrefix(scanner.Text(), "id:"); isID {
+			sequenceNumber, _ := strconv.ParseUint(eventID, 10, 64)
+			sequenceNumbers = append(sequenceNumbers, sequenceNumber)
+		}
+	}
+	return sequenceNumbers
+}
@@ -0,0 +1,178 @@
+package Routines
+
+import (
+	"math"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Chunks are stamped with the time the TCP routine finished reassembling them.
+The router measures how long each took to reach its routing queue and each
+WebSocket client measures how long until it was written, so time spent
+inside the adapter can be reported per chunk type as p50, p95 and p99
+*/
+
+// Stages a chunk's latency is measured at
+const (
+	LatencyStageRouting = "Routing" // Queued for its chunk type
+	LatencyStageWrite   = "Write"   // Written to a WebSocket client
+)
+
+const (
+	latencyBucketsPerOctave = 4  // Buckets double in width every this many, so percentiles are within 19%
+	latencyBucketCount      = 96 // Covers 1µs to about 16s, slower chunks fall in the last bucket
+)
+
+var latencyPercentiles = []float64{50, 95, 99}
+
+/*
+ReceivedChunk is a reassembled JSON chunk and when it was received. The time
+carries Go's monotonic clock reading so latencies are not skewed by wall
+clock changes
+*/
+type ReceivedChunk struct {
+	JSONString        string
+	ReceivedTime      time.Time
+	LastKnownValueKey string // What the chunk is the latest value of, empty if it is not kept
+}
+
+func NewReceivedChunk(JSONString string) ReceivedChunk {
+	return ReceivedChunk{JSONString: JSONString, ReceivedTime: time.Now()}
+}
+
+/*
+LatencyHistogram counts latencies in logarithmic buckets. It is safe to
+record from many goroutines without locking and is emptied each time its
+percentiles are taken
+*/
+type LatencyHistogram struct {
+	buckets [latencyBucketCount]atomic.Uint64
+}
+
+func (h *LatencyHistogram) Record(latency time.Duration) {
+	microseconds := float64(latency) / float64(time.Microsecond)
+	bucketIndex := 0
+	if microseconds > 1 {
+		bucketIndex = int(math.Log2(microseconds) * latencyBucketsPerOctave)
+	}
+	if bucketIndex >= latencyBucketCount {
+		bucketIndex = latencyBucketCount - 1
+	}
+	h.buckets[bucketIndex].Add(1)
+}
+
+/*
+TakePercentiles empties the histogram and returns the upper bound of the
+bucket holding each requested percentile
+
+returns false if nothing was recorded
+*/
+func (h *LatencyHistogram) TakePercentiles(percentiles []float64) ([]time.Duration, bool) {
+
+	var bucketCounts [latencyBucketCount]uint64
+	var totalCount uint64
+	for bucketIndex := range h.buckets {
+		bucketCounts[bucketIndex] = h.buckets[bucketIndex].Swap(0)
+		totalCount += bucketCounts[bucketIndex]
+	}
+	if totalCount == 0 {
+		return nil, false
+	}
+
+	percentileLatencies := make([]time.Duration, len(percentiles))
+	for percentileIndex, percentile := range percentiles {
+		// The rank of the sample at this percentile, counting from 1
+		rank := uint64(math.Ceil(percentile / 100 * float64(totalCount)))
+		if rank < 1 {
+			rank = 1
+		}
+
+		var cumulativeCount uint64
+		for bucketIndex, bucketCount := range bucketCounts {
+			cumulativeCount += bucketCount
+			if cumulativeCount >= rank {
+				percentileLatencies[percentileIndex] = getLatencyBucketUpperBound(bucketIndex)
+				break
+			}
+		}
+	}
+	return percentileLatencies, true
+}
+
+func getLatencyBucketUpperBound(bucketIndex int) time.Duration {
+	return time.Duration(math.Exp2(float64(bucketIndex+1)/latencyBucketsPerOctave) * float64(time.Microsecond))
+}
+
+/*
+ChunkTypeLatency holds the latency histograms of one chunk type
+*/
+type ChunkTypeLatency struct {
+	Routing LatencyHistogram // From receipt until queued for routing
+	Write   LatencyHistogram // From receipt until written to a WebSocket client
+}
+
+/*
+GetChunkTypeLatency returns the latency histograms of a chunk type, making
+them on first use
+*/
+func (s *ChunkTypeToChannelMap) GetChunkTypeLatency(chunkTypeString string) *ChunkTypeLatency {
+
+	s.mu.RLock()
+	chunkTypeLatency, exists := s.latencyMap[chunkTypeString]
+	s.mu.RUnlock()
+	if exists {
+		return chunkTypeLatency
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.latencyMap == nil {
+		s.latencyMap = make(map[string]*ChunkTypeLatency)
+	}
+	if chunkTypeLatency, exists = s.latencyMap[chunkTypeString]; !exists {
+		chunkTypeLatency = new(ChunkTypeLatency)
+		s.latencyMap[chunkTypeString] = chunkTypeLatency
+	}
+	return chunkTypeLatency
+}
+
+/*
+ReportChunkLatency sends the latency percentiles of every chunk type and
+stage that saw chunks since the last report
+*/
+func (s *ChunkTypeToChannelMap) ReportChunkLatency() {
+
+	s.mu.RLock()
+	chunkTypeLatencies := make(map[string]*ChunkTypeLatency, len(s.latencyMap))
+	for chunkTypeString, chunkTypeLatency := range s.latencyMap {
+		chunkTypeLatencies[chunkTypeString] = chunkTypeLatency
+	}
+	s.mu.RUnlock()
+
+	for chunkTypeString, chunkTypeLatency := range chunkTypeLatencies {
+		s.reportLatencyHistogram(chunkTypeString, LatencyStageRouting, &chunkTypeLatency.Routing)
+		s.reportLatencyHistogram(chunkTypeString, LatencyStageWrite, &chunkTypeLatency.Write)
+	}
+}
+
+func (s *ChunkTypeToChannelMap) reportLatencyHistogram(chunkTypeString string, stage string, latencyHistogram *LatencyHistogram) {
+
+	percentileLatencies, recorded := latencyHistogram.TakePercentiles(latencyPercentiles)
+	if !recorded {
+		return
+	}
+
+	for percentileIndex, percentile := range latencyPercentiles {
+		percentileString := "P" + strconv.FormatFloat(percentile, 'f', -1, 64)
+		latencyMilliseconds := float64(percentileLatencies[percentileIndex]) / float64(time.Millisecond)
+
+		SendMetric(s.reportingOutputChannel, NewMetricStatistic(chunkTypeString+"_"+stage+"_Latency_"+percentileString, latencyMilliseconds, MetricUnitMilliseconds).
+			WithMetric("chunk_latency_milliseconds", map[string]string{
+				"chunk_type": chunkTypeString,
+				"stage":      stage,
+				"quantile":   strconv.FormatFloat(percentile/100, 'f', -1, 64),
+			}))
+	}
+}
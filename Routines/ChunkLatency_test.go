@@ -0,0 +1,85 @@
+package Routines
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogramPercentiles(t *testing.T) {
+	var latencyHistogram LatencyHistogram
+	if _, recorded := latencyHistogram.TakePercentiles(latencyPercentiles); recorded {
+		t.Fatal("empty histogram returned percentiles")
+	}
+
+	recordLatencies := func(latency time.Duration, count int) {
+		for i := 0; i < count; i++ {
+			latencyHistogram.Record(latency)
+		}
+	}
+	recordLatencies(time.Millisecond, 90)
+	recordLatencies(10*time.Millisecond, 8)
+	recordLatencies(100*time.Millisecond, 2)
+
+	percentileLatencies, recorded := latencyHistogram.TakePercentiles(latencyPercentiles)
+	if !recorded {
+		t.Fatal("no percentiles returned")
+	}
+
+	// Each percentile is the upper bound of its bucket so it is at most 19% high
+	wantLatencies := []time.Duration{time.Millisecond, 10 * time.Millisecond, 100 * time.Millisecond}
+	for percentileIndex, wantLatency := range wantLatencies {
+		latency := percentileLatencies[percentileIndex]
+		if latency < wantLatency || latency > wantLatency*119/100 {
+			t.Errorf("P%v is %v, want within 19%% above %v", latencyPercentiles[percentileIndex], latency, wantLatency)
+		}
+	}
+
+	if _, recorded := latencyHistogram.TakePercentiles(latencyPercentiles); recorded {
+		t.Error("histogram was not emptied when its percentiles were taken")
+	}
+}
+
+func TestLatencyHistogramOutOfRangeLatencies(t *testing.T) {
+	var latencyHistogram LatencyHistogram
+	latencyHistogram.Record(0)
+	latencyHistogram.Record(time.Hour)
+
+	percentileLatencies, _ := latencyHistogram.TakePercentiles([]float64{50, 100})
+	if percentileLatencies[0] > 2*time.Microsecond {
+		t.Errorf("no latency is reported as %v, want the smallest bucket", percentileLatencies[0])
+	}
+	if percentileLatencies[1] != getLatencyBucketUpperBound(latencyBucketCount-1) {
+		t.Errorf("an hour is reported as %v, want the largest bucket", percentileLatencies[1])
+	}
+}
+
+func TestReportChunkLatency(t *testing.T) {
+	reportingChannel := make(chan string, 100)
+	chunkTypeRoutingMap := NewChunkTypeToChannelMap(newTestLoggingChannel(t), reportingChannel, newTestServerConfig(t, nil))
+	chunkTypeRoutingMap.GetChunkTypeLatency("TimeChunk").Routing.Record(2 * time.Millisecond)
+	chunkTypeRoutingMap.GetChunkTypeLatency("TimeChunk")
+
+	chunkTypeRoutingMap.ReportChunkLatency()
+	close(reportingChannel)
+
+	// Only the stage that saw chunks is reported
+	wantStatNames := map[string]bool{"TimeChunk_Routing_Latency_P50": true, "TimeChunk_Routing_Latency_P95": true, "TimeChunk_Routing_Latency_P99": true}
+	for message := range reportingChannel {
+		var systemMetric SystemMetric
+		if err := json.Unmarshal([]byte(message), &systemMetric); err != nil {
+			t.Fatalf("reported %s: %v", message, err)
+		}
+		if systemMetric.Metric.StatName == "" {
+			// Not a SystemMetric message
+			continue
+		}
+		if !wantStatNames[systemMetric.Metric.StatName] {
+			t.Errorf("reported %s, want only routing latency percentiles", systemMetric.Metric.StatName)
+		}
+		delete(wantStatNames, systemMetric.Metric.StatName)
+	}
+	if len(wantStatNames) != 0 {
+		t.Errorf("%v were not reported", wantStatNames)
+	}
+}
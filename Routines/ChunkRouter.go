@@ -1,8 +1,9 @@
 package Routines
 
 import (
+	"net"
+	"net/http"
 	"sync"
-	"encoding/json"
 	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog"
 	"github.com/gorilla/websocket"
@@ -11,15 +12,13 @@ import (
 	"sync/atomic"
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  8096,
-	WriteBufferSize: 8096,
-}
-
 ///
 ///			ROUTINE SAFE MAP FUNCTIONS
 ///
 
+// Path parameter naming the chunk type on every chunk type route
+const chunkTypeParameter = "chunkType"
+
 /*
 Routine safe map of key value pairs of strings and channels.
 Each string corresponds to channel to send a chunk type to a
@@ -28,92 +27,292 @@ routine that shall handle that chunk
 type ChunkTypeToChannelMap struct {
 	loggingOutputChannel 	chan map[zerolog.Level]string	// Channel to stream logging messages
 	reportingOutputChannel 	chan string	// Channel to stream Reporting messages
-	chunkTypeRoutingMap 	map[string](chan string) 		// Map of chunk type string and channel key value pairs
-	mu                  	sync.Mutex               		// Mutex to protect access to the map
+	chunkTypeRoutingMap 	map[string](chan *RoutedChunk) 	// Map of chunk type string and channel key value pairs
+	allChunkTypesQueue		chan *RoutedChunk				// Envelopes of every chunk type waiting for the clients of /DataTypes/all
+	sequenceNumberMap		map[string]uint64				// Map of chunk type string and the last sequence number given out
+	chunkHistoryMap			map[string]*ChunkRingBuffer		// Map of chunk type string and its most recent chunks
+	droppedChunkCountMap	map[string]uint64				// Map of chunk type string and how many chunks overflowed its queue
+	reportedDropCountMap	map[string]uint64				// Map of chunk type string and the drop count when last reported
+	throughputMap			map[string]*ChunkThroughputTracker // Map of chunk type string and its recent chunk and byte rates
+	latencyMap				map[string]*ChunkTypeLatency	// Map of chunk type string and how long its chunks take to pass through
+	lastSeenTimeMap			map[string]time.Time			// Map of chunk type string and when it was last received
+	staleChunkTypeSet		map[string]bool					// Set of chunk types whose queues were freed after going idle
+	subscriberMap			map[string]map[*ChunkSubscriber]struct{} // Map of chunk type string and the clients subscribed to it
+	stateChangedMap			map[string]chan struct{}		// Map of chunk type string and a channel closed when its queues are made or freed
+	dispatcherStopMap		map[string]chan struct{}		// Map of chunk type string and a channel closed to stop its dispatcher
+	lastKnownValueMap		map[string]map[string]*RoutedChunk // Map of chunk type string, key and newest chunk, only kept when enabled
+	disconnectedSlowClientCount atomic.Uint64				// Number of clients disconnected for being too slow
+	mu                  	sync.RWMutex               		// Mutex to protect access to the maps, readers far outnumber writers
+	serverConfig			WebSocketServerConfig			// Settings of the server this map routes for
+	upgrader				*websocket.Upgrader				// Upgrader configured for the server this map routes for
+	routePrefix				string							// Path each chunk type's WebSocket and REST routes are registered under
+	serverSentEventsRoutePrefix string						// Path each chunk type's Server-Sent Events route is registered under
 }
 
-func NewChunkTypeToChannelMap(loggingOutputChannel 	chan map[zerolog.Level]string, reportingOutputChannel chan string) *ChunkTypeToChannelMap {
+func NewChunkTypeToChannelMap(loggingOutputChannel 	chan map[zerolog.Level]string, reportingOutputChannel chan string, serverConfig WebSocketServerConfig) *ChunkTypeToChannelMap {
     p := new(ChunkTypeToChannelMap)
     p.loggingOutputChannel = loggingOutputChannel
 	p.reportingOutputChannel = reportingOutputChannel 
+	p.serverConfig = serverConfig
+	p.routePrefix = "/DataTypes/"
+	p.serverSentEventsRoutePrefix = "/sse/"
+	p.upgrader = NewWebSocketUpgrader(serverConfig)
+	// Made here so readers holding only the read lock never see it change
+	p.chunkTypeRoutingMap = make(map[string]chan *RoutedChunk)
+	p.allChunkTypesQueue = make(chan *RoutedChunk, chunkRoutingQueueCapacity)
     return p
 }
+/*
+SetRoutePrefixes changes the paths routes are registered under from
+/DataTypes/<ChunkType> and /sse/<ChunkType>, so one server can route by more
+than one key. It has to be called before any routes are registered
+*/
+func (s *ChunkTypeToChannelMap) SetRoutePrefixes(routePrefix string, serverSentEventsRoutePrefix string) {
+	s.routePrefix = routePrefix
+	s.serverSentEventsRoutePrefix = serverSentEventsRoutePrefix
+}
+
 /*
 Data string will be routed in the map given that chunk type key exists
 */
-func (s *ChunkTypeToChannelMap) SendChunkToWebSocket(loggingChannel chan map[zerolog.Level]string, chunkTypeKey string, data string, router *gin.Engine) {
+func (s *ChunkTypeToChannelMap) SendChunkToWebSocket(loggingChannel chan map[zerolog.Level]string, chunkTypeKey string, data string) {
+	s.SendReceivedChunkToWebSocket(loggingChannel, chunkTypeKey, NewReceivedChunk(data))
+}
+
+/*
+SendReceivedChunkToWebSocket routes a chunk keeping the time it was received
+so its latency can be measured
+*/
+func (s *ChunkTypeToChannelMap) SendReceivedChunkToWebSocket(loggingChannel chan map[zerolog.Level]string, chunkTypeKey string, receivedChunk ReceivedChunk) {
+
+	// The name is taken by the route streaming every chunk type
+	if chunkTypeKey == AllChunkTypesName {
+		loggingChannel <- CreateLogMessage(zerolog.ErrorLevel, "ChunkType - "+chunkTypeKey+" - is reserved, dropping chunk")
+		return
+	}
+
+	s.UpdateLastSeenTime(chunkTypeKey)
 
 	// We first check if the channel exists
-	// And wait to try get it
 	chunkRoutingChannel, channelExists := s.TryGetChannel(chunkTypeKey)
-	if channelExists {
-		// and try pass the data if it does if there is space in the queue
-		if len(chunkRoutingChannel) >= cap(chunkRoutingChannel) {
-			
-			// Note: One should see issues in the status messages. It may be useful to log this but the current
-			// Implementation does not gaurentee that the UI will service all queues which will lead most of them
-			// To be overloaded a lot of the time as only the loaded page will service a particular websocket
-
-			//loggingChannel <- CreateLogMessage(zerolog.WarnLevel, "ChunkType - "+chunkTypeKey+" - Routing queue overflowwing")
-			return
-		}
-		chunkRoutingChannel <- data
 
-	} else {
+	// A stale chunk type still has its routes so it only needs its queues back
+	if !channelExists && s.TryReactivateChunkType(loggingChannel, chunkTypeKey) {
+		chunkRoutingChannel, channelExists = s.TryGetChannel(chunkTypeKey)
+	}
+
+	if !channelExists {
 		// If it does not set up a weboscket connection
 		// To manage connections for this chunk type
-		s.RegisterChunkOnWebSocket(loggingChannel, chunkTypeKey, router)
+		s.RegisterChunkOnWebSocket(loggingChannel, chunkTypeKey)
 		loggingChannel <- CreateLogMessage(zerolog.WarnLevel, "ChunkType - "+chunkTypeKey+" - registered for routing")
+		chunkRoutingChannel, _ = s.TryGetChannel(chunkTypeKey)
 	}
-}
 
-func (s *ChunkTypeToChannelMap) GetChannelData(chunkTypeKey string) (dataString string, success bool) {
+	chunk := NewRoutedChunk(receivedChunk.JSONString)
+	chunk.ReceivedTime = receivedChunk.ReceivedTime
+	chunk.SequenceNumber = s.NextSequenceNumber(chunkTypeKey)
+	s.RecordChunkThroughput(chunkTypeKey, chunk)
 
-	// We first check if the channel exists
-	// And wait to try get it
-	chunkRoutingChannel, channelExists := s.TryGetChannel(chunkTypeKey)
-	if !channelExists {
-		return "", false
+	// Keep it for anyone asking what this type looked like recently
+	if chunkHistory, historyExists := s.TryGetChunkHistory(chunkTypeKey); historyExists {
+		chunkHistory.Push(chunk)
 	}
+	s.UpdateLastKnownValue(chunkTypeKey, receivedChunk.LastKnownValueKey, chunk)
 
-	var timeoutCh = time.After(5 * time.Millisecond)
+	// and try pass the data, applying the overflow policy if there is no space in the queue
+	s.EnqueueChunk(chunkTypeKey, chunkRoutingChannel, chunk)
+	s.queueForAllChunkTypesSubscribers(chunkTypeKey, chunk)
+	s.GetChunkTypeLatency(chunkTypeKey).Routing.Record(time.Since(chunk.ReceivedTime))
+}
 
-	select {
-	case data := <-chunkRoutingChannel:
-		return data, true
-	case <-timeoutCh:
-		return "", false
+/*
+RegisterKnownChunkTypes registers every chunk type listed in the config so
+clients can connect before any data has arrived
+*/
+func (s *ChunkTypeToChannelMap) RegisterKnownChunkTypes(loggingChannel chan map[zerolog.Level]string) {
+	for _, chunkTypeString := range s.serverConfig.ChunkRouting.KnownChunkTypes {
+		if chunkTypeString == AllChunkTypesName {
+			loggingChannel <- CreateLogMessage(zerolog.ErrorLevel, "ChunkType - "+chunkTypeString+" - is reserved and cannot be a known chunk type")
+			continue
+		}
+		if _, channelExists := s.TryGetChannel(chunkTypeString); channelExists {
+			continue
+		}
+		s.RegisterChunkOnWebSocket(loggingChannel, chunkTypeString)
 	}
 }
 
 /*
-We try and wait to get access to a channel. Once we get it, we can return it because channels
-are routine safe. Concurrently accessing map requires mutex
+EnqueueChunk places a chunk on its routing queue. When the queue is full
+the chunk type's overflow policy decides what is dropped and the drop is
+counted so it shows up in reporting
 */
-func (s *ChunkTypeToChannelMap) TryGetChannel(chunkType string) (extractedChannel chan string, exists bool) {
+func (s *ChunkTypeToChannelMap) EnqueueChunk(chunkTypeKey string, chunkRoutingChannel chan *RoutedChunk, chunk *RoutedChunk) {
+
+	overflowPolicy := s.serverConfig.ChunkRouting.GetChunkTypeConfig(chunkTypeKey).OverflowPolicy
+
 	for {
-		var lockAcquired = make(chan struct{}, 1)
+		select {
+		case chunkRoutingChannel <- chunk:
+			return
+		default:
+		}
+
+		// Note: The UI does not have to service every queue so drops are expected
+		// and are only reported rather than logged each time
+		s.IncrementDroppedChunkCount(chunkTypeKey)
 
-		// Spin this lambda up and try get the channel
-		go func() {
-			s.mu.Lock()
-			extractedChannel, exists = s.chunkTypeRoutingMap[chunkType]
-			s.mu.Unlock()
-			defer close(lockAcquired)
-		}()
+		if overflowPolicy == OverflowPolicyDropNewest {
+			return
+		}
 
-		// Wait here until lock aquired channel is closed
+		// Otherwise make space by throwing away the oldest queued chunk and retry
 		select {
-		case <-lockAcquired:
-			// Lock was acquired
-			return extractedChannel, exists
-		case <-time.After(5 * time.Millisecond):
-			// Lock was not acquired, sleep and retry
-			time.Sleep(5 * time.Millisecond)
+		case <-chunkRoutingChannel:
+		default:
+		}
+	}
+}
+
+func (s *ChunkTypeToChannelMap) IncrementDroppedChunkCount(chunkTypeKey string) {
+	s.AddDroppedChunkCount(chunkTypeKey, 1)
+}
+
+/*
+AddDroppedChunkCount counts chunks of a type dropped from its routing queue
+or from the send queues of its clients
+*/
+func (s *ChunkTypeToChannelMap) AddDroppedChunkCount(chunkTypeKey string, droppedChunkCount uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.droppedChunkCountMap == nil {
+		s.droppedChunkCountMap = make(map[string]uint64)
+	}
+	s.droppedChunkCountMap[chunkTypeKey] += droppedChunkCount
+}
+
+func (s *ChunkTypeToChannelMap) GetDroppedChunkCount(chunkTypeKey string) uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.droppedChunkCountMap[chunkTypeKey]
+}
+
+/*
+ReportDroppedChunks sends the drop count of every chunk type to reporting
+and logs a warning for any type that dropped chunks since the last report
+*/
+func (s *ChunkTypeToChannelMap) ReportDroppedChunks(loggingChannel chan map[zerolog.Level]string) {
+
+	s.mu.Lock()
+	droppedChunkCounts := make(map[string]uint64)
+	for chunkTypeString := range s.chunkTypeRoutingMap {
+		droppedChunkCounts[chunkTypeString] = s.droppedChunkCountMap[chunkTypeString]
+	}
+	// Clients of every chunk type have no routing queue but can still drop
+	if droppedChunkCount, exists := s.droppedChunkCountMap[AllChunkTypesName]; exists {
+		droppedChunkCounts[AllChunkTypesName] = droppedChunkCount
+	}
+	if s.reportedDropCountMap == nil {
+		s.reportedDropCountMap = make(map[string]uint64)
+	}
+	previousDropCounts := s.reportedDropCountMap
+	s.reportedDropCountMap = droppedChunkCounts
+	s.mu.Unlock()
+
+	for chunkTypeString, droppedChunkCount := range droppedChunkCounts {
+
+		if newDrops := droppedChunkCount - previousDropCounts[chunkTypeString]; newDrops > 0 {
+			loggingChannel <- CreateLogMessage(zerolog.WarnLevel, "ChunkType - "+chunkTypeString+" - Routing or client queues overflowed, dropped "+strconv.FormatUint(newDrops, 10)+" chunks")
+		}
+
+		DroppedChunksMetric := NewMetricStatistic(chunkTypeString+"_Dropped_Chunks", float64(droppedChunkCount), MetricUnitChunks).
+			WithMetric("dropped_chunks_total", map[string]string{"chunk_type": chunkTypeString})
+		if droppedChunkCount > previousDropCounts[chunkTypeString] {
+			DroppedChunksMetric = DroppedChunksMetric.WithSeverity(MetricSeverityWarning)
 		}
+
+		SendMetric(s.reportingOutputChannel, DroppedChunksMetric)
 	}
 }
 
+/*
+ReportChunkTypeMetrics sends how many chunks of each type have been routed,
+the depth of each routing queue and how many clients are subscribed to each
+type
+*/
+func (s *ChunkTypeToChannelMap) ReportChunkTypeMetrics() {
+
+	s.mu.RLock()
+	chunkCounts := make(map[string]uint64)
+	for chunkTypeString := range s.sequenceNumberMap {
+		chunkCounts[chunkTypeString] = s.sequenceNumberMap[chunkTypeString]
+	}
+	s.mu.RUnlock()
+
+	for chunkTypeString, chunkCount := range chunkCounts {
+		chunkTypeLabels := map[string]string{"chunk_type": chunkTypeString}
+
+		SendMetric(s.reportingOutputChannel, NewMetricStatistic(chunkTypeString+"_Chunks_Routed", float64(chunkCount), MetricUnitChunks).
+			WithMetric("chunks_routed_total", chunkTypeLabels))
+
+		if len, cap, channelExists := s.GetChannelLengthAndCapacity(chunkTypeString); channelExists {
+			SendMetric(s.reportingOutputChannel, NewMetricStatistic(chunkTypeString+"_Channel", float64(len), MetricUnitChunks).WithCapacity(float64(cap)).
+				WithMetric("chunk_queue_depth", chunkTypeLabels))
+		}
+
+		SendMetric(s.reportingOutputChannel, NewMetricStatistic(chunkTypeString+"_Subscribers", float64(len(s.GetSubscribers(chunkTypeString))), MetricUnitClients).
+			WithMetric("subscribers", chunkTypeLabels))
+	}
+
+	SendMetric(s.reportingOutputChannel, NewMetricStatistic(AllChunkTypesName+"_Subscribers", float64(len(s.GetSubscribers(AllChunkTypesName))), MetricUnitClients).
+		WithMetric("subscribers", map[string]string{"chunk_type": AllChunkTypesName}))
+}
+
+/*
+Channels are routine safe so once we have one it can be used without the lock
+*/
+func (s *ChunkTypeToChannelMap) TryGetChannel(chunkType string) (extractedChannel chan *RoutedChunk, exists bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	extractedChannel, exists = s.chunkTypeRoutingMap[chunkType]
+	return extractedChannel, exists
+}
+
+/*
+NextSequenceNumber hands out the id of the next chunk of a type. These are
+used as Server-Sent Event ids so clients can resume where they left off
+*/
+func (s *ChunkTypeToChannelMap) NextSequenceNumber(chunkTypeString string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sequenceNumberMap == nil {
+		s.sequenceNumberMap = make(map[string]uint64)
+	}
+
+	s.sequenceNumberMap[chunkTypeString]++
+	return s.sequenceNumberMap[chunkTypeString]
+}
+
+func (s *ChunkTypeToChannelMap) GetSequenceNumber(chunkTypeString string) uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.sequenceNumberMap[chunkTypeString]
+}
+
+func (s *ChunkTypeToChannelMap) TryGetChunkHistory(chunkTypeString string) (chunkHistory *ChunkRingBuffer, exists bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	chunkHistory, exists = s.chunkHistoryMap[chunkTypeString]
+	return chunkHistory, exists
+}
+
 func (s *ChunkTypeToChannelMap) GetChannelLengthAndCapacity(chunkTypeString string) (length int, capacity int, exists bool) {
 	var channel,exits = s.TryGetChannel(chunkTypeString)
 
@@ -124,132 +323,373 @@ func (s *ChunkTypeToChannelMap) GetChannelLengthAndCapacity(chunkTypeString stri
 	return len(channel), cap(channel), exits
 }
 
-func (s *ChunkTypeToChannelMap)RegisterChunkOnWebSocket(loggingChannel chan map[zerolog.Level]string, chunkTypeString string, router *gin.Engine) {
+/*
+A routing queue only hands chunks to its dispatcher, which copies them
+straight out to the send queue of every client, so chunks build up in the
+client queues and the routing queue's size is not configurable
+*/
+const chunkRoutingQueueCapacity = 1000
+
+/*
+createChunkTypeQueues makes the routing queue and history of a chunk type
+and wakes anything waiting on the old ones. The caller must hold the mutex
+*/
+func (s *ChunkTypeToChannelMap) createChunkTypeQueues(chunkTypeString string) {
+
+	chunkTypeConfig := s.serverConfig.ChunkRouting.GetChunkTypeConfig(chunkTypeString)
+	s.chunkTypeRoutingMap[chunkTypeString] = make(chan *RoutedChunk, chunkRoutingQueueCapacity)
+
+	if s.chunkHistoryMap == nil {
+		s.chunkHistoryMap = make(map[string]*ChunkRingBuffer)
+	}
+
+	// The buffer has to be able to hold the configured history replay
+	chunkHistorySize := s.serverConfig.RecentChunkBufferSize
+	if chunkTypeConfig.HistoryChunks > chunkHistorySize {
+		chunkHistorySize = chunkTypeConfig.HistoryChunks
+	}
+	s.chunkHistoryMap[chunkTypeString] = NewChunkRingBuffer(chunkHistorySize)
+
+	// Idle expiry counts from when the queues were made
+	if s.lastSeenTimeMap == nil {
+		s.lastSeenTimeMap = make(map[string]time.Time)
+	}
+	s.lastSeenTimeMap[chunkTypeString] = time.Now()
+
+	s.signalChunkTypeStateChanged(chunkTypeString)
+}
+
+/*
+IsChunkTypeRegistered reports whether a chunk type is served, including
+types that have gone stale
+*/
+func (s *ChunkTypeToChannelMap) IsChunkTypeRegistered(chunkTypeString string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, channelExists := s.chunkTypeRoutingMap[chunkTypeString]
+	return channelExists || s.staleChunkTypeSet[chunkTypeString]
+}
+
+/*
+RegisterRoutes adds the WebSocket, Server-Sent Events and REST routes every
+chunk type is served on. The chunk type is taken from the path and looked up
+in the map, so names sent by producers never become routes of their own
+*/
+func (s *ChunkTypeToChannelMap) RegisterRoutes(loggingChannel chan map[zerolog.Level]string, router *gin.Engine) {
+
+	// Every route for this type needs a token allowing it once authentication is on
+	requireChunkType := s.RequireRegisteredChunkType()
+
+	router.GET(s.routePrefix+":"+chunkTypeParameter, requireChunkType, func(c *gin.Context) {
+		s.HandleWebSocketSubscription(loggingChannel, c, c.Param(chunkTypeParameter))
+	})
+
+	// And the same chunks for clients that can only do plain HTTP
+	router.GET(s.serverSentEventsRoutePrefix+":"+chunkTypeParameter, requireChunkType, func(c *gin.Context) {
+		s.HandleServerSentEvents(loggingChannel, c, c.Param(chunkTypeParameter))
+	})
+
+	// Let pollers and probes see recent chunks without subscribing
+	router.GET(s.routePrefix+":"+chunkTypeParameter+"/latest", requireChunkType, func(c *gin.Context) {
+		s.HandleLatestChunkRequest(c, c.Param(chunkTypeParameter))
+	})
+	router.GET(s.routePrefix+":"+chunkTypeParameter+"/recent", requireChunkType, func(c *gin.Context) {
+		s.HandleRecentChunksRequest(c, c.Param(chunkTypeParameter))
+	})
+}
+
+/*
+RequireRegisteredChunkType returns gin middleware that answers 404 for chunk
+types that have not been registered and otherwise checks the token allows
+the chunk type
+*/
+func (s *ChunkTypeToChannelMap) RequireRegisteredChunkType() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		chunkTypeString := c.Param(chunkTypeParameter)
+		if !s.IsChunkTypeRegistered(chunkTypeString) {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"Error": "unknown chunk type " + chunkTypeString})
+			return
+		}
+		s.serverConfig.Authenticator.authorizeRequest(c, s.serverConfig.AuthorizationScope, chunkTypeString)
+	}
+}
+
+/*
+RegisterChunkOnWebSocket makes the queues of a chunk type and starts its
+dispatcher, after which the chunk type is served on the shared routes
+*/
+func (s *ChunkTypeToChannelMap)RegisterChunkOnWebSocket(loggingChannel chan map[zerolog.Level]string, chunkTypeString string) {
 
-		
 	loggingChannel <- CreateLogMessage(zerolog.InfoLevel, "Registering on WebSocket: "+chunkTypeString)
 
-	// if we have not started using the map yet then intialise it
-	if s.chunkTypeRoutingMap == nil {
-		chunkTypeChannelMap := make(map[string]chan string)
-		s.chunkTypeRoutingMap = chunkTypeChannelMap
+	s.mu.Lock()
+	s.createChunkTypeQueues(chunkTypeString)
+	if s.dispatcherStopMap == nil {
+		s.dispatcherStopMap = make(map[string]chan struct{})
 	}
+	dispatcherStopped := make(chan struct{})
+	s.dispatcherStopMap[chunkTypeString] = dispatcherStopped
+	s.mu.Unlock()
 
-	s.chunkTypeRoutingMap[chunkTypeString] = make(chan string, 1000)
+	// Copy chunks from the type queue out to every client's own queue
+	go s.RunChunkDispatcher(loggingChannel, chunkTypeString, dispatcherStopped)
+}
 
-	// When you get this HTTP request open the websocket
-	// This permenantly add this to the http 
-	// Router as we are using a reference
-	router.GET("/DataTypes/"+chunkTypeString, func(c *gin.Context) {
+/*
+HandleWebSocketSubscription upgrades a request to a WebSocket and streams a
+chunk type to it until either side closes the connection
+*/
+func (s *ChunkTypeToChannelMap) HandleWebSocketSubscription(loggingChannel chan map[zerolog.Level]string, c *gin.Context, chunkTypeString string) {
+
+	// Clients may ask for an encoding in the query instead of a subprotocol
+	requestedEncoding, encodingSupported := GetRequestedChunkEncoding(c.Request)
+	if !encodingSupported {
+		loggingChannel <- CreateLogMessage(zerolog.WarnLevel, "Client requested unsupported encoding on "+s.routePrefix+chunkTypeString)
+		c.String(http.StatusBadRequest, "Unsupported encoding")
+		return
+	}
 
-            // Upgrade the HTTP request into a websocket
-			loggingChannel <- CreateLogMessage(zerolog.InfoLevel, "Client calling for upgrade on /DataTypes/"+chunkTypeString)
-            WebSocketConnection, err := upgrader.Upgrade(c.Writer, c.Request, nil)
-			defer WebSocketConnection.Close()
+	// Upgrade the HTTP request into a websocket
+	loggingChannel <- CreateLogMessage(zerolog.InfoLevel, "Client calling for upgrade on "+s.routePrefix+chunkTypeString)
+	// Count the bytes that hit the network so compression savings can be reported
+	var byteCounters WebSocketClientByteCounters
+	countingWriter := &byteCountingResponseWriter{ResponseWriter: c.Writer, byteCounters: &byteCounters}
+	WebSocketConnection, err := s.upgrader.Upgrade(countingWriter, c.Request, nil)
 
-            if err != nil {
-                loggingChannel <- CreateLogMessage(zerolog.ErrorLevel, "Error upgrading to WebSocket:"+ err.Error())
-				return
-			}
+	if err != nil {
+		loggingChannel <- CreateLogMessage(zerolog.ErrorLevel, "Error upgrading to WebSocket:"+ err.Error())
+		return
+	}
+	defer WebSocketConnection.Close()
+
+	// Clients that stop answering pings are treated as gone
+	StartHeartbeat(WebSocketConnection, s.serverConfig)
+
+	// Only count what is sent after the handshake
+	byteCounters.WireBytes.Store(0)
+	if s.serverConfig.CompressionEnabled {
+		WebSocketConnection.SetCompressionLevel(s.serverConfig.CompressionLevel)
+	}
 
-			// Spin up Routines to manage this websocket upgrade request
-			// When this socket is closed all management of this queue is
-			// Stopped leading it to grow to its max capacity and lock up
+	encoding := SelectChunkEncoding(WebSocketConnection, requestedEncoding)
+	loggingChannel <- CreateLogMessage(zerolog.InfoLevel, "Client on "+s.routePrefix+chunkTypeString+" using "+string(encoding)+" encoding")
 
+	// Subscribe before replaying so nothing arriving during the replay is missed
+	subscriber := NewChunkSubscriber(GetClientHost(WebSocketConnection.RemoteAddr().String()), chunkTypeString, s.serverConfig.SlowConsumer.ClientQueueCapacity)
+	s.AddSubscriber(subscriber)
+	defer s.RemoveSubscriber(subscriber)
 
-			var AtomicWebsocketClosed atomic.Bool // Atomic integer used as a flag (0: false, 1: true)
-			AtomicWebsocketClosed.Store(false)
+	// Fill the display in with recent history before any live data
+	var lastSentSequenceNumber uint64
+	for _, chunk := range s.GetReplayChunks(chunkTypeString) {
+		if err := s.WriteChunkToWebSocket(loggingChannel, WebSocketConnection, chunkTypeString, chunk, encoding, &byteCounters); err != nil {
+			loggingChannel <- CreateLogMessage(zerolog.WarnLevel, "Issue replaying history to WebSocket:"+ err.Error())
+			return
+		}
+		lastSentSequenceNumber = chunk.SequenceNumber
+	}
 
-			var wg sync.WaitGroup
-			wg.Add(2)
-			go s.HandleReceivedSignals(loggingChannel, WebSocketConnection, &wg, &AtomicWebsocketClosed);
-			go s.HandleSignalTransmissions(loggingChannel ,WebSocketConnection, chunkTypeString, &wg, &AtomicWebsocketClosed )
-			wg.Wait()
+	// Spin up Routines to manage this websocket upgrade request
+	// Each client has its own queue so when this socket is closed
+	// only its queue stops being serviced and it is then removed
+	WebsocketClosed := make(chan struct{}) // Closed by the receive routine once the client has gone
 
-			loggingChannel <- CreateLogMessage(zerolog.InfoLevel, chunkTypeString + " Routine shut down")
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go s.HandleReceivedSignals(loggingChannel, WebSocketConnection, &wg, WebsocketClosed);
+	go s.HandleSignalTransmissions(loggingChannel ,WebSocketConnection, subscriber, encoding, &byteCounters, lastSentSequenceNumber, &wg, WebsocketClosed )
+	wg.Wait()
 
+	loggingChannel <- CreateLogMessage(zerolog.InfoLevel, chunkTypeString + " Routine shut down")
+}
+
+/*
+StartHeartbeat sets the read deadline of a new connection and pushes it out
+every time the client answers a ping. Pings are sent by the transmit routine
+or by RunPinger for connections without one
+*/
+func StartHeartbeat(WebSocketConnection *websocket.Conn, serverConfig WebSocketServerConfig) {
+
+	if serverConfig.PingInterval == 0 {
+		return
+	}
+
+	WebSocketConnection.SetReadDeadline(time.Now().Add(serverConfig.PongTimeout))
+	WebSocketConnection.SetPongHandler(func(string) error {
+		return WebSocketConnection.SetReadDeadline(time.Now().Add(serverConfig.PongTimeout))
 	})
 }
 
-func (s *ChunkTypeToChannelMap)HandleReceivedSignals(loggingChannel chan map[zerolog.Level]string, WebSocketConnection *websocket.Conn, wg *sync.WaitGroup, AtomicWebsocketClosed *atomic.Bool) {
+/*
+RunPinger pings a client every ping interval until WebsocketClosed is closed
+or a ping cannot be written. Pings are control frames so they can be sent
+while another routine writes to the connection
+*/
+func RunPinger(loggingChannel chan map[zerolog.Level]string, WebSocketConnection *websocket.Conn, serverConfig WebSocketServerConfig, WebsocketClosed <-chan struct{}) {
+
+	if serverConfig.PingInterval == 0 {
+		return
+	}
+
+	pingTicker := time.NewTicker(serverConfig.PingInterval)
+	defer pingTicker.Stop()
+
+	for {
+		select {
+		case <-WebsocketClosed:
+			return
+		case <-pingTicker.C:
+			if err := WebSocketConnection.WriteControl(websocket.PingMessage, nil, time.Now().Add(serverConfig.WriteTimeout)); err != nil {
+				loggingChannel <- CreateLogMessage(zerolog.WarnLevel, "Issue pinging WebSocket:"+err.Error())
+				return
+			}
+		}
+	}
+}
+
+func (s *ChunkTypeToChannelMap)HandleReceivedSignals(loggingChannel chan map[zerolog.Level]string, WebSocketConnection *websocket.Conn, wg *sync.WaitGroup, WebsocketClosed chan struct{}) {
 
 	defer wg.Done()
+	defer close(WebsocketClosed)
 	
 	for{
 		// We now just wait for the close message
 		_, _, err := WebSocketConnection.ReadMessage()
 		if err != nil {
-			loggingChannel <- CreateLogMessage(zerolog.WarnLevel, "Issue reading message from WebSocket:" + err.Error())
-			AtomicWebsocketClosed.Store(true)
+			// A read timeout means the client stopped answering pings
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				loggingChannel <- CreateLogMessage(zerolog.WarnLevel, "Client "+WebSocketConnection.RemoteAddr().String()+" stopped responding to pings, closing")
+				WebSocketConnection.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "Ping timeout"), time.Now().Add(s.serverConfig.WriteTimeout))
+			} else {
+				loggingChannel <- CreateLogMessage(zerolog.WarnLevel, "Issue reading message from WebSocket:" + err.Error())
+			}
 			break;
 		}
 	}
 }
 
-func (s *ChunkTypeToChannelMap)HandleSignalTransmissions(loggingChannel chan map[zerolog.Level]string, WebSocketConnection *websocket.Conn, chunkTypeString string, wg *sync.WaitGroup, AtomicWebsocketClosed *atomic.Bool) {
+/*
+HandleSignalTransmissions writes the client's queued chunks to the WebSocket.
+It sleeps until there is something to do and closes the connection when it
+stops so the receive routine stops too
+*/
+func (s *ChunkTypeToChannelMap)HandleSignalTransmissions(loggingChannel chan map[zerolog.Level]string, WebSocketConnection *websocket.Conn, subscriber *ChunkSubscriber, encoding ChunkEncoding, byteCounters *WebSocketClientByteCounters, lastSentSequenceNumber uint64, wg *sync.WaitGroup, WebsocketClosed chan struct{}) {
 
 	defer wg.Done()
-	currentTime := time.Now()
+	defer WebSocketConnection.Close()
+
+	chunkTypeString := subscriber.ChunkType
+	chunkTypeLatency := s.GetChunkTypeLatency(chunkTypeString)
+	reportingTicker := time.NewTicker(1000 * time.Millisecond)
+	defer reportingTicker.Stop()
+
+	// A nil channel never fires so pings are left out when disabled
+	var pingTickerChannel <-chan time.Time
+	if s.serverConfig.PingInterval > 0 {
+		pingTicker := time.NewTicker(s.serverConfig.PingInterval)
+		defer pingTicker.Stop()
+		pingTickerChannel = pingTicker.C
+	}
+
+	// Check the state straight away so clients joining a stale type are told
+	chunkTypeStale := false
+	var chunkTypeStateChanged <-chan struct{} = closedChannel
 	
 	for {
-		// Unmarshal the JSON string into a map
-		var bChannelExists = false
-		var strJSONData string
-
-		var chstrJSONData = make(chan string, 1)
-		var chbCannelExists = make(chan bool, 1)
-		
-		// Launch a goroutine to try fetch data
-		go func() {
-			strJSONDataTemp, bChannelExistsTmp := s.GetChannelData(chunkTypeString)
-			chbCannelExists <- bChannelExistsTmp
-			chstrJSONData <- strJSONDataTemp
-		}()
-
-		// While also limiting this with a timeout procedure
-		var chTimeout = time.After(5 * time.Millisecond)
-
-		// And see which finihsed first
 		select {
-		case bChannelExists = <-chbCannelExists:
-			strJSONData = <- chstrJSONData
-		case <-chTimeout:
-			// And continure if a timeout occurred
-			continue
-		}
-
-		// When we have data check the client has not closed out beautiful, stunning and special connection
-		if AtomicWebsocketClosed.Load() {
+		case <-WebsocketClosed:
 			loggingChannel <- CreateLogMessage(zerolog.WarnLevel, "RX Websocket closed, exiting write routine")
-			break
-		}
-		
-		// If the connection is open check we successfully got access to the channel and transmit data
-		if bChannelExists {
-			err := WebSocketConnection.WriteMessage(websocket.TextMessage, []byte(strJSONData))
-			if err != nil {
+			return
+
+		case <-subscriber.Disconnected():
+			// The slow consumer policy has given up on this client
+			WebSocketConnection.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "Client too slow"), time.Now().Add(s.serverConfig.WriteTimeout))
+			return
+
+		case chunk := <-subscriber.Queue():
+			// Chunks already sent as part of the history replay are skipped
+			if chunk.SequenceNumber <= lastSentSequenceNumber {
+				continue
+			}
+			if err := s.WriteChunkToWebSocket(loggingChannel, WebSocketConnection, chunkTypeString, chunk, encoding, byteCounters); err != nil {
 				loggingChannel <- CreateLogMessage(zerolog.WarnLevel, "Issue writing message to WebSocket:"+ err.Error())
-				AtomicWebsocketClosed.Store(true)
-				break
+				return
+			}
+			// Only live chunks count, replayed history would skew the latency
+			chunkTypeLatency.Write.Record(time.Since(chunk.ReceivedTime))
+
+		case <-chunkTypeStateChanged:
+			// Let the client know if this chunk type went idle or came back
+			var stale bool
+			stale, chunkTypeStateChanged = s.GetChunkTypeState(chunkTypeString)
+			if stale == chunkTypeStale {
+				continue
+			}
+			chunkTypeStale = stale
+			statusChunk := NewRoutedChunk(CreateChunkTypeStatusMessage(chunkTypeString, stale))
+			if err := s.WriteChunkToWebSocket(loggingChannel, WebSocketConnection, chunkTypeString, statusChunk, encoding, byteCounters); err != nil {
+				loggingChannel <- CreateLogMessage(zerolog.WarnLevel, "Issue writing message to WebSocket:"+ err.Error())
+				return
 			}
-		}
 
-		// Then check if we should report the length of this chunks data channel
-		if time.Since(currentTime) > 1000*time.Millisecond {
-
-			var len, cap, _ = s.GetChannelLengthAndCapacity(chunkTypeString)
-			currentTime= time.Now()
-
-			// Create the reporting message
-			QueueLogMessage := SystemInfo{SystemStat:SystemStatistic{
-				StatEnvironment: "TCP_WS_Adapter",
-				StatName: chunkTypeString + "_Channel",
-				StatStaus: strconv.Itoa(len) + "/" + strconv.Itoa(cap),
-			}}
-			
-			// And send it to the dedicated reporting routine
-			data, _ := json.Marshal(QueueLogMessage)
-			s.reportingOutputChannel <- string(data)
+		case <-pingTickerChannel:
+			// Ping the client so the read side notices if it has gone away
+			if err := WebSocketConnection.WriteControl(websocket.PingMessage, nil, time.Now().Add(s.serverConfig.WriteTimeout)); err != nil {
+				loggingChannel <- CreateLogMessage(zerolog.WarnLevel, "Issue pinging WebSocket:"+ err.Error())
+				return
+			}
+
+		case <-reportingTicker.C:
+			s.ReportWebSocketClient(WebSocketConnection, subscriber, byteCounters)
 		}
 	}
-}
\ No newline at end of file
+}
+
+/*
+ReportWebSocketClient sends how far behind the client is and how much it
+has cost on the network. The chunk type's queue is reported once for all
+its clients by ReportChunkTypeMetrics
+*/
+func (s *ChunkTypeToChannelMap) ReportWebSocketClient(WebSocketConnection *websocket.Conn, subscriber *ChunkSubscriber, byteCounters *WebSocketClientByteCounters) {
+
+	chunkTypeString := subscriber.ChunkType
+
+	// How far behind this client is
+	s.ReportSubscriber(subscriber)
+
+	// Along with how much this client has cost us on the network
+	clientName := subscriber.GetClientStatName()
+	clientLabels := map[string]string{"chunk_type": chunkTypeString, "client": subscriber.Label}
+	SendMetric(s.reportingOutputChannel, NewMetricStatistic(clientName+"_Uncompressed_Bytes", float64(byteCounters.UncompressedBytes.Load()), MetricUnitBytes).
+		WithMetric("client_uncompressed_bytes_total", clientLabels))
+	SendMetric(s.reportingOutputChannel, NewMetricStatistic(clientName+"_Compressed_Bytes", float64(byteCounters.WireBytes.Load()), MetricUnitBytes).
+		WithMetric("client_wire_bytes_total", clientLabels))
+}
+
+/*
+WriteChunkToWebSocket sends a chunk in the client's encoding. Chunks that
+cannot be encoded are logged and skipped
+
+returns an error only if the write to the client failed
+*/
+func (s *ChunkTypeToChannelMap) WriteChunkToWebSocket(loggingChannel chan map[zerolog.Level]string, WebSocketConnection *websocket.Conn, chunkTypeString string, chunk *RoutedChunk, encoding ChunkEncoding, byteCounters *WebSocketClientByteCounters) error {
+
+	// Transcoding is cached on the chunk so this is only paid once per encoding
+	encodedData, err := chunk.GetEncodedData(encoding)
+	if err != nil {
+		loggingChannel <- CreateLogMessage(zerolog.ErrorLevel, "Error encoding "+chunkTypeString+" as "+string(encoding)+":"+err.Error())
+		return nil
+	}
+
+	// Small messages are not worth the compression overhead
+	WebSocketConnection.EnableWriteCompression(s.serverConfig.CompressionEnabled && len(encodedData) >= s.serverConfig.CompressionMinimumMessageSize)
+	WebSocketConnection.SetWriteDeadline(time.Now().Add(s.serverConfig.WriteTimeout))
+	err = WebSocketConnection.WriteMessage(GetWebSocketMessageType(encoding), encodedData)
+	if err != nil {
+		return err
+	}
+
+	byteCounters.UncompressedBytes.Add(uint64(len(encodedData)))
+	return nil
+}
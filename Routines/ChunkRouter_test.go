@@ -0,0 +1,298 @@
+package Routines
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestEnqueueChunkAppliesTheOverflowPolicy(t *testing.T) {
+	chunkRouter := newTestChunkRouter(t, newTestServerConfig(t, map[string]interface{}{
+		"ChunkRoutingConfig": map[string]interface{}{
+			"DropNewestChunk": map[string]interface{}{"OverflowPolicy": "DropNewest"},
+			"DropOldestChunk": map[string]interface{}{"OverflowPolicy": "DropOldest"},
+			"LatestOnlyChunk": map[string]interface{}{"OverflowPolicy": "LatestOnly"},
+		},
+	}))
+
+	testCases := []struct {
+		chunkTypeString     string
+		queueCapacity       int
+		wantSequenceNumbers []uint64
+	}{
+		{"DropNewestChunk", 2, []uint64{1, 2}},
+		{"DropOldestChunk", 2, []uint64{4, 5}},
+		{"LatestOnlyChunk", 1, []uint64{5}},
+	}
+	for _, testCase := range testCases {
+		chunkRoutingChannel := make(chan *RoutedChunk, testCase.queueCapacity)
+		for index := 1; index <= 5; index++ {
+			chunk := NewRoutedChunk(`{"Index":` + strconv.Itoa(index) + `}`)
+			chunk.SequenceNumber = uint64(index)
+			chunkRouter.chunkTypeRoutingMap.EnqueueChunk(testCase.chunkTypeString, chunkRoutingChannel, chunk)
+		}
+		close(chunkRoutingChannel)
+
+		var sequenceNumbers []uint64
+		for chunk := range chunkRoutingChannel {
+			sequenceNumbers = append(sequenceNumbers, chunk.SequenceNumber)
+		}
+		if !equalSequenceNumbers(sequenceNumbers, testCase.wantSequenceNumbers) {
+			t.Errorf("%s queued %v, want %v", testCase.chunkTypeString, sequenceNumbers, testCase.wantSequenceNumbers)
+		}
+
+		wantDroppedChunkCount := uint64(5 - len(testCase.wantSequenceNumbers))
+		if droppedChunkCount := chunkRouter.chunkTypeRoutingMap.GetDroppedChunkCount(testCase.chunkTypeString); droppedChunkCount != wantDroppedChunkCount {
+			t.Errorf("%s counted %d dropped chunks, want %d", testCase.chunkTypeString, droppedChunkCount, wantDroppedChunkCount)
+		}
+	}
+}
+
+/*
+connectHeartbeatClient subscribes to TimeChunk and keeps reading so pings
+are handled, returning the error that ended the connection
+*/
+func connectHeartbeatClient(t *testing.T, serverURL string, answerPings bool) <-chan error {
+	WebSocketConnection, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(serverURL, "http")+"/DataTypes/TimeChunk", nil)
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	t.Cleanup(func() { WebSocketConnection.Close() })
+
+	// A client that has gone away never answers
+	if !answerPings {
+		WebSocketConnection.SetPingHandler(func(string) error { return nil })
+	}
+
+	connectionClosed := make(chan error, 1)
+	go func() {
+		for {
+			if _, _, err := WebSocketConnection.ReadMessage(); err != nil {
+				connectionClosed <- err
+				return
+			}
+		}
+	}()
+	return connectionClosed
+}
+
+func TestClientsThatStopAnsweringPingsAreClosed(t *testing.T) {
+	serverConfig := newTestServerConfig(t, nil)
+	serverConfig.PingInterval = 50 * time.Millisecond
+	serverConfig.PongTimeout = 300 * time.Millisecond
+
+	chunkRouter := newTestChunkRouter(t, serverConfig)
+	chunkRouter.sendChunk("TimeChunk", `{"TimeChunk":{}}`)
+	server := httptest.NewServer(chunkRouter.router)
+	defer server.Close()
+
+	answeringClientClosed := connectHeartbeatClient(t, server.URL, true)
+	silentClientClosed := connectHeartbeatClient(t, server.URL, false)
+
+	select {
+	case err := <-silentClientClosed:
+		if closeError, isCloseError := err.(*websocket.CloseError); !isCloseError || closeError.Code != websocket.CloseGoingAway {
+			t.Errorf("silent client was closed with %v, want a going away close", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("client that stopped answering pings was not closed")
+	}
+
+	// The client still answering outlived several pong timeouts
+	select {
+	case err := <-answeringClientClosed:
+		t.Fatalf("client answering pings was closed: %v", err)
+	default:
+	}
+
+	// and only the silent client's subscription was removed
+	deadline := time.Now().Add(time.Second)
+	for len(chunkRouter.chunkTypeRoutingMap.GetSubscribers("TimeChunk")) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d subscribers left, want only the answering client", len(chunkRouter.chunkTypeRoutingMap.GetSubscribers("TimeChunk")))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestKnownChunkTypesAreServedBeforeAnyData(t *testing.T) {
+	chunkRouter := newTestChunkRouter(t, newTestServerConfig(t, map[string]interface{}{
+		"ChunkRoutingConfig": map[string]interface{}{"KnownChunkTypes": []interface{}{"TimeChunk"}},
+	}))
+	chunkRouter.registerKnownChunkTypes()
+	server := httptest.NewServer(chunkRouter.router)
+	defer server.Close()
+
+	testCases := []struct {
+		chunkTypeString string
+		wantStatus      int
+	}{
+		{"TimeChunk", http.StatusOK},
+		{"FFTChunk", http.StatusNotFound},
+	}
+	for _, testCase := range testCases {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		request, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/sse/"+testCase.chunkTypeString, nil)
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			cancel()
+			t.Fatalf("requesting %s: %v", testCase.chunkTypeString, err)
+		}
+		response.Body.Close()
+		cancel()
+
+		if response.StatusCode != testCase.wantStatus {
+			t.Errorf("%s got status %d, want %d", testCase.chunkTypeString, response.StatusCode, testCase.wantStatus)
+		}
+	}
+}
+
+func TestFirstChunkOfANewTypeIsRouted(t *testing.T) {
+	chunkRouter := newTestChunkRouter(t, newTestServerConfig(t, nil))
+	chunkRouter.sendChunk("TimeChunk", `{"TimeChunk":{"Index":1}}`)
+
+	chunkHistory, exists := chunkRouter.chunkTypeRoutingMap.TryGetChunkHistory("TimeChunk")
+	if !exists {
+		t.Fatal("chunk type was not registered by its first chunk")
+	}
+	latestChunk, exists := chunkHistory.GetLatest()
+	if !exists || latestChunk.SequenceNumber != 1 || latestChunk.JSONString != `{"TimeChunk":{"Index":1}}` {
+		t.Errorf("latest chunk is %v, want the first chunk sent", latestChunk)
+	}
+}
+
+var benchmarkChunkTypes = []string{"TimeChunk", "FFTChunk", "GPSChunk", "WAVChunk"}
+
+/*
+newBenchmarkRoutingMap registers a few chunk types with a client each, the
+way the adapter looks with producers and browsers connected
+*/
+func newBenchmarkRoutingMap(b *testing.B, subscriberQueueCapacity int) (*ChunkTypeToChannelMap, map[string]*ChunkSubscriber) {
+	loggingChannel := newTestLoggingChannel(b)
+	chunkTypeRoutingMap := NewChunkTypeToChannelMap(loggingChannel, make(chan string, 1000), newTestServerConfig(b, nil))
+
+	subscribers := make(map[string]*ChunkSubscriber)
+	for _, chunkTypeString := range benchmarkChunkTypes {
+		chunkTypeRoutingMap.RegisterChunkOnWebSocket(loggingChannel, chunkTypeString)
+		subscribers[chunkTypeString] = NewChunkSubscriber("client", chunkTypeString, subscriberQueueCapacity)
+		chunkTypeRoutingMap.AddSubscriber(subscribers[chunkTypeString])
+	}
+
+	b.Cleanup(func() {
+		for _, subscriber := range subscribers {
+			chunkTypeRoutingMap.RemoveSubscriber(subscriber)
+		}
+	})
+	return chunkTypeRoutingMap, subscribers
+}
+
+/*
+reportLatencyPercentiles adds the median and 99th percentile of the
+measured latencies to the benchmark output
+*/
+func reportLatencyPercentiles(b *testing.B, latencies []time.Duration) {
+	if len(latencies) == 0 {
+		return
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	b.ReportMetric(float64(latencies[len(latencies)/2].Nanoseconds()), "p50-ns")
+	b.ReportMetric(float64(latencies[len(latencies)*99/100].Nanoseconds()), "p99-ns")
+}
+
+/*
+BenchmarkIdleRouting measures the CPU the router and its dispatchers use
+while registered chunk types have clients but no chunks arrive
+*/
+func BenchmarkIdleRouting(b *testing.B) {
+	newBenchmarkRoutingMap(b, 100)
+
+	startCPUTime, ok := getProcessCPUTime()
+	if !ok {
+		b.Skip("process CPU time is not available on this platform")
+	}
+
+	b.ResetTimer()
+	startTime := time.Now()
+	for i := 0; i < b.N; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	idleDuration := time.Since(startTime)
+	b.StopTimer()
+
+	endCPUTime, _ := getProcessCPUTime()
+	b.ReportMetric(float64((endCPUTime-startCPUTime).Nanoseconds())/idleDuration.Seconds(), "cpu-ns/s")
+}
+
+/*
+BenchmarkRoutingLatency measures the time from a chunk being received to it
+being in a client's send queue, one chunk at a time and with chunks of
+every type arriving as fast as the router takes them
+*/
+func BenchmarkRoutingLatency(b *testing.B) {
+	b.Run("OneAtATime", func(b *testing.B) {
+		loggingChannel := newTestLoggingChannel(b)
+		chunkTypeRoutingMap, subscribers := newBenchmarkRoutingMap(b, 100)
+		subscriber := subscribers["TimeChunk"]
+
+		latencies := make([]time.Duration, 0, b.N)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			chunkTypeRoutingMap.SendReceivedChunkToWebSocket(loggingChannel, "TimeChunk", NewReceivedChunk(`{"TimeChunk":{}}`))
+			chunk := <-subscriber.Queue()
+			latencies = append(latencies, time.Since(chunk.ReceivedTime))
+		}
+		b.StopTimer()
+
+		reportLatencyPercentiles(b, latencies)
+	})
+
+	b.Run("AllTypesAtFullRate", func(b *testing.B) {
+		loggingChannel := newTestLoggingChannel(b)
+		chunkTypeRoutingMap, subscribers := newBenchmarkRoutingMap(b, 1000)
+
+		// Keep fewer chunks in flight than any queue holds so none are dropped
+		inFlight := make(chan struct{}, 256)
+		latencyChannel := make(chan time.Duration, len(benchmarkChunkTypes))
+		chunkCounts := make(map[string]int)
+		for i := 0; i < b.N; i++ {
+			chunkCounts[benchmarkChunkTypes[i%len(benchmarkChunkTypes)]]++
+		}
+
+		b.ResetTimer()
+		for _, chunkTypeString := range benchmarkChunkTypes {
+			go func(subscriber *ChunkSubscriber, chunkCount int) {
+				for i := 0; i < chunkCount; i++ {
+					chunk := <-subscriber.Queue()
+					latencyChannel <- time.Since(chunk.ReceivedTime)
+					<-inFlight
+				}
+			}(subscribers[chunkTypeString], chunkCounts[chunkTypeString])
+		}
+
+		latencies := make([]time.Duration, 0, b.N)
+		latenciesCollected := make(chan struct{})
+		go func() {
+			for len(latencies) < b.N {
+				latencies = append(latencies, <-latencyChannel)
+			}
+			close(latenciesCollected)
+		}()
+
+		for i := 0; i < b.N; i++ {
+			inFlight <- struct{}{}
+			chunkTypeString := benchmarkChunkTypes[i%len(benchmarkChunkTypes)]
+			chunkTypeRoutingMap.SendReceivedChunkToWebSocket(loggingChannel, chunkTypeString, NewReceivedChunk(`{"`+chunkTypeString+`":{}}`))
+		}
+		<-latenciesCollected
+		b.StopTimer()
+
+		reportLatencyPercentiles(b, latencies)
+	})
+}
@@ -0,0 +1,159 @@
+package Routines
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+/*
+QueueOverflowPolicy decides what happens to a chunk when its chunk type
+queue is full
+*/
+type QueueOverflowPolicy string
+
+const (
+	OverflowPolicyDropNewest QueueOverflowPolicy = "DropNewest" // Keep what is queued and drop the new chunk
+	OverflowPolicyDropOldest QueueOverflowPolicy = "DropOldest" // Drop the oldest queued chunk to make space
+	OverflowPolicyLatestOnly QueueOverflowPolicy = "LatestOnly" // Only ever hold the newest chunk
+)
+
+func ParseQueueOverflowPolicy(policyString string) (QueueOverflowPolicy, error) {
+	for _, policy := range []QueueOverflowPolicy{OverflowPolicyDropNewest, OverflowPolicyDropOldest, OverflowPolicyLatestOnly} {
+		if strings.EqualFold(policyString, string(policy)) {
+			return policy, nil
+		}
+	}
+	return OverflowPolicyDropNewest, errors.New("OverflowPolicy should be DropNewest, DropOldest or LatestOnly, got " + policyString)
+}
+
+/*
+ChunkTypeRoutingConfig holds the routing settings for a single chunk type
+*/
+type ChunkTypeRoutingConfig struct {
+	HistoryChunks    int                 // Number of recent chunks replayed to a new subscriber, 0 to disable
+	HistoryMaxAge    time.Duration       // Only chunks newer than this are replayed, 0 to disable
+	OverflowPolicy   QueueOverflowPolicy // What to drop when the send queue of one of the type's clients is full
+	IdleExpiry       time.Duration       // How long without chunks before the type goes stale, 0 to never expire
+	ThroughputWindow time.Duration       // Window chunk and byte rates are measured over
+}
+
+/*
+ChunkRoutingConfig holds the routing settings of every chunk type. Types
+without their own entry use the defaults
+*/
+type ChunkRoutingConfig struct {
+	Default         ChunkTypeRoutingConfig            // Settings for chunk types not listed
+	ChunkTypes      map[string]ChunkTypeRoutingConfig // Settings for specific chunk types
+	KnownChunkTypes []string                          // Chunk types whose routes are registered at startup
+}
+
+func (c ChunkRoutingConfig) GetChunkTypeConfig(chunkTypeString string) ChunkTypeRoutingConfig {
+	if chunkTypeConfig, exists := c.ChunkTypes[chunkTypeString]; exists {
+		return chunkTypeConfig
+	}
+	return c.Default
+}
+
+/*
+NewChunkRoutingConfig returns the routing used when nothing is configured
+*/
+func NewChunkRoutingConfig() ChunkRoutingConfig {
+	return ChunkRoutingConfig{
+		Default: ChunkTypeRoutingConfig{
+			OverflowPolicy:   OverflowPolicyDropNewest,
+			ThroughputWindow: 10 * time.Second,
+		},
+		ChunkTypes: make(map[string]ChunkTypeRoutingConfig),
+	}
+}
+
+/*
+ParseChunkRoutingConfig reads a ChunkRoutingConfig section of the form
+
+	{ "KnownChunkTypes": [ ... ], "Default": { ... }, "<ChunkType>": { ... } }
+
+Each chunk type section only needs the keys it changes from the defaults
+*/
+func ParseChunkRoutingConfig(configSection map[string]interface{}) (ChunkRoutingConfig, error) {
+
+	routingConfig := NewChunkRoutingConfig()
+
+	var err error
+	if DefaultConfig, exists := GetConfigSection(configSection, "Default"); exists {
+		if routingConfig.Default, err = parseChunkTypeRoutingConfig(DefaultConfig, routingConfig.Default); err != nil {
+			return routingConfig, errors.New("Default: " + err.Error())
+		}
+	}
+
+	if routingConfig.KnownChunkTypes, err = GetConfigStringList(configSection, "KnownChunkTypes", nil); err != nil {
+		return routingConfig, err
+	}
+
+	for chunkTypeString := range configSection {
+		if chunkTypeString == "Default" || chunkTypeString == "KnownChunkTypes" {
+			continue
+		}
+
+		ChunkTypeConfig, isSection := GetConfigSection(configSection, chunkTypeString)
+		if !isSection {
+			return routingConfig, errors.New(chunkTypeString + " should be a config section")
+		}
+
+		if routingConfig.ChunkTypes[chunkTypeString], err = parseChunkTypeRoutingConfig(ChunkTypeConfig, routingConfig.Default); err != nil {
+			return routingConfig, errors.New(chunkTypeString + ": " + err.Error())
+		}
+	}
+
+	return routingConfig, nil
+}
+
+func parseChunkTypeRoutingConfig(configSection map[string]interface{}, defaults ChunkTypeRoutingConfig) (ChunkTypeRoutingConfig, error) {
+
+	chunkTypeConfig := defaults
+	var err error
+
+	if chunkTypeConfig.HistoryChunks, err = GetConfigInt(configSection, "HistoryChunks", defaults.HistoryChunks); err != nil {
+		return chunkTypeConfig, err
+	}
+	if chunkTypeConfig.HistoryChunks < 0 {
+		return chunkTypeConfig, errors.New("HistoryChunks should not be negative")
+	}
+
+	historySeconds, err := GetConfigInt(configSection, "HistorySeconds", int(defaults.HistoryMaxAge/time.Second))
+	if err != nil {
+		return chunkTypeConfig, err
+	}
+	if historySeconds < 0 {
+		return chunkTypeConfig, errors.New("HistorySeconds should not be negative")
+	}
+	chunkTypeConfig.HistoryMaxAge = time.Duration(historySeconds) * time.Second
+
+	policyString, err := GetConfigString(configSection, "OverflowPolicy", string(defaults.OverflowPolicy))
+	if err != nil {
+		return chunkTypeConfig, err
+	}
+	if chunkTypeConfig.OverflowPolicy, err = ParseQueueOverflowPolicy(policyString); err != nil {
+		return chunkTypeConfig, err
+	}
+
+	idleExpirySeconds, err := GetConfigInt(configSection, "IdleExpirySeconds", int(defaults.IdleExpiry/time.Second))
+	if err != nil {
+		return chunkTypeConfig, err
+	}
+	if idleExpirySeconds < 0 {
+		return chunkTypeConfig, errors.New("IdleExpirySeconds should not be negative")
+	}
+	chunkTypeConfig.IdleExpiry = time.Duration(idleExpirySeconds) * time.Second
+
+	throughputWindowSeconds, err := GetConfigInt(configSection, "ThroughputWindowSeconds", int(defaults.ThroughputWindow/time.Second))
+	if err != nil {
+		return chunkTypeConfig, err
+	}
+	if throughputWindowSeconds < 1 {
+		return chunkTypeConfig, errors.New("ThroughputWindowSeconds should be at least 1")
+	}
+	chunkTypeConfig.ThroughputWindow = time.Duration(throughputWindowSeconds) * time.Second
+
+	return chunkTypeConfig, nil
+}
@@ -0,0 +1,61 @@
+package Routines
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseChunkRoutingConfig(t *testing.T) {
+	routingConfig, err := ParseChunkRoutingConfig(map[string]interface{}{
+		"KnownChunkTypes": []interface{}{"TimeChunk", "FFTChunk"},
+		"Default":         map[string]interface{}{"HistoryChunks": "5", "HistorySeconds": "10"},
+		"TimeChunk":       map[string]interface{}{"HistoryChunks": "1", "OverflowPolicy": "dropoldest"},
+		"GPSChunk":        map[string]interface{}{"OverflowPolicy": "LatestOnly"},
+	})
+	if err != nil {
+		t.Fatalf("parsing failed: %v", err)
+	}
+
+	if len(routingConfig.KnownChunkTypes) != 2 || routingConfig.KnownChunkTypes[0] != "TimeChunk" || routingConfig.KnownChunkTypes[1] != "FFTChunk" {
+		t.Errorf("known chunk types are %v, want [TimeChunk FFTChunk]", routingConfig.KnownChunkTypes)
+	}
+
+	testCases := []struct {
+		chunkTypeString    string
+		wantHistoryChunks  int
+		wantHistoryMaxAge  time.Duration
+		wantOverflowPolicy QueueOverflowPolicy
+	}{
+		{"TimeChunk", 1, 10 * time.Second, OverflowPolicyDropOldest},
+		{"FFTChunk", 5, 10 * time.Second, OverflowPolicyDropNewest},
+		{"GPSChunk", 5, 10 * time.Second, OverflowPolicyLatestOnly},
+	}
+	for _, testCase := range testCases {
+		chunkTypeConfig := routingConfig.GetChunkTypeConfig(testCase.chunkTypeString)
+		if chunkTypeConfig.HistoryChunks != testCase.wantHistoryChunks || chunkTypeConfig.HistoryMaxAge != testCase.wantHistoryMaxAge {
+			t.Errorf("%s got %d chunks and %v, want %d chunks and %v", testCase.chunkTypeString,
+				chunkTypeConfig.HistoryChunks, chunkTypeConfig.HistoryMaxAge, testCase.wantHistoryChunks, testCase.wantHistoryMaxAge)
+		}
+		if chunkTypeConfig.OverflowPolicy != testCase.wantOverflowPolicy {
+			t.Errorf("%s got %s, want %s", testCase.chunkTypeString, chunkTypeConfig.OverflowPolicy, testCase.wantOverflowPolicy)
+		}
+	}
+
+	if defaultConfig := NewChunkRoutingConfig().GetChunkTypeConfig("TimeChunk"); defaultConfig.OverflowPolicy != OverflowPolicyDropNewest {
+		t.Errorf("unconfigured chunk types get %s, want DropNewest", defaultConfig.OverflowPolicy)
+	}
+
+	invalidSections := []map[string]interface{}{
+		{"Default": map[string]interface{}{"HistoryChunks": "-1"}},
+		{"TimeChunk": map[string]interface{}{"HistorySeconds": "-1"}},
+		{"TimeChunk": map[string]interface{}{"HistoryChunks": "many"}},
+		{"TimeChunk": "1"},
+		{"TimeChunk": map[string]interface{}{"OverflowPolicy": "DropAll"}},
+		{"KnownChunkTypes": "TimeChunk"},
+	}
+	for _, invalidSection := range invalidSections {
+		if _, err := ParseChunkRoutingConfig(invalidSection); err == nil {
+			t.Errorf("%v did not fail", invalidSection)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package Routines
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+/*
+ChunkSubscriber is a single client of a chunk type. Every subscriber has its
+own send queue so one slow client only ever holds up itself
+*/
+type ChunkSubscriber struct {
+	Name              string            // Remote host of the client
+	Label             string            // Name made unique among the chunk type's clients when subscribed, used in reporting
+	ChunkType         string            // Chunk type the client subscribed to
+	sendQueue         chan *RoutedChunk // Chunks waiting to be written to the client
+	droppedChunkCount atomic.Uint64     // Chunks dropped because the send queue was full
+	lagStartTime      time.Time         // When the client went over the lag threshold, zero if it is keeping up
+	lagging           atomic.Bool       // Whether the client is currently over the lag threshold
+	disconnect        chan struct{}     // Closed when the client should be disconnected for being too slow
+	disconnectOnce    sync.Once         // Ensures disconnect is only closed once
+}
+
+func NewChunkSubscriber(name string, chunkTypeString string, queueCapacity int) *ChunkSubscriber {
+	p := new(ChunkSubscriber)
+	p.Name = name
+	p.ChunkType = chunkTypeString
+	p.sendQueue = make(chan *RoutedChunk, queueCapacity)
+	p.disconnect = make(chan struct{})
+	return p
+}
+
+/*
+GetLag returns how many chunks the client is behind and how many it may be
+*/
+func (c *ChunkSubscriber) GetLag() (lag int, capacity int) {
+	return len(c.sendQueue), cap(c.sendQueue)
+}
+
+func (c *ChunkSubscriber) IsLagging() bool {
+	return c.lagging.Load()
+}
+
+func (c *ChunkSubscriber) GetDroppedChunkCount() uint64 {
+	return c.droppedChunkCount.Load()
+}
+
+/*
+Disconnected is closed when the slow consumer policy has asked for this
+client to be disconnected
+*/
+func (c *ChunkSubscriber) Disconnected() <-chan struct{} {
+	return c.disconnect
+}
+
+/*
+GetClientStatName returns what the statistics of this client are named after
+*/
+func (c *ChunkSubscriber) GetClientStatName() string {
+	return c.ChunkType + "_Client_" + c.Label
+}
+
+/*
+Queue holds the chunks waiting to be written to the client
+*/
+func (c *ChunkSubscriber) Queue() <-chan *RoutedChunk {
+	return c.sendQueue
+}
+
+/*
+Deliver queues a chunk for the client, applying the chunk type's overflow
+policy to this client alone if the client is too far behind. The client's
+lag is then checked against the slow consumer policy. Only the one
+dispatcher serving the client may deliver to it
+
+returns how many chunks were dropped for the client and whether it should
+now be disconnected
+*/
+func (c *ChunkSubscriber) Deliver(chunk *RoutedChunk, overflowPolicy QueueOverflowPolicy, slowConsumerConfig SlowConsumerConfig) (droppedChunkCount int, disconnect bool) {
+
+	droppedChunkCount = c.enqueue(chunk, overflowPolicy)
+	c.droppedChunkCount.Add(uint64(droppedChunkCount))
+
+	lag, _ := c.GetLag()
+	if lag < slowConsumerConfig.LagThreshold {
+		c.lagStartTime = time.Time{}
+		c.lagging.Store(false)
+		return droppedChunkCount, false
+	}
+
+	if !c.lagging.Load() {
+		c.lagStartTime = time.Now()
+		c.lagging.Store(true)
+	}
+
+	if slowConsumerConfig.Policy != SlowConsumerPolicyDisconnect || time.Since(c.lagStartTime) < slowConsumerConfig.LagDuration {
+		return droppedChunkCount, false
+	}
+
+	c.disconnectOnce.Do(func() {
+		close(c.disconnect)
+		disconnect = true
+	})
+	return droppedChunkCount, disconnect
+}
+
+/*
+enqueue places a chunk on the send queue. Conflating clients only keep the
+newest chunk so anything still waiting is dropped first, otherwise chunks
+are only dropped when the queue is full
+
+returns how many chunks were dropped
+*/
+func (c *ChunkSubscriber) enqueue(chunk *RoutedChunk, overflowPolicy QueueOverflowPolicy) int {
+
+	droppedChunkCount := 0
+	if overflowPolicy == OverflowPolicyLatestOnly {
+		droppedChunkCount += c.drainQueue()
+	}
+
+	for {
+		select {
+		case c.sendQueue <- chunk:
+			return droppedChunkCount
+		default:
+		}
+
+		droppedChunkCount++
+		if overflowPolicy == OverflowPolicyDropNewest {
+			return droppedChunkCount
+		}
+
+		// Otherwise make space by throwing away the oldest queued chunk and retry
+		select {
+		case <-c.sendQueue:
+		default:
+			// The client took it first so the retry does not drop anything
+			droppedChunkCount--
+		}
+	}
+}
+
+// drainQueue empties the send queue and returns how many chunks it held
+func (c *ChunkSubscriber) drainQueue() int {
+	drainedChunkCount := 0
+	for {
+		select {
+		case <-c.sendQueue:
+			drainedChunkCount++
+		default:
+			return drainedChunkCount
+		}
+	}
+}
+
+func (s *ChunkTypeToChannelMap) AddSubscriber(subscriber *ChunkSubscriber) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.subscriberMap == nil {
+		s.subscriberMap = make(map[string]map[*ChunkSubscriber]struct{})
+	}
+	if s.subscriberMap[subscriber.ChunkType] == nil {
+		s.subscriberMap[subscriber.ChunkType] = make(map[*ChunkSubscriber]struct{})
+	}
+	subscriber.Label = s.getUnusedClientLabel(subscriber.ChunkType, subscriber.Name)
+	s.subscriberMap[subscriber.ChunkType][subscriber] = struct{}{}
+}
+
+/*
+getUnusedClientLabel labels a client by its host, numbering clients from the
+same host so each is reported on its own. A client that reconnects gets its
+old label back rather than one per ephemeral port. The caller must hold the
+mutex
+*/
+func (s *ChunkTypeToChannelMap) getUnusedClientLabel(chunkTypeString string, name string) string {
+	for clientNumber := 1; ; clientNumber++ {
+		label := name
+		if clientNumber > 1 {
+			label += "-" + strconv.Itoa(clientNumber)
+		}
+
+		labelUsed := false
+		for subscriber := range s.subscriberMap[chunkTypeString] {
+			if subscriber.Label == label {
+				labelUsed = true
+				break
+			}
+		}
+		if !labelUsed {
+			return label
+		}
+	}
+}
+
+/*
+RemoveSubscriber stops delivering to a client and has the reporting routine
+forget its statistics
+*/
+func (s *ChunkTypeToChannelMap) RemoveSubscriber(subscriber *ChunkSubscriber) {
+	s.mu.Lock()
+	delete(s.subscriberMap[subscriber.ChunkType], subscriber)
+	s.mu.Unlock()
+
+	SendStatRemoval(s.reportingOutputChannel, AdapterStatEnvironment, subscriber.GetClientStatName()+"_")
+}
+
+func (s *ChunkTypeToChannelMap) GetSubscribers(chunkTypeString string) []*ChunkSubscriber {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	subscribers := make([]*ChunkSubscriber, 0, len(s.subscriberMap[chunkTypeString]))
+	for subscriber := range s.subscriberMap[chunkTypeString] {
+		subscribers = append(subscribers, subscriber)
+	}
+	return subscribers
+}
+
+/*
+RunChunkDispatcher drains the routing queue of a chunk type and copies each
+chunk onto the send queue of every subscriber. The queue is drained even
+without subscribers so it never sits full, which leaves the chunk type's
+overflow policy to be applied where chunks do build up, in the queues of
+slow clients. While the type is stale there is no queue so the dispatcher
+sleeps until the type is re-activated, and it returns once the type is
+forgotten
+*/
+func (s *ChunkTypeToChannelMap) RunChunkDispatcher(loggingChannel chan map[zerolog.Level]string, chunkTypeString string, dispatcherStopped <-chan struct{}) {
+
+	for {
+		select {
+		case <-dispatcherStopped:
+			return
+		default:
+		}
+
+		// The queue is replaced if the type goes stale and comes back so
+		// read it together with the channel that signals the replacement
+		s.mu.RLock()
+		chunkRoutingChannel := s.chunkTypeRoutingMap[chunkTypeString]
+		stateChanged := s.stateChangedMap[chunkTypeString]
+		s.mu.RUnlock()
+
+		s.dispatchChunks(loggingChannel, chunkTypeString, chunkRoutingChannel, stateChanged)
+	}
+}
+
+/*
+dispatchChunks copies chunks from one routing queue until the state of the
+chunk type changes. A nil queue blocks forever so stale types just wait
+*/
+func (s *ChunkTypeToChannelMap) dispatchChunks(loggingChannel chan map[zerolog.Level]string, chunkTypeString string, chunkRoutingChannel chan *RoutedChunk, stateChanged <-chan struct{}) {
+
+	overflowPolicy := s.serverConfig.ChunkRouting.GetChunkTypeConfig(chunkTypeString).OverflowPolicy
+
+	for {
+		select {
+		case <-stateChanged:
+			return
+		case chunk := <-chunkRoutingChannel:
+			s.deliverToSubscribers(loggingChannel, chunkTypeString, chunk, overflowPolicy)
+		}
+	}
+}
+
+/*
+deliverToSubscribers copies a chunk to every client of a chunk type, counting
+the chunks dropped for slow clients against the chunk type
+*/
+func (s *ChunkTypeToChannelMap) deliverToSubscribers(loggingChannel chan map[zerolog.Level]string, chunkTypeString string, chunk *RoutedChunk, overflowPolicy QueueOverflowPolicy) {
+
+	droppedChunkCount := 0
+	for _, subscriber := range s.GetSubscribers(chunkTypeString) {
+		subscriberDroppedChunkCount, disconnect := subscriber.Deliver(chunk, overflowPolicy, s.serverConfig.SlowConsumer)
+		droppedChunkCount += subscriberDroppedChunkCount
+		if disconnect {
+			s.disconnectedSlowClientCount.Add(1)
+			loggingChannel <- CreateLogMessage(zerolog.WarnLevel, "Client "+subscriber.Name+" on "+chunkTypeString+" too slow, disconnecting")
+		}
+	}
+
+	if droppedChunkCount > 0 {
+		s.AddDroppedChunkCount(chunkTypeString, uint64(droppedChunkCount))
+	}
+}
+
+/*
+ReportSlowConsumers sends how many clients are lagging and how many have
+been disconnected for being too slow
+*/
+func (s *ChunkTypeToChannelMap) ReportSlowConsumers() {
+
+	laggingClientCount := 0
+	s.mu.RLock()
+	for _, subscribers := range s.subscriberMap {
+		for subscriber := range subscribers {
+			if subscriber.IsLagging() {
+				laggingClientCount++
+			}
+		}
+	}
+	s.mu.RUnlock()
+
+	LaggingClientsMetric := NewMetricStatistic("Lagging_Clients", float64(laggingClientCount), MetricUnitClients).
+		WithMetric("lagging_clients", nil)
+	if laggingClientCount > 0 {
+		LaggingClientsMetric = LaggingClientsMetric.WithSeverity(MetricSeverityWarning)
+	}
+
+	SendMetric(s.reportingOutputChannel, LaggingClientsMetric)
+	SendMetric(s.reportingOutputChannel, NewMetricStatistic("Disconnected_Slow_Clients", float64(s.disconnectedSlowClientCount.Load()), MetricUnitClients).
+		WithMetric("slow_clients_disconnected_total", nil))
+}
+
+/*
+ReportSubscriber sends the lag and drop count of a single client
+*/
+func (s *ChunkTypeToChannelMap) ReportSubscriber(subscriber *ChunkSubscriber) {
+
+	lag, capacity := subscriber.GetLag()
+	clientName := subscriber.GetClientStatName()
+
+	clientLabels := map[string]string{"chunk_type": subscriber.ChunkType, "client": subscriber.Label}
+	SendMetric(s.reportingOutputChannel, NewMetricStatistic(clientName+"_Lag", float64(lag), MetricUnitChunks).WithCapacity(float64(capacity)).
+		WithMetric("client_lag_chunks", clientLabels))
+	SendMetric(s.reportingOutputChannel, NewMetricStatistic(clientName+"_Dropped_Chunks", float64(subscriber.GetDroppedChunkCount()), MetricUnitChunks).
+		WithMetric("client_dropped_chunks_total", clientLabels))
+}
+
+/*
+GetClientHost drops the port from a remote address, which changes every
+time a client reconnects
+*/
+func GetClientHost(remoteAddress string) string {
+	host, _, err := net.SplitHostPort(remoteAddress)
+	if err != nil {
+		return remoteAddress
+	}
+	return host
+}
@@ -0,0 +1,166 @@
+package Routines
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newSequencedChunk(sequenceNumber uint64) *RoutedChunk {
+	chunk := NewRoutedChunk(`{"TimeChunk":{}}`)
+	chunk.SequenceNumber = sequenceNumber
+	return chunk
+}
+
+func TestDeliverAppliesOverflowPolicyToClientQueue(t *testing.T) {
+	testCases := []struct {
+		overflowPolicy        QueueOverflowPolicy
+		wantQueuedChunks      []uint64
+		wantDroppedChunkCount uint64
+	}{
+		{OverflowPolicyDropNewest, []uint64{1, 2, 3}, 2},
+		{OverflowPolicyDropOldest, []uint64{3, 4, 5}, 2},
+		{OverflowPolicyLatestOnly, []uint64{5}, 4},
+	}
+
+	slowConsumerConfig := NewSlowConsumerConfig()
+	for _, testCase := range testCases {
+		t.Run(string(testCase.overflowPolicy), func(t *testing.T) {
+			subscriber := NewChunkSubscriber("client", "TimeChunk", 3)
+
+			var droppedChunkCount int
+			for sequenceNumber := uint64(1); sequenceNumber <= 5; sequenceNumber++ {
+				dropped, _ := subscriber.Deliver(newSequencedChunk(sequenceNumber), testCase.overflowPolicy, slowConsumerConfig)
+				droppedChunkCount += dropped
+			}
+
+			if uint64(droppedChunkCount) != testCase.wantDroppedChunkCount || subscriber.GetDroppedChunkCount() != testCase.wantDroppedChunkCount {
+				t.Errorf("dropped %d chunks, subscriber counted %d, want %d", droppedChunkCount, subscriber.GetDroppedChunkCount(), testCase.wantDroppedChunkCount)
+			}
+
+			var queuedChunks []uint64
+			for len(subscriber.Queue()) > 0 {
+				queuedChunks = append(queuedChunks, (<-subscriber.Queue()).SequenceNumber)
+			}
+			if len(queuedChunks) != len(testCase.wantQueuedChunks) {
+				t.Fatalf("queued %v, want %v", queuedChunks, testCase.wantQueuedChunks)
+			}
+			for chunkIndex := range queuedChunks {
+				if queuedChunks[chunkIndex] != testCase.wantQueuedChunks[chunkIndex] {
+					t.Fatalf("queued %v, want %v", queuedChunks, testCase.wantQueuedChunks)
+				}
+			}
+		})
+	}
+}
+
+func TestDispatchCountsClientDropsAgainstChunkType(t *testing.T) {
+	loggingChannel := newTestLoggingChannel(t)
+	chunkTypeRoutingMap := NewChunkTypeToChannelMap(loggingChannel, make(chan string, 1000), newTestServerConfig(t, nil))
+
+	subscriber := NewChunkSubscriber("client", "TimeChunk", 2)
+	chunkTypeRoutingMap.AddSubscriber(subscriber)
+
+	for sequenceNumber := uint64(1); sequenceNumber <= 5; sequenceNumber++ {
+		chunkTypeRoutingMap.deliverToSubscribers(loggingChannel, "TimeChunk", newSequencedChunk(sequenceNumber), OverflowPolicyDropNewest)
+	}
+
+	if droppedChunkCount := chunkTypeRoutingMap.GetDroppedChunkCount("TimeChunk"); droppedChunkCount != 3 {
+		t.Errorf("chunk type dropped %d chunks, want 3", droppedChunkCount)
+	}
+}
+
+func TestAllChunkTypesClientsGetEveryTypeInOrder(t *testing.T) {
+	loggingChannel := newTestLoggingChannel(t)
+	serverConfig := newTestServerConfig(t, nil)
+	// Every delivery past the first then goes through the lag tracking
+	serverConfig.SlowConsumer.LagThreshold = 1
+	chunkTypeRoutingMap := NewChunkTypeToChannelMap(loggingChannel, make(chan string, 1000), serverConfig)
+	chunkTypeRoutingMap.RegisterAllChunkTypesRoute(loggingChannel, gin.New())
+
+	chunkTypes := []string{"TimeChunk", "FFTChunk", "GPSChunk", "WAVChunk"}
+	chunksPerType := 200
+
+	// Clients of each type keep every type's dispatcher busy at the same time
+	for _, chunkTypeString := range chunkTypes {
+		chunkTypeRoutingMap.AddSubscriber(NewChunkSubscriber("client", chunkTypeString, chunksPerType))
+	}
+	allChunkTypesSubscriber := NewChunkSubscriber("client", AllChunkTypesName, len(chunkTypes)*chunksPerType)
+	chunkTypeRoutingMap.AddSubscriber(allChunkTypesSubscriber)
+
+	var sentChunkTypes []string
+	for chunkIndex := 0; chunkIndex < chunksPerType; chunkIndex++ {
+		for _, chunkTypeString := range chunkTypes {
+			chunkTypeRoutingMap.SendChunkToWebSocket(loggingChannel, chunkTypeString, `{"`+chunkTypeString+`":{}}`)
+			sentChunkTypes = append(sentChunkTypes, chunkTypeString)
+		}
+	}
+
+	for chunkIndex, sentChunkType := range sentChunkTypes {
+		select {
+		case envelope := <-allChunkTypesSubscriber.Queue():
+			var chunkEnvelope ChunkEnvelope
+			if err := json.Unmarshal([]byte(envelope.JSONString), &chunkEnvelope); err != nil {
+				t.Fatalf("chunk %d is not an envelope: %v", chunkIndex, err)
+			}
+			if chunkEnvelope.ChunkType != sentChunkType {
+				t.Fatalf("chunk %d is a %s, want %s", chunkIndex, chunkEnvelope.ChunkType, sentChunkType)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("only %d of %d chunks were delivered", chunkIndex, len(sentChunkTypes))
+		}
+	}
+	if droppedChunkCount := allChunkTypesSubscriber.GetDroppedChunkCount(); droppedChunkCount != 0 {
+		t.Errorf("dropped %d chunks, want none", droppedChunkCount)
+	}
+}
+
+func TestSubscribersFromOneHostGetStableLabels(t *testing.T) {
+	loggingChannel := newTestLoggingChannel(t)
+	reportingChannel := make(chan string, 10)
+	chunkTypeRoutingMap := NewChunkTypeToChannelMap(loggingChannel, reportingChannel, newTestServerConfig(t, nil))
+
+	firstSubscriber := NewChunkSubscriber(GetClientHost("10.0.0.5:51234"), "TimeChunk", 1)
+	secondSubscriber := NewChunkSubscriber(GetClientHost("10.0.0.5:51235"), "TimeChunk", 1)
+	otherTypeSubscriber := NewChunkSubscriber(GetClientHost("10.0.0.5:51236"), "FFTChunk", 1)
+	chunkTypeRoutingMap.AddSubscriber(firstSubscriber)
+	chunkTypeRoutingMap.AddSubscriber(secondSubscriber)
+	chunkTypeRoutingMap.AddSubscriber(otherTypeSubscriber)
+
+	if firstSubscriber.Label != "10.0.0.5" || secondSubscriber.Label != "10.0.0.5-2" || otherTypeSubscriber.Label != "10.0.0.5" {
+		t.Fatalf("got labels %q, %q and %q", firstSubscriber.Label, secondSubscriber.Label, otherTypeSubscriber.Label)
+	}
+
+	// The statistics of a client that leaves are forgotten
+	chunkTypeRoutingMap.RemoveSubscriber(firstSubscriber)
+	var systemStatRemoval SystemStatRemoval
+	if err := json.Unmarshal([]byte(<-reportingChannel), &systemStatRemoval); err != nil {
+		t.Fatalf("removing a subscriber did not report a removal: %v", err)
+	}
+	if wantRemoval := (StatRemoval{StatEnvironment: AdapterStatEnvironment, StatNamePrefix: "TimeChunk_Client_10.0.0.5_"}); systemStatRemoval.Removal != wantRemoval {
+		t.Errorf("got removal %+v, want %+v", systemStatRemoval.Removal, wantRemoval)
+	}
+
+	// and a client reconnecting from a new port takes its label back
+	reconnectedSubscriber := NewChunkSubscriber(GetClientHost("10.0.0.5:51237"), "TimeChunk", 1)
+	chunkTypeRoutingMap.AddSubscriber(reconnectedSubscriber)
+	if reconnectedSubscriber.Label != "10.0.0.5" {
+		t.Errorf("reconnected client got label %q, want 10.0.0.5", reconnectedSubscriber.Label)
+	}
+}
+
+func TestGetClientHost(t *testing.T) {
+	testCases := map[string]string{
+		"10.0.0.5:51234":  "10.0.0.5",
+		"[::1]:51234":     "::1",
+		"no port":         "no port",
+		"localhost:51234": "localhost",
+	}
+	for remoteAddress, want := range testCases {
+		if host := GetClientHost(remoteAddress); host != want {
+			t.Errorf("GetClientHost(%q) = %q, want %q", remoteAddress, host, want)
+		}
+	}
+}
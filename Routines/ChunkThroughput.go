@@ -0,0 +1,175 @@
+package Routines
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+Every chunk type tracks how many chunks and bytes it received, and how large
+they were, in one second buckets. Reports cover the last ThroughputWindow of
+complete seconds so a sensor dropping frames shows up as a falling rate
+rather than being hidden by a single busy second
+*/
+
+type throughputBucket struct {
+	second  int64  // Unix second the bucket counts, buckets of older seconds are reused
+	chunks  uint64 // Number of chunks received in the second
+	bytes   uint64 // Total size of those chunks
+	minSize int    // Smallest chunk received in the second
+	maxSize int    // Largest chunk received in the second
+}
+
+/*
+ChunkThroughputTracker counts the chunks of one type over a sliding window
+*/
+type ChunkThroughputTracker struct {
+	buckets     []throughputBucket // Ring of buckets indexed by Unix second
+	createdTime time.Time          // When tracking started, so early windows are not averaged over time before it
+	mu          sync.Mutex         // Mutex to protect access to the buckets
+}
+
+/*
+ChunkThroughput is what a chunk type received over a window. Sizes are only
+set when chunks were received
+*/
+type ChunkThroughput struct {
+	ChunksPerSecond float64
+	BytesPerSecond  float64
+	Chunks          uint64
+	MinSize         int
+	AverageSize     float64
+	MaxSize         int
+}
+
+func NewChunkThroughputTracker(window time.Duration) *ChunkThroughputTracker {
+	p := new(ChunkThroughputTracker)
+	windowSeconds := int(window / time.Second)
+	if windowSeconds < 1 {
+		windowSeconds = 1
+	}
+	// One bucket more than the window holds the second still being counted
+	p.buckets = make([]throughputBucket, windowSeconds+1)
+	p.createdTime = time.Now()
+	return p
+}
+
+func (t *ChunkThroughputTracker) Record(size int, receivedTime time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	second := receivedTime.Unix()
+	bucket := &t.buckets[second%int64(len(t.buckets))]
+	if bucket.second != second {
+		*bucket = throughputBucket{second: second, minSize: size, maxSize: size}
+	}
+
+	bucket.chunks++
+	bucket.bytes += uint64(size)
+	if size < bucket.minSize {
+		bucket.minSize = size
+	}
+	if size > bucket.maxSize {
+		bucket.maxSize = size
+	}
+}
+
+/*
+GetThroughput sums the complete seconds within the window. Until the tracker
+has existed for a whole window rates are averaged over the time it has
+*/
+func (t *ChunkThroughputTracker) GetThroughput(now time.Time) ChunkThroughput {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	windowSeconds := int64(len(t.buckets) - 1)
+	currentSecond := now.Unix()
+
+	var throughput ChunkThroughput
+	var totalBytes uint64
+	for _, bucket := range t.buckets {
+		if bucket.chunks == 0 || bucket.second >= currentSecond || bucket.second < currentSecond-windowSeconds {
+			continue
+		}
+
+		if throughput.Chunks == 0 || bucket.minSize < throughput.MinSize {
+			throughput.MinSize = bucket.minSize
+		}
+		if bucket.maxSize > throughput.MaxSize {
+			throughput.MaxSize = bucket.maxSize
+		}
+		throughput.Chunks += bucket.chunks
+		totalBytes += bucket.bytes
+	}
+
+	measuredSeconds := currentSecond - t.createdTime.Unix()
+	if measuredSeconds > windowSeconds {
+		measuredSeconds = windowSeconds
+	}
+	if measuredSeconds < 1 {
+		measuredSeconds = 1
+	}
+
+	throughput.ChunksPerSecond = float64(throughput.Chunks) / float64(measuredSeconds)
+	throughput.BytesPerSecond = float64(totalBytes) / float64(measuredSeconds)
+	if throughput.Chunks > 0 {
+		throughput.AverageSize = float64(totalBytes) / float64(throughput.Chunks)
+	}
+	return throughput
+}
+
+/*
+RecordChunkThroughput counts a routed chunk, creating the tracker of its
+type with the configured window on first use
+*/
+func (s *ChunkTypeToChannelMap) RecordChunkThroughput(chunkTypeString string, chunk *RoutedChunk) {
+
+	s.mu.RLock()
+	throughputTracker, exists := s.throughputMap[chunkTypeString]
+	s.mu.RUnlock()
+
+	if !exists {
+		s.mu.Lock()
+		if s.throughputMap == nil {
+			s.throughputMap = make(map[string]*ChunkThroughputTracker)
+		}
+		if throughputTracker, exists = s.throughputMap[chunkTypeString]; !exists {
+			throughputTracker = NewChunkThroughputTracker(s.serverConfig.ChunkRouting.GetChunkTypeConfig(chunkTypeString).ThroughputWindow)
+			s.throughputMap[chunkTypeString] = throughputTracker
+		}
+		s.mu.Unlock()
+	}
+
+	throughputTracker.Record(len(chunk.JSONString), chunk.ReceivedTime)
+}
+
+/*
+ReportChunkThroughput sends the chunk and byte rates of every chunk type and
+the smallest, average and largest chunk sizes of those that received any
+*/
+func (s *ChunkTypeToChannelMap) ReportChunkThroughput() {
+
+	s.mu.RLock()
+	throughputTrackers := make(map[string]*ChunkThroughputTracker, len(s.throughputMap))
+	for chunkTypeString, throughputTracker := range s.throughputMap {
+		throughputTrackers[chunkTypeString] = throughputTracker
+	}
+	s.mu.RUnlock()
+
+	now := time.Now()
+	for chunkTypeString, throughputTracker := range throughputTrackers {
+		throughput := throughputTracker.GetThroughput(now)
+		chunkTypeLabels := map[string]string{"chunk_type": chunkTypeString}
+
+		SendMetric(s.reportingOutputChannel, NewMetricStatistic(chunkTypeString+"_Chunk_Rate", throughput.ChunksPerSecond, MetricUnitChunksPerSecond).
+			WithMetric("chunk_rate", chunkTypeLabels))
+		SendMetric(s.reportingOutputChannel, NewMetricStatistic(chunkTypeString+"_Byte_Rate", throughput.BytesPerSecond, MetricUnitBytesPerSecond).
+			WithMetric("chunk_byte_rate", chunkTypeLabels))
+
+		if throughput.Chunks > 0 {
+			SendMetric(s.reportingOutputChannel, NewMetricStatistic(chunkTypeString+"_Chunk_Size", throughput.AverageSize, MetricUnitBytes).
+				WithRange(float64(throughput.MinSize), float64(throughput.MaxSize)).
+				WithMetric("chunk_size_bytes", chunkTypeLabels))
+		}
+	}
+}
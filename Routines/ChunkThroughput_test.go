@@ -0,0 +1,58 @@
+package Routines
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChunkThroughputOverTheWindow(t *testing.T) {
+	throughputTracker := NewChunkThroughputTracker(3 * time.Second)
+	startSecond := time.Unix(throughputTracker.createdTime.Unix(), 0)
+
+	throughputTracker.Record(100, startSecond.Add(1*time.Second))
+	throughputTracker.Record(300, startSecond.Add(1*time.Second+500*time.Millisecond))
+	throughputTracker.Record(200, startSecond.Add(2*time.Second))
+
+	// The second still being counted is left out
+	throughputTracker.Record(5000, startSecond.Add(3*time.Second))
+
+	throughput := throughputTracker.GetThroughput(startSecond.Add(3*time.Second + 500*time.Millisecond))
+	wantThroughput := ChunkThroughput{ChunksPerSecond: 1, BytesPerSecond: 200, Chunks: 3, MinSize: 100, AverageSize: 200, MaxSize: 300}
+	if throughput != wantThroughput {
+		t.Errorf("got %+v, want %+v", throughput, wantThroughput)
+	}
+
+	// A producer that stops shows up as a falling rate
+	throughput = throughputTracker.GetThroughput(startSecond.Add(7 * time.Second))
+	if throughput.Chunks != 0 || throughput.ChunksPerSecond != 0 || throughput.MaxSize != 0 {
+		t.Errorf("got %+v once the window has moved past every chunk, want nothing", throughput)
+	}
+}
+
+func TestChunkThroughputBeforeAWholeWindow(t *testing.T) {
+	throughputTracker := NewChunkThroughputTracker(10 * time.Second)
+	startSecond := time.Unix(throughputTracker.createdTime.Unix(), 0)
+
+	for i := 0; i < 4; i++ {
+		throughputTracker.Record(50, startSecond)
+	}
+
+	// Averaged over the one second the tracker has existed rather than the window
+	if throughput := throughputTracker.GetThroughput(startSecond.Add(time.Second)); throughput.ChunksPerSecond != 4 || throughput.BytesPerSecond != 200 {
+		t.Errorf("got %+v, want 4 chunks and 200 bytes a second", throughput)
+	}
+}
+
+func TestChunkThroughputReusesBuckets(t *testing.T) {
+	throughputTracker := NewChunkThroughputTracker(2 * time.Second)
+	startSecond := time.Unix(throughputTracker.createdTime.Unix(), 0)
+
+	for second := 0; second < 20; second++ {
+		throughputTracker.Record(10*(second+1), startSecond.Add(time.Duration(second)*time.Second))
+	}
+
+	throughput := throughputTracker.GetThroughput(startSecond.Add(20 * time.Second))
+	if throughput.Chunks != 2 || throughput.MinSize != 190 || throughput.MaxSize != 200 {
+		t.Errorf("got %+v, want only the last two seconds", throughput)
+	}
+}
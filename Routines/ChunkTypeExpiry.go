@@ -0,0 +1,232 @@
+package Routines
+
+import (
+	"encoding/json"
+	"slices"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+/*
+Chunk types that stop arriving for longer than their IdleExpiry are marked
+stale and their queue and history are freed. The type is still served so
+its routes tell subscribers the type is stale. If the type is seen again it
+is re-activated on the same routes. Once a stale type has no subscribers
+left it is forgotten entirely, unless it is a known chunk type, so producers
+sending many one-off types do not grow the router
+*/
+
+const (
+	ChunkTypeStatusActive = "Active"
+	ChunkTypeStatusStale  = "Stale"
+)
+
+type ChunkTypeStatus struct {
+	ChunkType string `json:"ChunkType"`
+	Status    string `json:"Status"`
+}
+
+/*
+ChunkTypeStatusMessage is sent to subscribers in place of chunk data when a
+chunk type becomes stale or active again
+*/
+type ChunkTypeStatusMessage struct {
+	Status ChunkTypeStatus `json:"ChunkTypeStatus"`
+}
+
+func CreateChunkTypeStatusMessage(chunkTypeString string, stale bool) string {
+	status := ChunkTypeStatusActive
+	if stale {
+		status = ChunkTypeStatusStale
+	}
+
+	data, _ := json.Marshal(ChunkTypeStatusMessage{Status: ChunkTypeStatus{
+		ChunkType: chunkTypeString,
+		Status:    status,
+	}})
+	return string(data)
+}
+
+func (s *ChunkTypeToChannelMap) UpdateLastSeenTime(chunkTypeString string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.lastSeenTimeMap == nil {
+		s.lastSeenTimeMap = make(map[string]time.Time)
+	}
+	s.lastSeenTimeMap[chunkTypeString] = time.Now()
+}
+
+/*
+GetLastSeenTimes returns when each chunk type was last received
+*/
+func (s *ChunkTypeToChannelMap) GetLastSeenTimes() map[string]time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	lastSeenTimes := make(map[string]time.Time, len(s.lastSeenTimeMap))
+	for chunkTypeString, lastSeenTime := range s.lastSeenTimeMap {
+		lastSeenTimes[chunkTypeString] = lastSeenTime
+	}
+	return lastSeenTimes
+}
+
+func (s *ChunkTypeToChannelMap) IsChunkTypeStale(chunkTypeString string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.staleChunkTypeSet[chunkTypeString]
+}
+
+// Already closed so a select on it fires straight away
+var closedChannel = func() chan struct{} {
+	channel := make(chan struct{})
+	close(channel)
+	return channel
+}()
+
+/*
+GetChunkTypeState returns whether a chunk type is stale along with a channel
+that is closed the next time its queues are made or freed. Waiting on the
+channel lets routines follow the state without polling it
+*/
+func (s *ChunkTypeToChannelMap) GetChunkTypeState(chunkTypeString string) (stale bool, stateChanged <-chan struct{}) {
+	s.mu.RLock()
+	stale = s.staleChunkTypeSet[chunkTypeString]
+	stateChangedChannel, exists := s.stateChangedMap[chunkTypeString]
+	s.mu.RUnlock()
+
+	if exists {
+		return stale, stateChangedChannel
+	}
+
+	// The type has not been registered yet so there is nothing to wait on
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return stale, s.getStateChangedChannel(chunkTypeString)
+}
+
+/*
+getStateChangedChannel returns the channel waited on for a chunk type,
+making it if needed. The caller must hold the mutex
+*/
+func (s *ChunkTypeToChannelMap) getStateChangedChannel(chunkTypeString string) chan struct{} {
+	if s.stateChangedMap == nil {
+		s.stateChangedMap = make(map[string]chan struct{})
+	}
+	if s.stateChangedMap[chunkTypeString] == nil {
+		s.stateChangedMap[chunkTypeString] = make(chan struct{})
+	}
+	return s.stateChangedMap[chunkTypeString]
+}
+
+/*
+signalChunkTypeStateChanged wakes every routine waiting on a chunk type and
+gives the next ones a fresh channel. The caller must hold the mutex
+*/
+func (s *ChunkTypeToChannelMap) signalChunkTypeStateChanged(chunkTypeString string) {
+	close(s.getStateChangedChannel(chunkTypeString))
+	s.stateChangedMap[chunkTypeString] = make(chan struct{})
+}
+
+/*
+ExpireIdleChunkTypes frees the queue and history of every chunk type that
+has not been seen within its IdleExpiry and forgets stale chunk types
+nobody is subscribed to
+*/
+func (s *ChunkTypeToChannelMap) ExpireIdleChunkTypes(loggingChannel chan map[zerolog.Level]string) {
+
+	var expiredChunkTypes []string
+	var forgottenChunkTypes []string
+
+	s.mu.Lock()
+	for chunkTypeString := range s.chunkTypeRoutingMap {
+
+		idleExpiry := s.serverConfig.ChunkRouting.GetChunkTypeConfig(chunkTypeString).IdleExpiry
+		if idleExpiry == 0 || time.Since(s.lastSeenTimeMap[chunkTypeString]) < idleExpiry {
+			continue
+		}
+
+		delete(s.chunkTypeRoutingMap, chunkTypeString)
+		delete(s.chunkHistoryMap, chunkTypeString)
+
+		if s.staleChunkTypeSet == nil {
+			s.staleChunkTypeSet = make(map[string]bool)
+		}
+		s.staleChunkTypeSet[chunkTypeString] = true
+		s.signalChunkTypeStateChanged(chunkTypeString)
+
+		expiredChunkTypes = append(expiredChunkTypes, chunkTypeString)
+	}
+
+	for chunkTypeString := range s.staleChunkTypeSet {
+		if len(s.subscriberMap[chunkTypeString]) > 0 || slices.Contains(s.serverConfig.ChunkRouting.KnownChunkTypes, chunkTypeString) {
+			continue
+		}
+		s.forgetChunkType(chunkTypeString)
+		forgottenChunkTypes = append(forgottenChunkTypes, chunkTypeString)
+	}
+	s.mu.Unlock()
+
+	for _, chunkTypeString := range expiredChunkTypes {
+		loggingChannel <- CreateLogMessage(zerolog.InfoLevel, "ChunkType - "+chunkTypeString+" - idle, marked stale and queue freed")
+	}
+	for _, chunkTypeString := range forgottenChunkTypes {
+		// Its statistics would otherwise be reported with their last values forever
+		SendStatRemoval(s.reportingOutputChannel, AdapterStatEnvironment, chunkTypeString+"_")
+		loggingChannel <- CreateLogMessage(zerolog.InfoLevel, "ChunkType - "+chunkTypeString+" - stale without subscribers, forgotten")
+	}
+}
+
+/*
+forgetChunkType deletes everything kept for a chunk type and stops its
+dispatcher, after which the type is served again only if it is seen again.
+The caller must hold the mutex
+*/
+func (s *ChunkTypeToChannelMap) forgetChunkType(chunkTypeString string) {
+
+	delete(s.chunkTypeRoutingMap, chunkTypeString)
+	delete(s.chunkHistoryMap, chunkTypeString)
+	delete(s.sequenceNumberMap, chunkTypeString)
+	delete(s.droppedChunkCountMap, chunkTypeString)
+	delete(s.reportedDropCountMap, chunkTypeString)
+	delete(s.throughputMap, chunkTypeString)
+	delete(s.latencyMap, chunkTypeString)
+	delete(s.lastSeenTimeMap, chunkTypeString)
+	delete(s.staleChunkTypeSet, chunkTypeString)
+	delete(s.subscriberMap, chunkTypeString)
+	delete(s.lastKnownValueMap, chunkTypeString)
+
+	if dispatcherStopped, exists := s.dispatcherStopMap[chunkTypeString]; exists {
+		close(dispatcherStopped)
+		delete(s.dispatcherStopMap, chunkTypeString)
+	}
+
+	// Wakes the dispatcher so it sees it has been stopped
+	close(s.getStateChangedChannel(chunkTypeString))
+	delete(s.stateChangedMap, chunkTypeString)
+}
+
+/*
+TryReactivateChunkType recreates the queue and history of a stale chunk
+type when it is seen again. Its routes are still registered so nothing
+else has to change
+
+returns whether the chunk type was stale
+*/
+func (s *ChunkTypeToChannelMap) TryReactivateChunkType(loggingChannel chan map[zerolog.Level]string, chunkTypeString string) bool {
+
+	s.mu.Lock()
+	if !s.staleChunkTypeSet[chunkTypeString] {
+		s.mu.Unlock()
+		return false
+	}
+
+	s.createChunkTypeQueues(chunkTypeString)
+	delete(s.staleChunkTypeSet, chunkTypeString)
+	s.mu.Unlock()
+
+	loggingChannel <- CreateLogMessage(zerolog.InfoLevel, "ChunkType - "+chunkTypeString+" - seen again, re-activated")
+	return true
+}
@@ -0,0 +1,181 @@
+package Routines
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+receiveChunkTypeStatuses returns the statuses sent on an event stream as
+they arrive
+*/
+func receiveChunkTypeStatuses(t *testing.T, ctx context.Context, URL string) <-chan string {
+	request, _ := http.NewRequestWithContext(ctx, http.MethodGet, URL, nil)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("could not open event stream: %v", err)
+	}
+
+	statuses := make(chan string, 10)
+	go func() {
+		defer response.Body.Close()
+
+		scanner := bufio.NewScanner(response.Body)
+		isStatusEvent := false
+		for scanner.Scan() {
+			line := scanner.Text()
+			if eventName, isEvent := strings.CutPrefix(line, "event:"); isEvent {
+				isStatusEvent = eventName == "ChunkTypeStatus"
+			}
+			if data, isData := strings.CutPrefix(line, "data:"); isData && isStatusEvent {
+				var statusMessage ChunkTypeStatusMessage
+				json.Unmarshal([]byte(data), &statusMessage)
+				statuses <- statusMessage.Status.Status
+			}
+		}
+	}()
+	return statuses
+}
+
+func waitForChunkTypeStatus(t *testing.T, statuses <-chan string, wantStatus string) {
+	select {
+	case status := <-statuses:
+		if status != wantStatus {
+			t.Fatalf("subscriber was told the chunk type is %s, want %s", status, wantStatus)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("subscriber was not told the chunk type is %s", wantStatus)
+	}
+}
+
+func TestIdleChunkTypesExpireAndReactivate(t *testing.T) {
+	chunkRouter := newTestChunkRouter(t, newTestServerConfig(t, map[string]interface{}{
+		"ChunkRoutingConfig": map[string]interface{}{
+			"TimeChunk": map[string]interface{}{"IdleExpirySeconds": "1"},
+		},
+	}))
+	chunkTypeRoutingMap := chunkRouter.chunkTypeRoutingMap
+	chunkRouter.sendChunk("TimeChunk", `{"TimeChunk":{}}`)
+	chunkRouter.sendChunk("TimeChunk", `{"TimeChunk":{}}`)
+
+	server := httptest.NewServer(chunkRouter.router)
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	statuses := receiveChunkTypeStatuses(t, ctx, server.URL+"/sse/TimeChunk")
+
+	chunkTypeRoutingMap.ExpireIdleChunkTypes(chunkRouter.loggingChannel)
+	if chunkTypeRoutingMap.IsChunkTypeStale("TimeChunk") {
+		t.Fatal("chunk type expired while it was still being received")
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	chunkTypeRoutingMap.ExpireIdleChunkTypes(chunkRouter.loggingChannel)
+	if !chunkTypeRoutingMap.IsChunkTypeStale("TimeChunk") {
+		t.Fatal("idle chunk type was not marked stale")
+	}
+	if _, channelExists := chunkTypeRoutingMap.TryGetChannel("TimeChunk"); channelExists {
+		t.Error("stale chunk type still has its queue")
+	}
+	if _, historyExists := chunkTypeRoutingMap.TryGetChunkHistory("TimeChunk"); historyExists {
+		t.Error("stale chunk type still has its recent chunks")
+	}
+	waitForChunkTypeStatus(t, statuses, ChunkTypeStatusStale)
+
+	// Data arriving again brings the type back on the same routes
+	chunkRouter.sendChunk("TimeChunk", `{"TimeChunk":{}}`)
+	if chunkTypeRoutingMap.IsChunkTypeStale("TimeChunk") {
+		t.Fatal("chunk type was not re-activated")
+	}
+	if _, channelExists := chunkTypeRoutingMap.TryGetChannel("TimeChunk"); !channelExists {
+		t.Error("re-activated chunk type has no queue")
+	}
+	waitForChunkTypeStatus(t, statuses, ChunkTypeStatusActive)
+}
+
+func TestOneOffChunkTypesAreForgottenOnceStale(t *testing.T) {
+	loggingChannel := newTestLoggingChannel(t)
+	reportingChannel := make(chan string, 100)
+	chunkTypeRoutingMap := NewChunkTypeToChannelMap(loggingChannel, reportingChannel, newTestServerConfig(t, map[string]interface{}{
+		"ChunkRoutingConfig": map[string]interface{}{
+			"OneOffChunk": map[string]interface{}{"IdleExpirySeconds": "1"},
+		},
+	}))
+	goroutineCount := runtime.NumGoroutine()
+
+	chunkTypeRoutingMap.SendChunkToWebSocket(loggingChannel, "OneOffChunk", `{"OneOffChunk":{}}`)
+	subscriber := NewChunkSubscriber("client", "OneOffChunk", 10)
+	chunkTypeRoutingMap.AddSubscriber(subscriber)
+	if runtime.NumGoroutine() <= goroutineCount {
+		t.Fatal("no dispatcher was started for the chunk type")
+	}
+
+	chunkTypeRoutingMap.mu.Lock()
+	chunkTypeRoutingMap.lastSeenTimeMap["OneOffChunk"] = time.Now().Add(-2 * time.Second)
+	chunkTypeRoutingMap.mu.Unlock()
+
+	// A subscriber keeps the stale type around to be told when it comes back
+	chunkTypeRoutingMap.ExpireIdleChunkTypes(loggingChannel)
+	if !chunkTypeRoutingMap.IsChunkTypeStale("OneOffChunk") {
+		t.Fatal("idle chunk type was not marked stale")
+	}
+
+	chunkTypeRoutingMap.RemoveSubscriber(subscriber)
+	chunkTypeRoutingMap.ExpireIdleChunkTypes(loggingChannel)
+	if chunkTypeRoutingMap.IsChunkTypeRegistered("OneOffChunk") {
+		t.Fatal("stale chunk type without subscribers is still served")
+	}
+
+	chunkTypeRoutingMap.mu.RLock()
+	perTypeMaps := map[string]int{
+		"routing":        len(chunkTypeRoutingMap.chunkTypeRoutingMap),
+		"history":        len(chunkTypeRoutingMap.chunkHistoryMap),
+		"sequence":       len(chunkTypeRoutingMap.sequenceNumberMap),
+		"dropped chunks": len(chunkTypeRoutingMap.droppedChunkCountMap),
+		"throughput":     len(chunkTypeRoutingMap.throughputMap),
+		"latency":        len(chunkTypeRoutingMap.latencyMap),
+		"last seen":      len(chunkTypeRoutingMap.lastSeenTimeMap),
+		"stale":          len(chunkTypeRoutingMap.staleChunkTypeSet),
+		"subscribers":    len(chunkTypeRoutingMap.subscriberMap),
+		"state changed":  len(chunkTypeRoutingMap.stateChangedMap),
+		"dispatcher":     len(chunkTypeRoutingMap.dispatcherStopMap),
+	}
+	chunkTypeRoutingMap.mu.RUnlock()
+	for mapName, entryCount := range perTypeMaps {
+		if entryCount != 0 {
+			t.Errorf("%s map still has %d entries", mapName, entryCount)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > goroutineCount {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines running, want the %d from before the chunk type was seen", runtime.NumGoroutine(), goroutineCount)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	statRemoved := false
+	for len(reportingChannel) > 0 {
+		var statRemoval SystemStatRemoval
+		if json.Unmarshal([]byte(<-reportingChannel), &statRemoval) == nil && statRemoval.Removal.StatNamePrefix == "OneOffChunk_" {
+			statRemoved = true
+		}
+	}
+	if !statRemoved {
+		t.Error("statistics of the forgotten chunk type were not removed")
+	}
+
+	// and it is registered afresh if it is seen again
+	chunkTypeRoutingMap.SendChunkToWebSocket(loggingChannel, "OneOffChunk", `{"OneOffChunk":{}}`)
+	if sequenceNumber := chunkTypeRoutingMap.GetSequenceNumber("OneOffChunk"); sequenceNumber != 1 {
+		t.Errorf("chunk type seen again starts at sequence number %d, want 1", sequenceNumber)
+	}
+}
@@ -0,0 +1,99 @@
+package Routines
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+/*
+Helpers for reading optional values out of the decoded Config.json. Values
+in the config are written as strings so each helper converts from a string
+and falls back to a default when the key is missing
+*/
+
+func GetConfigSection(configJson map[string]interface{}, sectionName string) (section map[string]interface{}, exists bool) {
+	section, exists = configJson[sectionName].(map[string]interface{})
+	return section, exists
+}
+
+func GetConfigString(configSection map[string]interface{}, key string, defaultValue string) (string, error) {
+	value, exists := configSection[key]
+	if !exists {
+		return defaultValue, nil
+	}
+
+	stringValue, isString := value.(string)
+	if !isString {
+		return defaultValue, errors.New(key + " should be a string")
+	}
+
+	return stringValue, nil
+}
+
+func GetConfigBool(configSection map[string]interface{}, key string, defaultValue bool) (bool, error) {
+	stringValue, err := GetConfigString(configSection, key, strconv.FormatBool(defaultValue))
+	if err != nil {
+		return defaultValue, err
+	}
+
+	switch strings.ToUpper(stringValue) {
+	case "TRUE":
+		return true, nil
+	case "FALSE":
+		return false, nil
+	}
+
+	return defaultValue, errors.New(key + " should be True or False, got " + stringValue)
+}
+
+func GetConfigInt(configSection map[string]interface{}, key string, defaultValue int) (int, error) {
+	stringValue, err := GetConfigString(configSection, key, strconv.Itoa(defaultValue))
+	if err != nil {
+		return defaultValue, err
+	}
+
+	intValue, err := strconv.Atoi(stringValue)
+	if err != nil {
+		return defaultValue, errors.New(key + " should be an integer, got " + stringValue)
+	}
+
+	return intValue, nil
+}
+
+func GetConfigFloat(configSection map[string]interface{}, key string, defaultValue float64) (float64, error) {
+	stringValue, err := GetConfigString(configSection, key, strconv.FormatFloat(defaultValue, 'f', -1, 64))
+	if err != nil {
+		return defaultValue, err
+	}
+
+	floatValue, err := strconv.ParseFloat(stringValue, 64)
+	if err != nil {
+		return defaultValue, errors.New(key + " should be a number, got " + stringValue)
+	}
+
+	return floatValue, nil
+}
+
+func GetConfigStringList(configSection map[string]interface{}, key string, defaultValue []string) ([]string, error) {
+	value, exists := configSection[key]
+	if !exists {
+		return defaultValue, nil
+	}
+
+	listValue, isList := value.([]interface{})
+	if !isList {
+		return defaultValue, errors.New(key + " should be a list of strings")
+	}
+
+	stringValues := make([]string, 0, len(listValue))
+	for _, item := range listValue {
+		stringValue, isString := item.(string)
+		if !isString {
+			return defaultValue, errors.New(key + " should be a list of strings")
+		}
+		stringValues = append(stringValues, stringValue)
+	}
+
+	return stringValues, nil
+}
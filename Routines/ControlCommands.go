@@ -0,0 +1,359 @@
+package Routines
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog"
+)
+
+/*
+Control commands travel from UI clients back down to the TCP producer that
+owns a source identifier. They are framed the same way producers frame chunks
+
+	|Transport Header(2)| [Session Header(23)|Session Data(x)] |
+
+where the transport header is the little endian size of the whole frame, the
+session header is state(1), session(4), sequence(4), chunk type(4), source
+identifier(6) and data size(4), and the first frame of a session carries a
+4 byte prefix holding the size of the whole command
+*/
+
+const (
+	controlFrameMaximumSize            = 512
+	controlTransportHeaderSize         = 2
+	controlSessionHeaderSize           = 23
+	controlCommandPrefixSize           = 4
+	controlSourceIdentifierSize        = 6
+	controlCommandMaximumSize          = 64 * 1024
+	controlCommandResultTimeout        = 5 * time.Second
+	ControlCommandChunkType     uint32 = 0 // Chunk type producers see on control frames
+)
+
+/*
+ControlCommand is a JSON command for the producer with the given source
+identifier. The outcome of sending it is reported on ResultChannel
+*/
+type ControlCommand struct {
+	SourceIdentifier string     // Hex encoded 6 byte source identifier of the producer
+	Command          string     // JSON command as sent by the client
+	ResultChannel    chan error // Receives nil once written to the producer or why it was not
+}
+
+func NewControlCommand(sourceIdentifier string, command string) ControlCommand {
+	return ControlCommand{
+		SourceIdentifier: sourceIdentifier,
+		Command:          command,
+		ResultChannel:    make(chan error, 1),
+	}
+}
+
+/*
+ControlResultMessage is sent back to WebSocket control clients for every
+command they send
+*/
+type ControlResultMessage struct {
+	Result ControlResult `json:"ControlResult"`
+}
+
+type ControlResult struct {
+	SourceIdentifier string `json:"SourceIdentifier"`
+	Status           string `json:"Status"`
+	Error            string `json:"Error,omitempty"`
+}
+
+func CreateControlResultMessage(sourceIdentifier string, err error) []byte {
+	result := ControlResult{SourceIdentifier: sourceIdentifier, Status: "Sent"}
+	if err != nil {
+		result.Status = "Failed"
+		result.Error = err.Error()
+	}
+
+	data, _ := json.Marshal(ControlResultMessage{Result: result})
+	return data
+}
+
+/*
+ParseSourceIdentifier checks a source identifier from a URL and returns it
+in the lower case hex form used as the registry key
+*/
+func ParseSourceIdentifier(sourceIdentifier string) (string, error) {
+	sourceIdentifierBytes, err := hex.DecodeString(sourceIdentifier)
+	if err != nil || len(sourceIdentifierBytes) != controlSourceIdentifierSize {
+		return "", errors.New("source identifier should be 12 hex characters")
+	}
+	return strings.ToLower(sourceIdentifier), nil
+}
+
+/*
+GetSourceIdentifier reads the source identifier out of a session header
+*/
+func GetSourceIdentifier(sessionHeaderBytes []byte) string {
+	return hex.EncodeToString(sessionHeaderBytes[13 : 13+controlSourceIdentifierSize])
+}
+
+/*
+FrameControlCommand splits a command into transport frames for one session
+*/
+func FrameControlCommand(command []byte, sessionNumber uint32, sourceIdentifier string) ([][]byte, error) {
+
+	sourceIdentifierBytes, err := hex.DecodeString(sourceIdentifier)
+	if err != nil || len(sourceIdentifierBytes) != controlSourceIdentifierSize {
+		return nil, errors.New("source identifier should be 12 hex characters")
+	}
+
+	// The first frame starts with the size of the whole command
+	sessionData := make([]byte, controlCommandPrefixSize, controlCommandPrefixSize+len(command))
+	binary.LittleEndian.PutUint32(sessionData, uint32(len(command)))
+	sessionData = append(sessionData, command...)
+
+	maximumDataSize := controlFrameMaximumSize - controlTransportHeaderSize - controlSessionHeaderSize
+
+	var frames [][]byte
+	for sequenceNumber := uint32(0); len(sessionData) > 0; sequenceNumber++ {
+
+		dataSize := len(sessionData)
+		if dataSize > maximumDataSize {
+			dataSize = maximumDataSize
+		}
+		frameSize := controlTransportHeaderSize + controlSessionHeaderSize + dataSize
+
+		transmissionState := byte(0)
+		if dataSize == len(sessionData) {
+			transmissionState = 1
+		}
+
+		frame := make([]byte, frameSize)
+		binary.LittleEndian.PutUint16(frame[0:], uint16(frameSize))
+		frame[2] = transmissionState
+		binary.LittleEndian.PutUint32(frame[3:], sessionNumber)
+		binary.LittleEndian.PutUint32(frame[7:], sequenceNumber)
+		binary.LittleEndian.PutUint32(frame[11:], ControlCommandChunkType)
+		copy(frame[15:21], sourceIdentifierBytes)
+		binary.LittleEndian.PutUint32(frame[21:], uint32(dataSize))
+		copy(frame[25:], sessionData[:dataSize])
+
+		frames = append(frames, frame)
+		sessionData = sessionData[dataSize:]
+	}
+
+	return frames, nil
+}
+
+/*
+ControlConnectionRegistry remembers which TCP connection each producer's
+source identifier was last seen on
+*/
+type ControlConnectionRegistry struct {
+	connectionMap map[string]net.Conn // Map of source identifier and producer connection
+	mu            sync.RWMutex        // Mutex to protect access to the map
+}
+
+func NewControlConnectionRegistry() *ControlConnectionRegistry {
+	p := new(ControlConnectionRegistry)
+	p.connectionMap = make(map[string]net.Conn)
+	return p
+}
+
+/*
+RegisterConnection records the connection of a source identifier
+
+returns whether this is a new connection for the source identifier
+*/
+func (r *ControlConnectionRegistry) RegisterConnection(sourceIdentifier string, conn net.Conn) bool {
+	r.mu.RLock()
+	registeredConnection := r.connectionMap[sourceIdentifier]
+	r.mu.RUnlock()
+
+	if registeredConnection == conn {
+		return false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.connectionMap[sourceIdentifier] = conn
+	return true
+}
+
+/*
+RemoveConnection forgets every source identifier seen on a connection
+*/
+func (r *ControlConnectionRegistry) RemoveConnection(conn net.Conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for sourceIdentifier, registeredConnection := range r.connectionMap {
+		if registeredConnection == conn {
+			delete(r.connectionMap, sourceIdentifier)
+		}
+	}
+}
+
+func (r *ControlConnectionRegistry) TryGetConnection(sourceIdentifier string) (conn net.Conn, exists bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	conn, exists = r.connectionMap[sourceIdentifier]
+	return conn, exists
+}
+
+/*
+RunControlCommandWriter frames each control command and writes it down the
+connection of its producer. Each command is sent as its own session
+*/
+func RunControlCommandWriter(loggingChannel chan map[zerolog.Level]string, controlCommandChannel <-chan ControlCommand, controlConnections *ControlConnectionRegistry) {
+
+	sessionNumber := uint32(0)
+
+	for command := range controlCommandChannel {
+
+		conn, exists := controlConnections.TryGetConnection(command.SourceIdentifier)
+		if !exists {
+			command.ResultChannel <- errors.New("no producer connected for source " + command.SourceIdentifier)
+			continue
+		}
+
+		sessionNumber++
+		frames, err := FrameControlCommand([]byte(command.Command), sessionNumber, command.SourceIdentifier)
+		if err != nil {
+			command.ResultChannel <- err
+			continue
+		}
+
+		// A producer that stops reading must not hold up everyone else's commands
+		conn.SetWriteDeadline(time.Now().Add(controlCommandResultTimeout))
+		for _, frame := range frames {
+			if _, err = conn.Write(frame); err != nil {
+				break
+			}
+		}
+
+		if err != nil {
+			loggingChannel <- CreateLogMessage(zerolog.ErrorLevel, "Error writing control command to source "+command.SourceIdentifier+":"+err.Error())
+			controlConnections.RemoveConnection(conn)
+			command.ResultChannel <- errors.New("could not write to producer for source " + command.SourceIdentifier)
+			continue
+		}
+
+		loggingChannel <- CreateLogMessage(zerolog.DebugLevel, "Control command sent to source "+command.SourceIdentifier)
+		command.ResultChannel <- nil
+	}
+}
+
+/*
+SendControlCommand queues a command for the TCP routine and waits for the
+outcome
+*/
+func SendControlCommand(controlCommandChannel chan<- ControlCommand, sourceIdentifier string, command string) error {
+
+	if !json.Valid([]byte(command)) {
+		return errors.New("control commands should be JSON")
+	}
+
+	controlCommand := NewControlCommand(sourceIdentifier, command)
+	select {
+	case controlCommandChannel <- controlCommand:
+	case <-time.After(controlCommandResultTimeout):
+		return errors.New("control command queue full")
+	}
+
+	select {
+	case err := <-controlCommand.ResultChannel:
+		return err
+	case <-time.After(controlCommandResultTimeout):
+		return errors.New("timed out waiting for producer")
+	}
+}
+
+/*
+RegisterControlRoutes adds the /Control/:source endpoints. Clients either
+POST a single JSON command or open a WebSocket and send one command per
+message, getting a ControlResult back for each
+*/
+func RegisterControlRoutes(loggingChannel chan map[zerolog.Level]string, router *gin.Engine, controlCommandChannel chan<- ControlCommand, serverConfig WebSocketServerConfig) {
+
+	upgrader := NewWebSocketUpgrader(serverConfig)
+	requireAuthorization := serverConfig.Authenticator.RequireParamAuthorization(AuthorizationScopeControlSources, "source")
+
+	router.POST("/Control/:source", requireAuthorization, func(c *gin.Context) {
+
+		sourceIdentifier, err := ParseSourceIdentifier(c.Param("source"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"Error": err.Error()})
+			return
+		}
+
+		command, err := io.ReadAll(io.LimitReader(c.Request.Body, controlCommandMaximumSize))
+		if err != nil || !json.Valid(command) {
+			c.JSON(http.StatusBadRequest, gin.H{"Error": "control commands should be JSON"})
+			return
+		}
+
+		if err := SendControlCommand(controlCommandChannel, sourceIdentifier, string(command)); err != nil {
+			loggingChannel <- CreateLogMessage(zerolog.WarnLevel, "Control command for source "+sourceIdentifier+" not sent:"+err.Error())
+			c.Data(http.StatusBadGateway, "application/json", CreateControlResultMessage(sourceIdentifier, err))
+			return
+		}
+
+		c.Data(http.StatusOK, "application/json", CreateControlResultMessage(sourceIdentifier, nil))
+	})
+
+	router.GET("/Control/:source", requireAuthorization, func(c *gin.Context) {
+
+		sourceIdentifier, err := ParseSourceIdentifier(c.Param("source"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"Error": err.Error()})
+			return
+		}
+
+		loggingChannel <- CreateLogMessage(zerolog.InfoLevel, "Client calling for upgrade on /Control/"+sourceIdentifier)
+		WebSocketConnection, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			loggingChannel <- CreateLogMessage(zerolog.ErrorLevel, "Error upgrading to WebSocket:"+err.Error())
+			return
+		}
+		defer WebSocketConnection.Close()
+		WebSocketConnection.SetReadLimit(controlCommandMaximumSize)
+
+		// Clients that stop answering pings are treated as gone
+		StartHeartbeat(WebSocketConnection, serverConfig)
+		WebsocketClosed := make(chan struct{})
+		defer close(WebsocketClosed)
+		go RunPinger(loggingChannel, WebSocketConnection, serverConfig, WebsocketClosed)
+
+		for {
+			_, command, err := WebSocketConnection.ReadMessage()
+			if err != nil {
+				// A read timeout means the client stopped answering pings
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					loggingChannel <- CreateLogMessage(zerolog.WarnLevel, "Control client for source "+sourceIdentifier+" stopped responding to pings, closing")
+					WebSocketConnection.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "Ping timeout"), time.Now().Add(serverConfig.WriteTimeout))
+					return
+				}
+				loggingChannel <- CreateLogMessage(zerolog.InfoLevel, "Control client for source "+sourceIdentifier+" closed:"+err.Error())
+				return
+			}
+
+			err = SendControlCommand(controlCommandChannel, sourceIdentifier, string(command))
+			if err != nil {
+				loggingChannel <- CreateLogMessage(zerolog.WarnLevel, "Control command for source "+sourceIdentifier+" not sent:"+err.Error())
+			}
+
+			WebSocketConnection.SetWriteDeadline(time.Now().Add(serverConfig.WriteTimeout))
+			if err := WebSocketConnection.WriteMessage(websocket.TextMessage, CreateControlResultMessage(sourceIdentifier, err)); err != nil {
+				loggingChannel <- CreateLogMessage(zerolog.WarnLevel, "Issue writing message to WebSocket:"+err.Error())
+				return
+			}
+		}
+	})
+}
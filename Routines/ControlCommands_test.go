@@ -0,0 +1,187 @@
+package Routines
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+/*
+newTestControlServer serves the control routes with a fast heartbeat and a
+producer that accepts every command
+*/
+func newTestControlServer(t *testing.T) string {
+	loggingChannel := newTestLoggingChannel(t)
+	serverConfig := newTestServerConfig(t, nil)
+	serverConfig.PingInterval = 20 * time.Millisecond
+	serverConfig.PongTimeout = 100 * time.Millisecond
+
+	controlCommandChannel := make(chan ControlCommand)
+	go func() {
+		for command := range controlCommandChannel {
+			command.ResultChannel <- nil
+		}
+	}()
+
+	router := gin.New()
+	RegisterControlRoutes(loggingChannel, router, controlCommandChannel, serverConfig)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	return "ws" + strings.TrimPrefix(server.URL, "http") + "/Control/0a0b0c0d0e0f"
+}
+
+func TestControlWebSocketKeepsClientsAnsweringPings(t *testing.T) {
+	WebSocketConnection, _, err := websocket.DefaultDialer.Dial(newTestControlServer(t), nil)
+	if err != nil {
+		t.Fatalf("dialing control WebSocket: %v", err)
+	}
+	defer WebSocketConnection.Close()
+
+	// Pongs are only sent while reading, so read in the background
+	pingCount := 0
+	WebSocketConnection.SetPingHandler(func(appData string) error {
+		pingCount++
+		return WebSocketConnection.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(time.Second))
+	})
+	results := make(chan string)
+	go func() {
+		for {
+			_, message, err := WebSocketConnection.ReadMessage()
+			if err != nil {
+				close(results)
+				return
+			}
+			results <- string(message)
+		}
+	}()
+
+	time.Sleep(300 * time.Millisecond)
+	if err := WebSocketConnection.WriteMessage(websocket.TextMessage, []byte(`{"Gain":2}`)); err != nil {
+		t.Fatalf("sending command: %v", err)
+	}
+	result, open := <-results
+	if !open || !strings.Contains(result, `"Status":"Sent"`) {
+		t.Fatalf("got result %q, want the command sent", result)
+	}
+	if pingCount == 0 {
+		t.Error("client was never pinged")
+	}
+}
+
+func TestControlWebSocketClosesClientsNotAnsweringPings(t *testing.T) {
+	WebSocketConnection, _, err := websocket.DefaultDialer.Dial(newTestControlServer(t), nil)
+	if err != nil {
+		t.Fatalf("dialing control WebSocket: %v", err)
+	}
+	defer WebSocketConnection.Close()
+
+	WebSocketConnection.SetPingHandler(func(string) error { return nil })
+	WebSocketConnection.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	_, _, err = WebSocketConnection.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("got %v, want the server to close the connection for not answering pings", err)
+	}
+}
+
+func TestFrameControlCommand(t *testing.T) {
+	maximumDataSize := controlFrameMaximumSize - controlTransportHeaderSize - controlSessionHeaderSize
+
+	testCases := []struct {
+		name           string
+		commandSize    int
+		wantFrameSizes []int
+	}{
+		{"empty command", 0, []int{29}},
+		{"small command", 10, []int{39}},
+		{"fills one frame", maximumDataSize - controlCommandPrefixSize, []int{512}},
+		{"one byte over one frame", maximumDataSize - controlCommandPrefixSize + 1, []int{512, 26}},
+		{"fills two frames", 2*maximumDataSize - controlCommandPrefixSize, []int{512, 512}},
+		{"many frames", 2000, []int{512, 512, 512, 512, 81}},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			command := bytes.Repeat([]byte("x"), testCase.commandSize)
+			frames, err := FrameControlCommand(command, 7, "0a0b0c0d0e0f")
+			if err != nil {
+				t.Fatalf("framing command: %v", err)
+			}
+			if len(frames) != len(testCase.wantFrameSizes) {
+				t.Fatalf("got %d frames, want %d", len(frames), len(testCase.wantFrameSizes))
+			}
+
+			var sessionData []byte
+			for frameIndex, frame := range frames {
+				if len(frame) != testCase.wantFrameSizes[frameIndex] {
+					t.Errorf("frame %d is %d bytes, want %d", frameIndex, len(frame), testCase.wantFrameSizes[frameIndex])
+				}
+				if transportSize := binary.LittleEndian.Uint16(frame[0:]); int(transportSize) != len(frame) {
+					t.Errorf("frame %d transport header says %d bytes, frame is %d", frameIndex, transportSize, len(frame))
+				}
+
+				// Read back the way the TCP routine reads producer frames
+				sessionHeaderBytes := frame[controlTransportHeaderSize : controlTransportHeaderSize+controlSessionHeaderSize]
+				transmissionState, sessionNumber, sequenceNumber := ConvertBytesToSessionStates(sessionHeaderBytes)
+				wantTransmissionState := byte(0)
+				if frameIndex == len(frames)-1 {
+					wantTransmissionState = 1
+				}
+				if transmissionState != wantTransmissionState || sessionNumber != 7 || sequenceNumber != uint32(frameIndex) {
+					t.Errorf("frame %d has state %d, session %d and sequence %d, want %d, 7 and %d", frameIndex, transmissionState, sessionNumber, sequenceNumber, wantTransmissionState, frameIndex)
+				}
+				if chunkType := binary.LittleEndian.Uint32(frame[11:]); chunkType != ControlCommandChunkType {
+					t.Errorf("frame %d has chunk type %d, want %d", frameIndex, chunkType, ControlCommandChunkType)
+				}
+				if sourceIdentifier := GetSourceIdentifier(sessionHeaderBytes); sourceIdentifier != "0a0b0c0d0e0f" {
+					t.Errorf("frame %d has source identifier %s", frameIndex, sourceIdentifier)
+				}
+				if dataSize := binary.LittleEndian.Uint32(frame[21:]); int(dataSize) != len(frame)-controlTransportHeaderSize-controlSessionHeaderSize {
+					t.Errorf("frame %d says it holds %d data bytes, it holds %d", frameIndex, dataSize, len(frame)-controlTransportHeaderSize-controlSessionHeaderSize)
+				}
+
+				sessionData = append(sessionData, frame[controlTransportHeaderSize+controlSessionHeaderSize:]...)
+			}
+
+			if commandSize := binary.LittleEndian.Uint32(sessionData); int(commandSize) != testCase.commandSize {
+				t.Errorf("size prefix is %d, want %d", commandSize, testCase.commandSize)
+			}
+			if !bytes.Equal(sessionData[controlCommandPrefixSize:], command) {
+				t.Error("reassembled command differs from the command sent")
+			}
+		})
+	}
+}
+
+func TestFrameControlCommandSourceIdentifiers(t *testing.T) {
+	testCases := []struct {
+		sourceIdentifier string
+		wantErr          bool
+	}{
+		{"0a0b0c0d0e0f", false},
+		{"0A0B0C0D0E0F", false},
+		{"", true},
+		{"0a0b0c0d0e", true},
+		{"0a0b0c0d0e0f10", true},
+		{"0a0b0c0d0e0", true},
+		{"0a0b0c0d0e0g", true},
+		{"0a:0b:0c:0d:0e:0f", true},
+	}
+
+	for _, testCase := range testCases {
+		frames, err := FrameControlCommand([]byte(`{}`), 1, testCase.sourceIdentifier)
+		if (err != nil) != testCase.wantErr {
+			t.Errorf("source identifier %q: got error %v, want error %v", testCase.sourceIdentifier, err, testCase.wantErr)
+		}
+		if err != nil && frames != nil {
+			t.Errorf("source identifier %q: got frames alongside an error", testCase.sourceIdentifier)
+		}
+	}
+}
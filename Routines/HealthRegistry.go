@@ -0,0 +1,198 @@
+package Routines
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+)
+
+/*
+Each long running routine beats a heartbeat into a shared registry and marks
+itself ready once it can do its job, such as when its listener is bound.
+Both HTTP servers answer
+
+  - GET /healthz 200 while every routine has beaten within its timeout
+  - GET /readyz 200 while every routine is also ready
+
+and 503 otherwise, each with the state of every routine
+
+	{ "Status": "Ready", "Routines": { "TCPRx": { "Alive": true, "Ready": true, "LastHeartbeat": 1700000000000, "Detail": "Listening on port 10100" } } }
+
+so orchestrators can probe them without a token
+*/
+
+// Routines of the adapter that report their health
+const (
+	HealthRoutineLogging         = "Logging"
+	HealthRoutineTCPRx           = "TCPRx"
+	HealthRoutineDataRouter      = "DataRouter"
+	HealthRoutineDataServer      = "DataServer"
+	HealthRoutineReportingRouter = "ReportingRouter"
+	HealthRoutineReportingServer = "ReportingServer"
+)
+
+const (
+	healthHeartbeatInterval = 1000 * time.Millisecond
+	healthHeartbeatTimeout  = 5 * time.Second // Routines silent for this long are considered dead
+)
+
+type RoutineHealth struct {
+	Alive         bool   `json:"Alive"`
+	Ready         bool   `json:"Ready"`
+	LastHeartbeat int64  `json:"LastHeartbeat,omitempty"` // Unix time in milliseconds, left out for routines without heartbeats
+	Detail        string `json:"Detail,omitempty"`
+}
+
+type HealthStatus struct {
+	Status   string                   `json:"Status"`
+	Routines map[string]RoutineHealth `json:"Routines"`
+}
+
+type routineHealthState struct {
+	heartbeatTimeout time.Duration // 0 for routines only checked for readiness
+	lastHeartbeat    time.Time     // Registration time until the first heartbeat
+	ready            bool
+	detail           string
+}
+
+/*
+HealthRegistry holds the heartbeats and readiness of every routine
+*/
+type HealthRegistry struct {
+	routineMap map[string]*routineHealthState // Map of routine name and its health
+	mu         sync.Mutex                     // Mutex to protect access to the map
+}
+
+func NewHealthRegistry() *HealthRegistry {
+	p := new(HealthRegistry)
+	p.routineMap = make(map[string]*routineHealthState)
+	return p
+}
+
+/*
+NewAdapterHealthRegistry registers every routine of the adapter up front so
+a routine that never starts shows up as unhealthy rather than missing. HTTP
+servers are served by the routines that also route for them so only their
+readiness is tracked
+*/
+func NewAdapterHealthRegistry() *HealthRegistry {
+	p := NewHealthRegistry()
+	p.Register(HealthRoutineLogging, healthHeartbeatTimeout)
+	p.Register(HealthRoutineTCPRx, healthHeartbeatTimeout)
+	p.Register(HealthRoutineDataRouter, healthHeartbeatTimeout)
+	p.Register(HealthRoutineDataServer, 0)
+	p.Register(HealthRoutineReportingRouter, healthHeartbeatTimeout)
+	p.Register(HealthRoutineReportingServer, 0)
+	return p
+}
+
+/*
+Register adds a routine that has to beat at least once per heartbeat
+timeout, or 0 if it is only checked for readiness
+*/
+func (h *HealthRegistry) Register(routineName string, heartbeatTimeout time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.routineMap[routineName] = &routineHealthState{heartbeatTimeout: heartbeatTimeout, lastHeartbeat: time.Now()}
+}
+
+func (h *HealthRegistry) Heartbeat(routineName string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if routineHealth, exists := h.routineMap[routineName]; exists {
+		routineHealth.lastHeartbeat = time.Now()
+	}
+}
+
+/*
+SetReady marks whether a routine can do its job, with detail on why shown
+to whoever probes
+*/
+func (h *HealthRegistry) SetReady(routineName string, ready bool, detail string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if routineHealth, exists := h.routineMap[routineName]; exists {
+		routineHealth.ready = ready
+		routineHealth.detail = detail
+	}
+}
+
+/*
+GetHealth returns the state of every routine and whether all are alive and
+all are ready
+*/
+func (h *HealthRegistry) GetHealth() (routines map[string]RoutineHealth, alive bool, ready bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	alive = true
+	ready = true
+	routines = make(map[string]RoutineHealth, len(h.routineMap))
+	for routineName, routineHealth := range h.routineMap {
+		health := RoutineHealth{Alive: true, Ready: routineHealth.ready, Detail: routineHealth.detail}
+		if routineHealth.heartbeatTimeout > 0 {
+			health.Alive = time.Since(routineHealth.lastHeartbeat) <= routineHealth.heartbeatTimeout
+			health.LastHeartbeat = routineHealth.lastHeartbeat.UnixMilli()
+		}
+		// A routine that has stopped cannot do its job
+		health.Ready = health.Ready && health.Alive
+
+		alive = alive && health.Alive
+		ready = ready && health.Ready
+		routines[routineName] = health
+	}
+	return routines, alive, ready
+}
+
+/*
+RunHTTPServer serves a router on a port, marking the server ready once the
+port is bound and not ready if it stops serving
+*/
+func RunHTTPServer(loggingChannel chan map[zerolog.Level]string, router *gin.Engine, port string, healthRegistry *HealthRegistry, routineName string) {
+
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		healthRegistry.SetReady(routineName, false, "Error listening on port "+port+":"+err.Error())
+		loggingChannel <- CreateLogMessage(zerolog.ErrorLevel, routineName+" error listening on port "+port+":"+err.Error())
+		return
+	}
+
+	healthRegistry.SetReady(routineName, true, "Listening on port "+port)
+	err = router.RunListener(listener)
+	healthRegistry.SetReady(routineName, false, "Stopped serving on port "+port)
+	if err != nil {
+		loggingChannel <- CreateLogMessage(zerolog.ErrorLevel, routineName+" stopped serving:"+err.Error())
+	}
+}
+
+/*
+RegisterHealthRoutes adds /healthz and /readyz to a server. They are left
+unauthenticated so orchestrators can probe them
+*/
+func RegisterHealthRoutes(router *gin.Engine, healthRegistry *HealthRegistry) {
+
+	router.GET("/healthz", func(c *gin.Context) {
+		routines, alive, _ := healthRegistry.GetHealth()
+		if !alive {
+			c.JSON(http.StatusServiceUnavailable, HealthStatus{Status: "Unhealthy", Routines: routines})
+			return
+		}
+		c.JSON(http.StatusOK, HealthStatus{Status: "Healthy", Routines: routines})
+	})
+
+	router.GET("/readyz", func(c *gin.Context) {
+		routines, _, ready := healthRegistry.GetHealth()
+		if !ready {
+			c.JSON(http.StatusServiceUnavailable, HealthStatus{Status: "NotReady", Routines: routines})
+			return
+		}
+		c.JSON(http.StatusOK, HealthStatus{Status: "Ready", Routines: routines})
+	})
+}
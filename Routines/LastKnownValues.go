@@ -0,0 +1,124 @@
+package Routines
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+Some statistics are reported rarely, so a reporting client that only saw
+live data could wait a long time for them. When last known values are
+enabled the router keeps the newest chunk of every statistic and sends the
+whole set to each new subscriber, in place of history, before live data.
+The chunks keep their sequence numbers so none are sent twice. The reporting
+routine names what each chunk is the latest value of, see
+ReportingMessage.GetStatisticKey
+*/
+
+/*
+EnableLastKnownValues makes the router keep the newest chunk for each key
+and replay them to new subscribers. It has to be called before routing starts
+*/
+func (s *ChunkTypeToChannelMap) EnableLastKnownValues() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastKnownValueMap = make(map[string]map[string]*RoutedChunk)
+}
+
+/*
+UpdateLastKnownValue keeps a chunk as the latest value of a key if last
+known values are enabled and the key is not empty. Chunks have to be stored
+before they are queued so a subscriber never misses one between its replay
+and live data
+*/
+func (s *ChunkTypeToChannelMap) UpdateLastKnownValue(chunkTypeString string, key string, chunk *RoutedChunk) {
+	if s.lastKnownValueMap == nil || key == "" {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.lastKnownValueMap[chunkTypeString] == nil {
+		s.lastKnownValueMap[chunkTypeString] = make(map[string]*RoutedChunk)
+	}
+	s.lastKnownValueMap[chunkTypeString][key] = chunk
+}
+
+/*
+GetLastKnownValues returns the newest chunk of every key of a chunk type in
+the order they were received, leaving out those not updated within the
+reporting status expiry
+
+returns false if last known values are not enabled
+*/
+func (s *ChunkTypeToChannelMap) GetLastKnownValues(chunkTypeString string) ([]*RoutedChunk, bool) {
+	if s.lastKnownValueMap == nil {
+		return nil, false
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	oldestReceivedTime := time.Now().Add(-reportingStatusExpiry)
+	lastKnownValues := s.lastKnownValueMap[chunkTypeString]
+	chunks := make([]*RoutedChunk, 0, len(lastKnownValues))
+	for _, chunk := range lastKnownValues {
+		if chunk.ReceivedTime.Before(oldestReceivedTime) {
+			continue
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].SequenceNumber < chunks[j].SequenceNumber
+	})
+	return chunks, true
+}
+
+/*
+PruneLastKnownValues forgets the chunks of every chunk type not updated
+within the reporting status expiry, so keys that stop being reported do not
+build up while no client connects
+*/
+func (s *ChunkTypeToChannelMap) PruneLastKnownValues() {
+	if s.lastKnownValueMap == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	oldestReceivedTime := time.Now().Add(-reportingStatusExpiry)
+	for chunkTypeString, lastKnownValues := range s.lastKnownValueMap {
+		for key, chunk := range lastKnownValues {
+			if chunk.ReceivedTime.Before(oldestReceivedTime) {
+				delete(lastKnownValues, key)
+			}
+		}
+		if len(lastKnownValues) == 0 {
+			delete(s.lastKnownValueMap, chunkTypeString)
+		}
+	}
+}
+
+/*
+RemoveLastKnownValues forgets the chunks of a chunk type whose keys start
+with a prefix
+*/
+func (s *ChunkTypeToChannelMap) RemoveLastKnownValues(chunkTypeString string, keyPrefix string) {
+	if s.lastKnownValueMap == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key := range s.lastKnownValueMap[chunkTypeString] {
+		if strings.HasPrefix(key, keyPrefix) {
+			delete(s.lastKnownValueMap[chunkTypeString], key)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package Routines
+
+import (
+	"testing"
+	"time"
+)
+
+/*
+routeTestMessage routes a reporting message the way the reporting routine
+does, to its type and to the environment that reported it
+*/
+func routeTestMessage(t testing.TB, JSONString string, chunkTypeRoutingMap *ChunkTypeToChannelMap, environmentRoutingMap *ChunkTypeToChannelMap) {
+	message, err := ParseReportingMessage(JSONString)
+	if err != nil {
+		t.Fatalf("could not parse %s: %v", JSONString, err)
+	}
+	RouteReportingMessage(newTestLoggingChannel(t), message, chunkTypeRoutingMap, environmentRoutingMap)
+}
+
+func TestPruneLastKnownValues(t *testing.T) {
+	loggingChannel := newTestLoggingChannel(t)
+	serverConfig := newTestServerConfig(t, nil)
+	chunkTypeRoutingMap := NewChunkTypeToChannelMap(loggingChannel, make(chan string, 100), serverConfig)
+	chunkTypeRoutingMap.EnableLastKnownValues()
+	environmentRoutingMap := NewReportingEnvironmentMap(loggingChannel, make(chan string, 100), serverConfig)
+
+	routeTestMessage(t, `{"SystemInfo":{"StatEnvironment":"Node1","StatName":"Expired","StatStaus":"1"}}`, chunkTypeRoutingMap, environmentRoutingMap)
+	routeTestMessage(t, `{"SystemInfo":{"StatEnvironment":"Node1","StatName":"Current","StatStaus":"1"}}`, chunkTypeRoutingMap, environmentRoutingMap)
+	routeTestMessage(t, `{"SystemMetric":{"StatEnvironment":"Node1","StatName":"Expired","Value":1}}`, chunkTypeRoutingMap, environmentRoutingMap)
+
+	// Age the expired statistic as if nothing had reported it for longer than the expiry
+	expiredReceivedTime := time.Now().Add(-reportingStatusExpiry - time.Minute)
+	chunkTypeRoutingMap.lastKnownValueMap["SystemInfo"]["Node1/Expired"].ReceivedTime = expiredReceivedTime
+	chunkTypeRoutingMap.lastKnownValueMap["SystemMetric"]["Node1/Expired"].ReceivedTime = expiredReceivedTime
+
+	if chunks, _ := chunkTypeRoutingMap.GetLastKnownValues("SystemInfo"); len(chunks) != 1 {
+		t.Errorf("got %d last known values, want only the current one", len(chunks))
+	}
+
+	chunkTypeRoutingMap.PruneLastKnownValues()
+	if _, exists := chunkTypeRoutingMap.lastKnownValueMap["SystemInfo"]["Node1/Expired"]; exists {
+		t.Error("expired value was kept")
+	}
+	if _, exists := chunkTypeRoutingMap.lastKnownValueMap["SystemInfo"]["Node1/Current"]; !exists {
+		t.Error("current value was pruned")
+	}
+	if _, exists := chunkTypeRoutingMap.lastKnownValueMap["SystemMetric"]; exists {
+		t.Error("chunk type without values was kept")
+	}
+}
@@ -3,6 +3,7 @@ package Routines
 import (
 	"os"
 	"strings"
+	"time"
 
 	"github.com/rs/zerolog"
 )
@@ -17,7 +18,7 @@ type SystemInfo struct {
 	SystemStat SystemStatistic `json:"SystemInfo"`
 }
 
-func HandleLogging(configJson map[string]interface{}, routineCompleteChannel chan bool, incomingDataChannel chan map[zerolog.Level]string) {
+func HandleLogging(configJson map[string]interface{}, routineCompleteChannel chan bool, incomingDataChannel chan map[zerolog.Level]string, healthRegistry *HealthRegistry) {
 
 	// And finally create a logger
 	var LogLevel = zerolog.DebugLevel
@@ -87,9 +88,20 @@ func HandleLogging(configJson map[string]interface{}, routineCompleteChannel cha
 	}
 
 	logger.Info().Msg("Starting logging routine")
+	healthRegistry.SetReady(HealthRoutineLogging, true, "Consuming log messages")
+
+	// Beat between messages so a quiet log does not look like a stuck one
+	heartbeatTicker := time.NewTicker(healthHeartbeatInterval)
+	defer heartbeatTicker.Stop()
 
 	for {
-		levelMessageMap := <-incomingDataChannel
+		var levelMessageMap map[zerolog.Level]string
+		select {
+		case levelMessageMap = <-incomingDataChannel:
+		case <-heartbeatTicker.C:
+			healthRegistry.Heartbeat(HealthRoutineLogging)
+			continue
+		}
 
 		for logLevelKey, LogMessageString := range levelMessageMap {
 			if logLevelKey == zerolog.DebugLevel {
@@ -105,8 +117,6 @@ func HandleLogging(configJson map[string]interface{}, routineCompleteChannel cha
 			}
 		}
 	}
-
-	routineCompleteChannel <- true
 }
 
 func CreateLogMessage(logLevel zerolog.Level, messageString string) map[zerolog.Level]string {
@@ -0,0 +1,136 @@
+package Routines
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+OriginPolicy decides which browser origins may open WebSockets and call the
+REST endpoints of a server. Allowed origins can be
+
+	*                       any origin
+	https://ui.example.com  an exact origin
+	https://*.example.com   any subdomain of example.com over https
+	*.example.com           any subdomain of example.com over any scheme
+*/
+type OriginPolicy struct {
+	AllowedOrigins []string // Origin patterns as written in the config
+}
+
+func NewOriginPolicy(allowedOrigins []string) OriginPolicy {
+	return OriginPolicy{AllowedOrigins: allowedOrigins}
+}
+
+func (p OriginPolicy) AllowsAllOrigins() bool {
+	for _, allowedOrigin := range p.AllowedOrigins {
+		if allowedOrigin == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func (p OriginPolicy) IsOriginAllowed(origin string) bool {
+
+	originURL, err := url.Parse(origin)
+	if err != nil || originURL.Host == "" {
+		return false
+	}
+
+	for _, allowedOrigin := range p.AllowedOrigins {
+		if allowedOrigin == "*" || strings.EqualFold(allowedOrigin, origin) {
+			return true
+		}
+		if matchesWildcardOrigin(allowedOrigin, originURL) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+matchesWildcardOrigin checks an origin against a *.domain pattern. The
+pattern only matches subdomains, not the bare domain, and a port in the
+pattern has to match exactly
+*/
+func matchesWildcardOrigin(allowedOrigin string, originURL *url.URL) bool {
+
+	allowedScheme := ""
+	allowedHost := allowedOrigin
+	if schemeSeparatorIndex := strings.Index(allowedOrigin, "://"); schemeSeparatorIndex >= 0 {
+		allowedScheme = allowedOrigin[:schemeSeparatorIndex]
+		allowedHost = allowedOrigin[schemeSeparatorIndex+3:]
+	}
+
+	if !strings.HasPrefix(allowedHost, "*.") {
+		return false
+	}
+	if allowedScheme != "" && !strings.EqualFold(allowedScheme, originURL.Scheme) {
+		return false
+	}
+
+	// Split off any port so it can be compared on its own
+	allowedPort := ""
+	allowedDomain := allowedHost[1:]
+	if portSeparatorIndex := strings.LastIndex(allowedDomain, ":"); portSeparatorIndex >= 0 {
+		allowedPort = allowedDomain[portSeparatorIndex+1:]
+		allowedDomain = allowedDomain[:portSeparatorIndex]
+	}
+
+	if allowedPort != originURL.Port() {
+		return false
+	}
+	return strings.HasSuffix(strings.ToLower(originURL.Hostname()), strings.ToLower(allowedDomain))
+}
+
+/*
+CheckOrigin is used by the WebSocket upgrader. Requests without an Origin
+header do not come from a browser and are let through
+*/
+func (p OriginPolicy) CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	return p.IsOriginAllowed(origin)
+}
+
+/*
+CORSMiddleware adds CORS headers for allowed origins and answers preflight
+requests. Disallowed origins get no CORS headers so the browser blocks them
+*/
+func (p OriginPolicy) CORSMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		origin := c.Request.Header.Get("Origin")
+		if origin == "" {
+			c.Next()
+			return
+		}
+
+		c.Writer.Header().Add("Vary", "Origin")
+		originAllowed := p.IsOriginAllowed(origin)
+
+		if originAllowed {
+			c.Header("Access-Control-Allow-Origin", origin)
+			c.Header("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			c.Header("Access-Control-Allow-Headers", "Authorization, Content-Type, Last-Event-ID")
+			c.Header("Access-Control-Max-Age", "600")
+		}
+
+		if c.Request.Method == http.MethodOptions {
+			if originAllowed {
+				c.AbortWithStatus(http.StatusNoContent)
+			} else {
+				c.AbortWithStatus(http.StatusForbidden)
+			}
+			return
+		}
+
+		c.Next()
+	}
+}
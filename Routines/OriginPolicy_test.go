@@ -0,0 +1,102 @@
+package Routines
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestOriginPolicyIsOriginAllowed(t *testing.T) {
+	testCases := []struct {
+		name           string
+		allowedOrigins []string
+		origin         string
+		want           bool
+	}{
+		{"any origin", []string{"*"}, "https://anything.example.net", true},
+		{"exact origin", []string{"https://ui.example.com"}, "https://ui.example.com", true},
+		{"exact origin ignores case", []string{"https://UI.example.com"}, "https://ui.example.com", true},
+		{"exact origin other scheme", []string{"https://ui.example.com"}, "http://ui.example.com", false},
+		{"exact origin other port", []string{"https://ui.example.com"}, "https://ui.example.com:8443", false},
+		{"nothing allowed", nil, "https://ui.example.com", false},
+		{"not a URL", []string{"*.example.com"}, "ui.example.com", false},
+
+		{"wildcard subdomain", []string{"https://*.example.com"}, "https://ui.example.com", true},
+		{"wildcard nested subdomain", []string{"https://*.example.com"}, "https://a.b.example.com", true},
+		{"wildcard ignores case", []string{"https://*.Example.com"}, "https://UI.example.COM", true},
+		{"wildcard bare domain", []string{"https://*.example.com"}, "https://example.com", false},
+		{"wildcard suffix without dot", []string{"https://*.example.com"}, "https://evilexample.com", false},
+		{"wildcard domain as subdomain", []string{"https://*.example.com"}, "https://example.com.evil.com", false},
+		{"wildcard domain in userinfo", []string{"https://*.example.com"}, "https://ui.example.com@evil.com", false},
+		{"wildcard other scheme", []string{"https://*.example.com"}, "http://ui.example.com", false},
+		{"wildcard any scheme", []string{"*.example.com"}, "http://ui.example.com", true},
+		{"wildcard any scheme other domain", []string{"*.example.com"}, "http://ui.example.org", false},
+
+		{"wildcard port", []string{"https://*.example.com:8443"}, "https://ui.example.com:8443", true},
+		{"wildcard other port", []string{"https://*.example.com:8443"}, "https://ui.example.com:9443", false},
+		{"wildcard port missing from origin", []string{"https://*.example.com:8443"}, "https://ui.example.com", false},
+		{"wildcard without port", []string{"https://*.example.com"}, "https://ui.example.com:8443", false},
+
+		{"second pattern matches", []string{"https://ui.example.org", "https://*.example.com"}, "https://ui.example.com", true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			originPolicy := NewOriginPolicy(testCase.allowedOrigins)
+			if got := originPolicy.IsOriginAllowed(testCase.origin); got != testCase.want {
+				t.Errorf("IsOriginAllowed(%q) with %v = %v, want %v", testCase.origin, testCase.allowedOrigins, got, testCase.want)
+			}
+		})
+	}
+}
+
+func TestOriginPolicyCheckOrigin(t *testing.T) {
+	originPolicy := NewOriginPolicy([]string{"https://*.example.com"})
+
+	request := httptest.NewRequest(http.MethodGet, "/DataTypes/TimeChunk", nil)
+	if !originPolicy.CheckOrigin(request) {
+		t.Error("requests without an Origin header should be allowed")
+	}
+
+	request.Header.Set("Origin", "https://evilexample.com")
+	if originPolicy.CheckOrigin(request) {
+		t.Error("requests from origins not allowed should be refused")
+	}
+}
+
+func TestOriginPolicyCORSMiddleware(t *testing.T) {
+	testCases := []struct {
+		name            string
+		method          string
+		origin          string
+		wantStatus      int
+		wantAllowOrigin string
+	}{
+		{"preflight allowed", http.MethodOptions, "https://ui.example.com", http.StatusNoContent, "https://ui.example.com"},
+		{"preflight refused", http.MethodOptions, "https://evilexample.com", http.StatusForbidden, ""},
+		{"request allowed", http.MethodGet, "https://ui.example.com", http.StatusOK, "https://ui.example.com"},
+		{"request from other origin", http.MethodGet, "https://evilexample.com", http.StatusOK, ""},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			router := gin.New()
+			router.Use(NewOriginPolicy([]string{"https://*.example.com"}).CORSMiddleware())
+			router.GET("/status", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+			request := httptest.NewRequest(testCase.method, "/status", nil)
+			request.Header.Set("Origin", testCase.origin)
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, request)
+
+			if recorder.Code != testCase.wantStatus {
+				t.Errorf("got status %d, want %d", recorder.Code, testCase.wantStatus)
+			}
+			if allowOrigin := recorder.Header().Get("Access-Control-Allow-Origin"); allowOrigin != testCase.wantAllowOrigin {
+				t.Errorf("got Access-Control-Allow-Origin %q, want %q", allowOrigin, testCase.wantAllowOrigin)
+			}
+		})
+	}
+}
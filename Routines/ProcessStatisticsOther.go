@@ -0,0 +1,15 @@
+//go:build !unix
+
+package Routines
+
+import "time"
+
+// Open file descriptors are not reported on systems without them
+func getOpenFileDescriptors() (openFileDescriptors int, fileDescriptorLimit uint64, ok bool) {
+	return 0, 0, false
+}
+
+// CPU time is not reported on systems without getrusage
+func getProcessCPUTime() (time.Duration, bool) {
+	return 0, false
+}
@@ -0,0 +1,44 @@
+//go:build unix
+
+package Routines
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+/*
+getOpenFileDescriptors counts the descriptors the adapter has open and
+returns its soft limit on them, or 0 if that is unknown. Linux lists them in
+/proc/self/fd and other systems in /dev/fd
+*/
+func getOpenFileDescriptors() (openFileDescriptors int, fileDescriptorLimit uint64, ok bool) {
+
+	fileDescriptorEntries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		if fileDescriptorEntries, err = os.ReadDir("/dev/fd"); err != nil {
+			return 0, 0, false
+		}
+	}
+
+	var resourceLimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &resourceLimit); err == nil {
+		fileDescriptorLimit = uint64(resourceLimit.Cur)
+	}
+
+	// Reading the directory took a descriptor of its own
+	return len(fileDescriptorEntries) - 1, fileDescriptorLimit, true
+}
+
+/*
+getProcessCPUTime returns the user and system CPU time the adapter has used
+*/
+func getProcessCPUTime() (time.Duration, bool) {
+
+	var resourceUsage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &resourceUsage); err != nil {
+		return 0, false
+	}
+	return time.Duration(resourceUsage.Utime.Nano() + resourceUsage.Stime.Nano()), true
+}
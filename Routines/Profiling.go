@@ -0,0 +1,78 @@
+package Routines
+
+import (
+	"errors"
+	"net/http"
+	"net/http/pprof"
+	"os"
+
+	"github.com/rs/zerolog"
+)
+
+/*
+The Go profiler can be served on /debug/pprof/ by turning on ProfilingConfig,
+so heap, goroutine and CPU profiles can be taken from a running adapter
+
+	"ProfilingConfig": { "Enabled": "True", "Address": "localhost:6060" }
+
+It is off by default and has no authentication, so it listens on localhost
+unless another address is configured
+*/
+
+type ProfilingConfig struct {
+	Enabled bool
+	Address string // Host and port the profiler listens on
+}
+
+func ParseProfilingConfig(configJson map[string]interface{}) (ProfilingConfig, error) {
+
+	profilingConfig := ProfilingConfig{Enabled: false, Address: "localhost:6060"}
+
+	ProfilingConfigSection, exists := GetConfigSection(configJson, "ProfilingConfig")
+	if !exists {
+		return profilingConfig, nil
+	}
+
+	var err error
+	if profilingConfig.Enabled, err = GetConfigBool(ProfilingConfigSection, "Enabled", profilingConfig.Enabled); err != nil {
+		return profilingConfig, err
+	}
+	if profilingConfig.Address, err = GetConfigString(ProfilingConfigSection, "Address", profilingConfig.Address); err != nil {
+		return profilingConfig, err
+	}
+	if profilingConfig.Address == "" {
+		return profilingConfig, errors.New("Address should not be empty")
+	}
+
+	return profilingConfig, nil
+}
+
+/*
+HandleProfiling serves the profiler if it is enabled, returning straight
+away if not
+*/
+func HandleProfiling(configJson map[string]interface{}, loggingChannel chan map[zerolog.Level]string) {
+
+	profilingConfig, err := ParseProfilingConfig(configJson)
+	if err != nil {
+		loggingChannel <- CreateLogMessage(zerolog.FatalLevel, "ProfilingConfig "+err.Error())
+		os.Exit(1)
+		return
+	}
+	if !profilingConfig.Enabled {
+		return
+	}
+
+	// A mux of its own keeps the profiler off every other server
+	profilingMux := http.NewServeMux()
+	profilingMux.HandleFunc("/debug/pprof/", pprof.Index)
+	profilingMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	profilingMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	profilingMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	profilingMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	loggingChannel <- CreateLogMessage(zerolog.WarnLevel, "Profiling enabled on http://"+profilingConfig.Address+"/debug/pprof/")
+	if err := http.ListenAndServe(profilingConfig.Address, profilingMux); err != nil {
+		loggingChannel <- CreateLogMessage(zerolog.ErrorLevel, "Profiling stopped serving:"+err.Error())
+	}
+}
@@ -0,0 +1,196 @@
+package Routines
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+The reporting server keeps the latest value of every SystemMetric it routes
+and serves them on /metrics in the Prometheus text format, so scrapes see
+the same values as the reporting stream
+*/
+
+const (
+	prometheusNamespace        = "tcp_ws_adapter"
+	prometheusContentType      = "text/plain; version=0.0.4; charset=utf-8"
+	metricCacheExpiry          = 5 * time.Minute // Metrics not reported for this long are left out
+	prometheusLabelEnvironment = "environment"
+)
+
+var invalidPrometheusNameCharacters = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+/*
+MetricCache holds the latest value of each metric, keyed by environment,
+metric name and labels
+*/
+type MetricCache struct {
+	metricMap map[string]MetricStatistic // Map of metric key and its latest value
+	mu        sync.Mutex                 // Mutex to protect access to the map
+}
+
+func NewMetricCache() *MetricCache {
+	p := new(MetricCache)
+	p.metricMap = make(map[string]MetricStatistic)
+	return p
+}
+
+func (m *MetricCache) Update(metric MetricStatistic) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.metricMap[GetPrometheusName(metric)+formatPrometheusLabels(getPrometheusLabels(metric))] = metric
+}
+
+/*
+GetMetrics returns every metric reported within the cache expiry and forgets
+the rest
+*/
+func (m *MetricCache) GetMetrics() []MetricStatistic {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.pruneExpiredMetrics()
+	metrics := make([]MetricStatistic, 0, len(m.metricMap))
+	for _, metric := range m.metricMap {
+		metrics = append(metrics, metric)
+	}
+	return metrics
+}
+
+/*
+Prune forgets metrics not reported within the cache expiry so series that
+stopped being reported do not build up between scrapes
+*/
+func (m *MetricCache) Prune() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.pruneExpiredMetrics()
+}
+
+// pruneExpiredMetrics does the work of Prune. The caller must hold the mutex
+func (m *MetricCache) pruneExpiredMetrics() {
+	oldestTimestamp := time.Now().Add(-metricCacheExpiry).UnixMilli()
+	for key, metric := range m.metricMap {
+		if metric.Timestamp < oldestTimestamp {
+			delete(m.metricMap, key)
+		}
+	}
+}
+
+/*
+Remove forgets every metric of the removed statistics, such as those of a
+client that has disconnected
+*/
+func (m *MetricCache) Remove(removal StatRemoval) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, metric := range m.metricMap {
+		if removal.Matches(metric.StatEnvironment, metric.StatName) {
+			delete(m.metricMap, key)
+		}
+	}
+}
+
+/*
+GetPrometheusName returns the name a metric is exposed as. Metrics without a
+Metric name are named after their StatName
+*/
+func GetPrometheusName(metric MetricStatistic) string {
+	name := metric.Metric
+	if name == "" {
+		name = strings.ToLower(metric.StatName)
+	}
+	return prometheusNamespace + "_" + invalidPrometheusNameCharacters.ReplaceAllString(name, "_")
+}
+
+func getPrometheusLabels(metric MetricStatistic) map[string]string {
+	labels := map[string]string{prometheusLabelEnvironment: metric.StatEnvironment}
+	for labelName, labelValue := range metric.Labels {
+		labels[invalidPrometheusNameCharacters.ReplaceAllString(labelName, "_")] = labelValue
+	}
+	return labels
+}
+
+func formatPrometheusLabels(labels map[string]string) string {
+	labelNames := make([]string, 0, len(labels))
+	for labelName := range labels {
+		labelNames = append(labelNames, labelName)
+	}
+	sort.Strings(labelNames)
+
+	labelValueEscaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	formattedLabels := make([]string, 0, len(labelNames))
+	for _, labelName := range labelNames {
+		formattedLabels = append(formattedLabels, labelName+`="`+labelValueEscaper.Replace(labels[labelName])+`"`)
+	}
+	return "{" + strings.Join(formattedLabels, ",") + "}"
+}
+
+/*
+FormatPrometheusMetrics writes metrics in the Prometheus text format, grouped
+by name so each gets a single TYPE line. Metrics with a range also get _min
+and _max gauges
+*/
+func FormatPrometheusMetrics(metrics []MetricStatistic) string {
+
+	samplesByName := make(map[string][]string)
+	addSample := func(name string, labels string, value float64) {
+		samplesByName[name] = append(samplesByName[name], name+labels+" "+strconv.FormatFloat(value, 'g', -1, 64))
+	}
+
+	for _, metric := range metrics {
+		name := GetPrometheusName(metric)
+		labels := formatPrometheusLabels(getPrometheusLabels(metric))
+		addSample(name, labels, metric.Value)
+		if metric.Min != nil {
+			addSample(name+"_min", labels, *metric.Min)
+		}
+		if metric.Max != nil {
+			addSample(name+"_max", labels, *metric.Max)
+		}
+	}
+
+	names := make([]string, 0, len(samplesByName))
+	for name := range samplesByName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var builder strings.Builder
+	for _, name := range names {
+		metricType := "gauge"
+		if strings.HasSuffix(name, "_total") {
+			metricType = "counter"
+		}
+		builder.WriteString("# TYPE " + name + " " + metricType + "\n")
+
+		samples := samplesByName[name]
+		sort.Strings(samples)
+		for _, sample := range samples {
+			builder.WriteString(sample + "\n")
+		}
+	}
+	return builder.String()
+}
+
+/*
+RegisterMetricsRoute adds /metrics to the reporting server. With
+authentication on the token has to allow the "metrics" reporting stream
+*/
+func RegisterMetricsRoute(router *gin.Engine, metricCache *MetricCache, serverConfig WebSocketServerConfig) {
+	requireAuthorization := serverConfig.Authenticator.RequireAuthorization(AuthorizationScopeReportingStreams, "metrics")
+
+	router.GET("/metrics", requireAuthorization, func(c *gin.Context) {
+		c.Data(http.StatusOK, prometheusContentType, []byte(FormatPrometheusMetrics(metricCache.GetMetrics())))
+	})
+}
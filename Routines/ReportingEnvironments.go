@@ -0,0 +1,86 @@
+package Routines
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+)
+
+/*
+Statistics forwarded from remote nodes arrive mixed in with the adapter's
+own, so the reporting server also routes every SystemInfo, SystemMetric and
+SystemAlert message by its StatEnvironment. Each environment is served on
+
+	/Reporting/<environment>          WebSocket
+	/sse/Reporting/<environment>      Server-Sent Events
+	/Reporting/<environment>/latest   and /recent as for chunk types
+
+and GET /Reporting lists the environments seen
+
+	{ "Environments": [ { "StatEnvironment": "TCP_WS_Adapter", "LastSeen": 1700000000000, "Subscribers": 1 } ] }
+*/
+
+const (
+	ReportingEnvironmentRoutePrefix                 = "/Reporting/"
+	ReportingEnvironmentServerSentEventsRoutePrefix = "/sse/Reporting/"
+)
+
+type ReportingEnvironment struct {
+	StatEnvironment string `json:"StatEnvironment"`
+	LastSeen        int64  `json:"LastSeen"` // Unix time in milliseconds
+	Subscribers     int    `json:"Subscribers"`
+}
+
+type ReportingEnvironmentListing struct {
+	Environments []ReportingEnvironment `json:"Environments"`
+}
+
+/*
+NewReportingEnvironmentMap creates the router of reporting messages by
+environment. New subscribers are sent the latest message of every statistic
+in the environment before live updates. Tokens are checked against their
+Environments rather than their ReportingStreams
+*/
+func NewReportingEnvironmentMap(loggingChannel chan map[zerolog.Level]string, reportingChannel chan string, serverConfig WebSocketServerConfig) *ChunkTypeToChannelMap {
+	serverConfig.AuthorizationScope = AuthorizationScopeEnvironments
+	environmentRoutingMap := NewChunkTypeToChannelMap(loggingChannel, reportingChannel, serverConfig)
+	environmentRoutingMap.SetRoutePrefixes(ReportingEnvironmentRoutePrefix, ReportingEnvironmentServerSentEventsRoutePrefix)
+	environmentRoutingMap.EnableLastKnownValues()
+	return environmentRoutingMap
+}
+
+/*
+IsRoutableEnvironment reports whether an environment can have its own
+route. Names containing / and the reserved "all" cannot
+*/
+func IsRoutableEnvironment(environment string) bool {
+	return environment != "" && environment != AllChunkTypesName && !strings.Contains(environment, "/")
+}
+
+/*
+RegisterReportingEnvironmentsRoute adds GET /Reporting. With authentication
+on the token has to allow the "environments" reporting stream
+*/
+func RegisterReportingEnvironmentsRoute(router *gin.Engine, environmentRoutingMap *ChunkTypeToChannelMap, serverConfig WebSocketServerConfig) {
+	requireAuthorization := serverConfig.Authenticator.RequireAuthorization(AuthorizationScopeReportingStreams, "environments")
+
+	router.GET(strings.TrimSuffix(ReportingEnvironmentRoutePrefix, "/"), requireAuthorization, func(c *gin.Context) {
+
+		environmentListing := ReportingEnvironmentListing{Environments: []ReportingEnvironment{}}
+		for environment, lastSeenTime := range environmentRoutingMap.GetLastSeenTimes() {
+			environmentListing.Environments = append(environmentListing.Environments, ReportingEnvironment{
+				StatEnvironment: environment,
+				LastSeen:        lastSeenTime.UnixMilli(),
+				Subscribers:     len(environmentRoutingMap.GetSubscribers(environment)),
+			})
+		}
+		sort.Slice(environmentListing.Environments, func(i, j int) bool {
+			return environmentListing.Environments[i].StatEnvironment < environmentListing.Environments[j].StatEnvironment
+		})
+
+		c.JSON(http.StatusOK, environmentListing)
+	})
+}
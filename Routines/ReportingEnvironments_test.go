@@ -0,0 +1,111 @@
+package Routines
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestIsRoutableEnvironment(t *testing.T) {
+	testCases := []struct {
+		environment  string
+		wantRoutable bool
+	}{
+		{"TCP_WS_Adapter", true},
+		{"Node 1", true},
+		{"", false},
+		{AllChunkTypesName, false},
+		{"Node/1", false},
+	}
+	for _, testCase := range testCases {
+		if routable := IsRoutableEnvironment(testCase.environment); routable != testCase.wantRoutable {
+			t.Errorf("IsRoutableEnvironment(%q) = %v, want %v", testCase.environment, routable, testCase.wantRoutable)
+		}
+	}
+}
+
+func TestReportingEnvironmentsAreListed(t *testing.T) {
+	loggingChannel := newTestLoggingChannel(t)
+	router := gin.New()
+	serverConfig := newTestServerConfig(t, nil)
+	environmentRoutingMap := NewReportingEnvironmentMap(loggingChannel, make(chan string, 100), serverConfig)
+	environmentRoutingMap.RegisterRoutes(loggingChannel, router)
+	RegisterReportingEnvironmentsRoute(router, environmentRoutingMap, serverConfig)
+
+	for _, environment := range []string{"Node2", "Node1"} {
+		environmentRoutingMap.SendChunkToWebSocket(loggingChannel, environment, `{"SystemInfo":{"StatEnvironment":"`+environment+`","StatName":"x","StatStaus":"1"}}`)
+	}
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/Reporting", nil))
+	var environmentListing ReportingEnvironmentListing
+	if err := json.Unmarshal(recorder.Body.Bytes(), &environmentListing); err != nil {
+		t.Fatalf("got status %d and %s: %v", recorder.Code, recorder.Body, err)
+	}
+	if len(environmentListing.Environments) != 2 || environmentListing.Environments[0].StatEnvironment != "Node1" || environmentListing.Environments[1].StatEnvironment != "Node2" {
+		t.Errorf("listed %+v, want Node1 and Node2 in order", environmentListing.Environments)
+	}
+}
+
+func TestReportingEnvironmentsWithRouteSyntaxInTheirName(t *testing.T) {
+	loggingChannel := newTestLoggingChannel(t)
+	router := gin.New()
+	environmentRoutingMap := NewReportingEnvironmentMap(loggingChannel, make(chan string, 100), newTestServerConfig(t, nil))
+	environmentRoutingMap.RegisterRoutes(loggingChannel, router)
+
+	// Each of these used to become a gin route of its own, which panics or captures other paths
+	environments := []string{"*x", ":id", "a b", "Node?1", "Node#1"}
+	for _, environment := range environments {
+		environmentRoutingMap.SendChunkToWebSocket(loggingChannel, environment, `{"SystemInfo":{"StatEnvironment":"`+environment+`","StatName":"x","StatStaus":"1"}}`)
+	}
+
+	for _, environment := range environments {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, ReportingEnvironmentRoutePrefix+url.PathEscape(environment)+"/latest", nil))
+		if recorder.Code != http.StatusOK {
+			t.Errorf("environment %q: got status %d, want %d", environment, recorder.Code, http.StatusOK)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, ReportingEnvironmentRoutePrefix+"Unknown/latest", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("unknown environment: got status %d, want %d", recorder.Code, http.StatusNotFound)
+	}
+}
+
+func TestReportingEnvironmentsAreCheckedAgainstTheirOwnClaims(t *testing.T) {
+	loggingChannel := newTestLoggingChannel(t)
+	router := gin.New()
+	serverConfig := newTestServerConfig(t, nil)
+	serverConfig.Authenticator = newTestAuthenticator(t)
+	serverConfig.AuthorizationScope = AuthorizationScopeReportingStreams
+	environmentRoutingMap := NewReportingEnvironmentMap(loggingChannel, make(chan string, 100), serverConfig)
+	environmentRoutingMap.RegisterRoutes(loggingChannel, router)
+
+	// A node reporting as "status" must not be readable with the status stream's claim
+	environmentRoutingMap.SendChunkToWebSocket(loggingChannel, "status", `{"SystemInfo":{"StatEnvironment":"status","StatName":"x","StatStaus":"1"}}`)
+
+	testCases := []struct {
+		name       string
+		claimsJSON string
+		wantStatus int
+	}{
+		{"reporting stream claim", `{"ReportingStreams":["status"]}`, http.StatusForbidden},
+		{"environment claim", `{"Environments":["status"]}`, http.StatusOK},
+	}
+	for _, testCase := range testCases {
+		token := signTestJWT(`{"alg":"HS256","kid":"primary"}`, testCase.claimsJSON, "HS256", "primary-secret")
+		request := httptest.NewRequest(http.MethodGet, ReportingEnvironmentRoutePrefix+"status/latest", nil)
+		request.Header.Set("Authorization", "Bearer "+token)
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		if recorder.Code != testCase.wantStatus {
+			t.Errorf("%s: got status %d, want %d", testCase.name, recorder.Code, testCase.wantStatus)
+		}
+	}
+}
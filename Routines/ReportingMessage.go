@@ -0,0 +1,165 @@
+package Routines
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+/*
+ReportingMessage is a message on the reporting channel decoded once by the
+reporting routine, so the caches, alert rules, environment routing and last
+known values all work from the same statistic. At most one of the statistic
+fields is set, and only when the message holds a valid one
+*/
+type ReportingMessage struct {
+	ChunkType    string           // Root key of the message, which it is routed by
+	JSONString   string           // The message as it is sent to clients
+	ReceivedTime time.Time        // When the reporting routine received the message
+	SystemInfo   *SystemStatistic // Statistic of a SystemInfo message
+	SystemMetric *MetricStatistic // Metric of a SystemMetric message
+	SystemAlert  *AlertEvent      // Alert of a SystemAlert message
+	Removal      *StatRemoval     // Statistics a SystemStatRemoval message forgets
+}
+
+/*
+ParseReportingMessage decodes a reporting message and the statistic it
+holds. Messages of other types or with an invalid statistic are still
+returned so they can be routed by their root key
+
+returns an error if the message is not a JSON object with a root key
+*/
+func ParseReportingMessage(JSONString string) (ReportingMessage, error) {
+	message := ReportingMessage{JSONString: JSONString, ReceivedTime: time.Now()}
+
+	var JSONData map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(JSONString), &JSONData); err != nil {
+		return message, err
+	}
+
+	// We assume there's only one root key
+	var messageData json.RawMessage
+	for key, data := range JSONData {
+		message.ChunkType = key
+		messageData = data
+		break
+	}
+	if message.ChunkType == "" {
+		return message, errors.New("message has no root key")
+	}
+
+	switch message.ChunkType {
+	case "SystemInfo":
+		var systemStatistic SystemStatistic
+		if err := json.Unmarshal(messageData, &systemStatistic); err == nil && systemStatistic.StatName != "" {
+			message.SystemInfo = &systemStatistic
+		}
+
+	case "SystemMetric":
+		var metric MetricStatistic
+		if err := json.Unmarshal(messageData, &metric); err == nil && metric.StatName != "" {
+			message.SystemMetric = &metric
+		}
+
+	case "SystemAlert":
+		var alertEvent AlertEvent
+		if err := json.Unmarshal(messageData, &alertEvent); err == nil && alertEvent.Rule != "" {
+			message.SystemAlert = &alertEvent
+		}
+
+	case "SystemStatRemoval":
+		var removal StatRemoval
+		if err := json.Unmarshal(messageData, &removal); err == nil {
+			message.Removal = &removal
+		}
+	}
+
+	return message, nil
+}
+
+/*
+NewAlertReportingMessage creates the SystemAlert message of an alert so it
+is routed like one received from the reporting channel
+*/
+func NewAlertReportingMessage(alertEvent AlertEvent) ReportingMessage {
+	data, _ := json.Marshal(SystemAlert{Alert: alertEvent})
+	return ReportingMessage{ChunkType: "SystemAlert", JSONString: string(data), ReceivedTime: time.Now(), SystemAlert: &alertEvent}
+}
+
+/*
+NewLegacyReportingMessage creates the SystemInfo message of a metric for
+UIs that only read the legacy shape
+*/
+func NewLegacyReportingMessage(metric MetricStatistic) ReportingMessage {
+	systemStatistic := SystemStatistic{
+		StatEnvironment: metric.StatEnvironment,
+		StatName:        metric.StatName,
+		StatStaus:       metric.GetLegacyStatus(),
+	}
+	data, _ := json.Marshal(SystemInfo{SystemStat: systemStatistic})
+	return ReportingMessage{ChunkType: "SystemInfo", JSONString: string(data), ReceivedTime: time.Now(), SystemInfo: &systemStatistic}
+}
+
+/*
+GetStatisticKey keys SystemInfo and SystemMetric messages by their
+environment and statistic name, and SystemAlert messages also by their rule
+
+returns false for messages without a statistic
+*/
+func (m ReportingMessage) GetStatisticKey() (string, bool) {
+	switch {
+	case m.SystemInfo != nil:
+		return m.SystemInfo.StatEnvironment + "/" + m.SystemInfo.StatName, true
+	case m.SystemMetric != nil:
+		return m.SystemMetric.StatEnvironment + "/" + m.SystemMetric.StatName, true
+	case m.SystemAlert != nil:
+		return m.SystemAlert.Rule + "/" + m.SystemAlert.StatEnvironment + "/" + m.SystemAlert.StatName, true
+	}
+	return "", false
+}
+
+/*
+GetStatEnvironment returns the environment of the statistic in the message,
+or false if it has none that can be used in a route
+*/
+func (m ReportingMessage) GetStatEnvironment() (string, bool) {
+	var environment string
+	switch {
+	case m.SystemInfo != nil:
+		environment = m.SystemInfo.StatEnvironment
+	case m.SystemMetric != nil:
+		environment = m.SystemMetric.StatEnvironment
+	case m.SystemAlert != nil:
+		environment = m.SystemAlert.StatEnvironment
+	}
+
+	if !IsRoutableEnvironment(environment) {
+		return "", false
+	}
+	return environment, true
+}
+
+/*
+RouteReportingMessage sends a message to clients of its type and of the
+environment that reported it. Environments key their last known values by
+type as well as statistic, so the latest SystemInfo and SystemMetric of a
+statistic are both kept
+*/
+func RouteReportingMessage(loggingChannel chan map[zerolog.Level]string, message ReportingMessage, chunkTypeRoutingMap *ChunkTypeToChannelMap, environmentRoutingMap *ChunkTypeToChannelMap) {
+	statisticKey, hasStatisticKey := message.GetStatisticKey()
+
+	receivedChunk := ReceivedChunk{JSONString: message.JSONString, ReceivedTime: message.ReceivedTime}
+	if hasStatisticKey {
+		receivedChunk.LastKnownValueKey = statisticKey
+	}
+	chunkTypeRoutingMap.SendReceivedChunkToWebSocket(loggingChannel, message.ChunkType, receivedChunk)
+
+	if environment, hasEnvironment := message.GetStatEnvironment(); hasEnvironment {
+		if hasStatisticKey {
+			receivedChunk.LastKnownValueKey = message.ChunkType + "/" + statisticKey
+		}
+		environmentRoutingMap.SendReceivedChunkToWebSocket(loggingChannel, environment, receivedChunk)
+	}
+}
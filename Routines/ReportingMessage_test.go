@@ -0,0 +1,56 @@
+package Routines
+
+import "testing"
+
+func TestParseReportingMessage(t *testing.T) {
+	testCases := []struct {
+		name            string
+		JSONString      string
+		wantChunkType   string
+		wantKey         string
+		wantEnvironment string
+		wantError       bool
+	}{
+		{"system info", `{"SystemInfo":{"StatEnvironment":"Node1","StatName":"Queue","StatStaus":"1"}}`, "SystemInfo", "Node1/Queue", "Node1", false},
+		{"system metric", `{"SystemMetric":{"StatEnvironment":"Node1","StatName":"Queue","Value":1}}`, "SystemMetric", "Node1/Queue", "Node1", false},
+		{"system alert", `{"SystemAlert":{"Rule":"Backlog","StatEnvironment":"Node1","StatName":"Queue"}}`, "SystemAlert", "Backlog/Node1/Queue", "Node1", false},
+		{"statistic without name", `{"SystemInfo":{"StatEnvironment":"Node1","StatStaus":"1"}}`, "SystemInfo", "", "", false},
+		{"statistic of wrong shape", `{"SystemMetric":{"StatName":["Queue"]}}`, "SystemMetric", "", "", false},
+		{"environment that cannot be routed", `{"SystemInfo":{"StatEnvironment":"a/b","StatName":"Queue","StatStaus":"1"}}`, "SystemInfo", "a/b/Queue", "", false},
+		{"other chunk type", `{"TimeChunk":{"StatEnvironment":"Node1","StatName":"Queue"}}`, "TimeChunk", "", "", false},
+		{"no root key", `{}`, "", "", "", true},
+		{"not JSON", `SystemInfo`, "", "", "", true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			message, err := ParseReportingMessage(testCase.JSONString)
+			if (err != nil) != testCase.wantError {
+				t.Fatalf("got error %v, want error %v", err, testCase.wantError)
+			}
+			if testCase.wantError {
+				return
+			}
+
+			if message.ChunkType != testCase.wantChunkType {
+				t.Errorf("got chunk type %q, want %q", message.ChunkType, testCase.wantChunkType)
+			}
+			if key, _ := message.GetStatisticKey(); key != testCase.wantKey {
+				t.Errorf("got statistic key %q, want %q", key, testCase.wantKey)
+			}
+			if environment, _ := message.GetStatEnvironment(); environment != testCase.wantEnvironment {
+				t.Errorf("got environment %q, want %q", environment, testCase.wantEnvironment)
+			}
+		})
+	}
+}
+
+func TestParseReportingMessageRemoval(t *testing.T) {
+	message, err := ParseReportingMessage(`{"SystemStatRemoval":{"StatEnvironment":"TCP_WS_Adapter","StatNamePrefix":"TimeChunk_Client_10.0.0.5_"}}`)
+	if err != nil || message.Removal == nil {
+		t.Fatalf("removal was not parsed: %v", err)
+	}
+	if wantRemoval := (StatRemoval{StatEnvironment: AdapterStatEnvironment, StatNamePrefix: "TimeChunk_Client_10.0.0.5_"}); *message.Removal != wantRemoval {
+		t.Errorf("got removal %+v, want %+v", *message.Removal, wantRemoval)
+	}
+}
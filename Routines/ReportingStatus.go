@@ -0,0 +1,176 @@
+package Routines
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+The reporting routine keeps the latest value of every statistic it routes,
+whether reported by the adapter or forwarded from upstream SystemInfo, so
+GET /status can return the current state without a WebSocket
+
+	{ "TCP_WS_Adapter": { "TimeChunk_Channel": { "Status": "12/1000", "UpdatedAt": 1700000000000, "Metric": { ... } } } }
+
+Metric is only present for statistics also reported as a SystemMetric
+*/
+
+const (
+	reportingStatusExpiry       = 1 * time.Hour    // Statistics not reported for this long are assumed gone
+	reportingCachePruneInterval = 10 * time.Second // How often the reporting routine forgets expired statistics
+)
+
+type ReportingStatistic struct {
+	Status    string           `json:"Status"`
+	UpdatedAt int64            `json:"UpdatedAt"` // Unix time in milliseconds
+	Metric    *MetricStatistic `json:"Metric,omitempty"`
+}
+
+/*
+ReportingStatusCache maps environment and statistic names to their latest
+values
+*/
+type ReportingStatusCache struct {
+	statusMap map[string]map[string]ReportingStatistic // Map of environment, statistic name and latest value
+	mu        sync.Mutex                               // Mutex to protect access to the map
+}
+
+func NewReportingStatusCache() *ReportingStatusCache {
+	p := new(ReportingStatusCache)
+	p.statusMap = make(map[string]map[string]ReportingStatistic)
+	return p
+}
+
+/*
+UpdateStatus stores a legacy statistic, keeping any typed metric already
+held for it
+*/
+func (r *ReportingStatusCache) UpdateStatus(systemStatistic SystemStatistic) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	environmentStatus := r.getEnvironmentStatus(systemStatistic.StatEnvironment)
+	statistic := environmentStatus[systemStatistic.StatName]
+	statistic.Status = systemStatistic.StatStaus
+	statistic.UpdatedAt = time.Now().UnixMilli()
+	environmentStatus[systemStatistic.StatName] = statistic
+}
+
+func (r *ReportingStatusCache) UpdateMetric(metric MetricStatistic) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	environmentStatus := r.getEnvironmentStatus(metric.StatEnvironment)
+	environmentStatus[metric.StatName] = ReportingStatistic{
+		Status:    metric.GetLegacyStatus(),
+		UpdatedAt: time.Now().UnixMilli(),
+		Metric:    &metric,
+	}
+}
+
+/*
+getEnvironmentStatus returns the statistics of an environment, making the
+map if needed. The caller must hold the mutex
+*/
+func (r *ReportingStatusCache) getEnvironmentStatus(environment string) map[string]ReportingStatistic {
+	if r.statusMap[environment] == nil {
+		r.statusMap[environment] = make(map[string]ReportingStatistic)
+	}
+	return r.statusMap[environment]
+}
+
+/*
+GetStatus returns a copy of every statistic reported within the expiry and
+forgets the rest
+*/
+func (r *ReportingStatusCache) GetStatus() map[string]map[string]ReportingStatistic {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.pruneExpiredStatistics()
+	status := make(map[string]map[string]ReportingStatistic, len(r.statusMap))
+	for environment, environmentStatus := range r.statusMap {
+		status[environment] = make(map[string]ReportingStatistic, len(environmentStatus))
+		for statName, statistic := range environmentStatus {
+			status[environment][statName] = statistic
+		}
+	}
+	return status
+}
+
+/*
+Prune forgets statistics not reported within the expiry so ones that stopped
+being reported do not build up between requests
+*/
+func (r *ReportingStatusCache) Prune() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.pruneExpiredStatistics()
+}
+
+// pruneExpiredStatistics does the work of Prune. The caller must hold the mutex
+func (r *ReportingStatusCache) pruneExpiredStatistics() {
+	oldestUpdate := time.Now().Add(-reportingStatusExpiry).UnixMilli()
+	for environment, environmentStatus := range r.statusMap {
+		for statName, statistic := range environmentStatus {
+			if statistic.UpdatedAt < oldestUpdate {
+				delete(environmentStatus, statName)
+			}
+		}
+		if len(environmentStatus) == 0 {
+			delete(r.statusMap, environment)
+		}
+	}
+}
+
+/*
+Remove forgets the removed statistics, such as those of a client that has
+disconnected
+*/
+func (r *ReportingStatusCache) Remove(removal StatRemoval) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	environmentStatus := r.statusMap[removal.StatEnvironment]
+	for statName := range environmentStatus {
+		if removal.Matches(removal.StatEnvironment, statName) {
+			delete(environmentStatus, statName)
+		}
+	}
+	if len(environmentStatus) == 0 {
+		delete(r.statusMap, removal.StatEnvironment)
+	}
+}
+
+/*
+ForgetStatistics removes statistics from everything the reporting routine
+keeps of them, so new clients and scrapes stop seeing them
+*/
+func ForgetStatistics(removal StatRemoval, chunkTypeRoutingMap *ChunkTypeToChannelMap, environmentRoutingMap *ChunkTypeToChannelMap, metricCache *MetricCache, statusCache *ReportingStatusCache) {
+
+	metricCache.Remove(removal)
+	statusCache.Remove(removal)
+
+	// Last known values are keyed as RouteReportingMessage names them
+	statisticKeyPrefix := removal.StatEnvironment + "/" + removal.StatNamePrefix
+	for _, chunkTypeString := range []string{"SystemInfo", "SystemMetric"} {
+		chunkTypeRoutingMap.RemoveLastKnownValues(chunkTypeString, statisticKeyPrefix)
+		environmentRoutingMap.RemoveLastKnownValues(removal.StatEnvironment, chunkTypeString+"/"+statisticKeyPrefix)
+	}
+}
+
+/*
+RegisterStatusRoute adds GET /status to the reporting server. With
+authentication on the token has to allow the "status" reporting stream
+*/
+func RegisterStatusRoute(router *gin.Engine, statusCache *ReportingStatusCache, serverConfig WebSocketServerConfig) {
+	requireAuthorization := serverConfig.Authenticator.RequireAuthorization(AuthorizationScopeReportingStreams, "status")
+
+	router.GET("/status", requireAuthorization, func(c *gin.Context) {
+		c.JSON(http.StatusOK, statusCache.GetStatus())
+	})
+}
@@ -0,0 +1,108 @@
+package Routines
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+routeTestStatistic hands a statistic to everything the reporting routine
+keeps it in, as both a SystemMetric and a SystemInfo
+*/
+func routeTestStatistic(t *testing.T, metric MetricStatistic, chunkTypeRoutingMap *ChunkTypeToChannelMap, environmentRoutingMap *ChunkTypeToChannelMap, metricCache *MetricCache, statusCache *ReportingStatusCache) {
+	systemMetricJSON, _ := json.Marshal(SystemMetric{Metric: metric})
+	systemInfoJSON, _ := json.Marshal(SystemInfo{SystemStat: SystemStatistic{StatEnvironment: metric.StatEnvironment, StatName: metric.StatName, StatStaus: metric.GetLegacyStatus()}})
+
+	metricCache.Update(metric)
+	statusCache.UpdateMetric(metric)
+	routeTestMessage(t, string(systemMetricJSON), chunkTypeRoutingMap, environmentRoutingMap)
+	routeTestMessage(t, string(systemInfoJSON), chunkTypeRoutingMap, environmentRoutingMap)
+}
+
+func getLastKnownStatNames(t *testing.T, routingMap *ChunkTypeToChannelMap, chunkTypeString string) []string {
+	chunks, _ := routingMap.GetLastKnownValues(chunkTypeString)
+	statNames := make([]string, 0, len(chunks))
+	for _, chunk := range chunks {
+		var JSONData map[string]struct{ StatName string }
+		if err := json.Unmarshal([]byte(chunk.JSONString), &JSONData); err != nil {
+			t.Fatalf("last known value is not a statistic: %v", err)
+		}
+		for chunkType, statistic := range JSONData {
+			statNames = append(statNames, chunkType+"/"+statistic.StatName)
+		}
+	}
+	sort.Strings(statNames)
+	return statNames
+}
+
+func TestForgetStatisticsRemovesAClientEverywhere(t *testing.T) {
+	loggingChannel := newTestLoggingChannel(t)
+	serverConfig := newTestServerConfig(t, nil)
+	chunkTypeRoutingMap := NewChunkTypeToChannelMap(loggingChannel, make(chan string, 100), serverConfig)
+	chunkTypeRoutingMap.EnableLastKnownValues()
+	environmentRoutingMap := NewReportingEnvironmentMap(loggingChannel, make(chan string, 100), serverConfig)
+	metricCache := NewMetricCache()
+	statusCache := NewReportingStatusCache()
+
+	for _, statName := range []string{"TimeChunk_Client_10.0.0.5_Lag", "TimeChunk_Client_10.0.0.5-2_Lag", "TimeChunk_Channel"} {
+		routeTestStatistic(t, NewMetricStatistic(statName, 1, MetricUnitChunks), chunkTypeRoutingMap, environmentRoutingMap, metricCache, statusCache)
+	}
+
+	ForgetStatistics(StatRemoval{StatEnvironment: AdapterStatEnvironment, StatNamePrefix: "TimeChunk_Client_10.0.0.5_"}, chunkTypeRoutingMap, environmentRoutingMap, metricCache, statusCache)
+
+	var metricNames []string
+	for _, metric := range metricCache.GetMetrics() {
+		metricNames = append(metricNames, metric.StatName)
+	}
+	sort.Strings(metricNames)
+	if strings.Join(metricNames, ",") != "TimeChunk_Channel,TimeChunk_Client_10.0.0.5-2_Lag" {
+		t.Errorf("metrics kept: %v", metricNames)
+	}
+
+	var statusNames []string
+	for statName := range statusCache.GetStatus()[AdapterStatEnvironment] {
+		statusNames = append(statusNames, statName)
+	}
+	sort.Strings(statusNames)
+	if strings.Join(statusNames, ",") != "TimeChunk_Channel,TimeChunk_Client_10.0.0.5-2_Lag" {
+		t.Errorf("statuses kept: %v", statusNames)
+	}
+
+	wantLastKnownValues := "SystemInfo/TimeChunk_Channel,SystemInfo/TimeChunk_Client_10.0.0.5-2_Lag,SystemMetric/TimeChunk_Channel,SystemMetric/TimeChunk_Client_10.0.0.5-2_Lag"
+	lastKnownValues := append(getLastKnownStatNames(t, chunkTypeRoutingMap, "SystemInfo"), getLastKnownStatNames(t, chunkTypeRoutingMap, "SystemMetric")...)
+	if strings.Join(lastKnownValues, ",") != wantLastKnownValues {
+		t.Errorf("last known values kept: %v", lastKnownValues)
+	}
+	if environmentLastKnownValues := getLastKnownStatNames(t, environmentRoutingMap, AdapterStatEnvironment); strings.Join(environmentLastKnownValues, ",") != wantLastKnownValues {
+		t.Errorf("environment last known values kept: %v", environmentLastKnownValues)
+	}
+}
+
+func TestReportingCachesPruneExpiredStatistics(t *testing.T) {
+	metricCache := NewMetricCache()
+	statusCache := NewReportingStatusCache()
+
+	expiredMetric := NewMetricStatistic("Expired", 1, MetricUnitChunks)
+	expiredMetric.Timestamp = time.Now().Add(-metricCacheExpiry - time.Minute).UnixMilli()
+	metricCache.Update(expiredMetric)
+	metricCache.Update(NewMetricStatistic("Current", 1, MetricUnitChunks))
+
+	statusCache.UpdateMetric(NewMetricStatistic("Expired", 1, MetricUnitChunks))
+	statusCache.UpdateMetric(NewMetricStatistic("Current", 1, MetricUnitChunks))
+	statusCache.statusMap[AdapterStatEnvironment]["Expired"] = ReportingStatistic{UpdatedAt: time.Now().Add(-reportingStatusExpiry - time.Minute).UnixMilli()}
+	statusCache.UpdateMetric(MetricStatistic{StatEnvironment: "Gone", StatName: "Expired"})
+	statusCache.statusMap["Gone"]["Expired"] = ReportingStatistic{UpdatedAt: time.Now().Add(-reportingStatusExpiry - time.Minute).UnixMilli()}
+
+	metricCache.Prune()
+	statusCache.Prune()
+
+	if len(metricCache.metricMap) != 1 {
+		t.Errorf("metric cache holds %d metrics after pruning, want 1", len(metricCache.metricMap))
+	}
+	if len(statusCache.statusMap) != 1 || len(statusCache.statusMap[AdapterStatEnvironment]) != 1 {
+		t.Errorf("status cache holds %v after pruning, want only Current", statusCache.statusMap)
+	}
+}
@@ -0,0 +1,148 @@
+package Routines
+
+import (
+	"runtime"
+	"time"
+)
+
+/*
+Every second the adapter reports on itself as SystemMetric and SystemInfo
+statistics, so memory growth or a descriptor leak shows up on the reporting
+stream and in Prometheus without rebuilding with pprof. Open file
+descriptors and CPU usage are read from the operating system and are left
+out where it cannot provide them
+*/
+
+const runtimeMetricsInterval = 1000 * time.Millisecond
+
+/*
+RuntimeMetricsReporter remembers what it saw at its last report so it can
+report the garbage collections and CPU time since then
+*/
+type RuntimeMetricsReporter struct {
+	reportingChannel chan<- string
+	lastGCCount      uint32        // Garbage collections completed at the last report
+	lastCPUTime      time.Duration // User and system CPU time used at the last report
+	lastReportTime   time.Time     // Zero until the first report
+}
+
+func NewRuntimeMetricsReporter(reportingChannel chan<- string) *RuntimeMetricsReporter {
+	r := new(RuntimeMetricsReporter)
+	r.reportingChannel = reportingChannel
+	return r
+}
+
+/*
+RunRuntimeMetricsReporter reports Go runtime and process statistics of the
+adapter every second
+*/
+func RunRuntimeMetricsReporter(reportingChannel chan<- string) {
+
+	runtimeMetricsReporter := NewRuntimeMetricsReporter(reportingChannel)
+	reportingTicker := time.NewTicker(runtimeMetricsInterval)
+	defer reportingTicker.Stop()
+
+	for range reportingTicker.C {
+		runtimeMetricsReporter.Report()
+	}
+}
+
+func (r *RuntimeMetricsReporter) Report() {
+
+	var memoryStats runtime.MemStats
+	runtime.ReadMemStats(&memoryStats)
+
+	SendMetric(r.reportingChannel, NewMetricStatistic("Goroutines", float64(runtime.NumGoroutine()), "goroutines").
+		WithMetric("go_goroutines", nil))
+	SendMetric(r.reportingChannel, NewMetricStatistic("Heap_Allocated_Bytes", float64(memoryStats.HeapAlloc), MetricUnitBytes).
+		WithMetric("go_heap_alloc_bytes", nil))
+	SendMetric(r.reportingChannel, NewMetricStatistic("Heap_In_Use_Bytes", float64(memoryStats.HeapInuse), MetricUnitBytes).
+		WithMetric("go_heap_inuse_bytes", nil))
+	SendMetric(r.reportingChannel, NewMetricStatistic("Heap_Objects", float64(memoryStats.HeapObjects), "objects").
+		WithMetric("go_heap_objects", nil))
+	SendMetric(r.reportingChannel, NewMetricStatistic("GC_Cycles", float64(memoryStats.NumGC), "cycles").
+		WithMetric("go_gc_cycles_total", nil))
+	r.reportGCPauses(&memoryStats)
+
+	if openFileDescriptors, fileDescriptorLimit, ok := getOpenFileDescriptors(); ok {
+		openFileDescriptorsMetric := NewMetricStatistic("Open_File_Descriptors", float64(openFileDescriptors), "descriptors")
+		if fileDescriptorLimit > 0 {
+			openFileDescriptorsMetric = openFileDescriptorsMetric.WithCapacity(float64(fileDescriptorLimit))
+		}
+		SendMetric(r.reportingChannel, openFileDescriptorsMetric.WithMetric("process_open_fds", nil))
+	}
+
+	r.reportCPUUsage()
+}
+
+/*
+reportGCPauses sends the latest stop the world pause with the shortest and
+longest since the last report as its range, and the total paused time
+*/
+func (r *RuntimeMetricsReporter) reportGCPauses(memoryStats *runtime.MemStats) {
+
+	gcCount := memoryStats.NumGC
+	newGCCount := gcCount - r.lastGCCount
+	r.lastGCCount = gcCount
+	if gcCount == 0 {
+		return
+	}
+
+	// The runtime only keeps the most recent pauses, in a circular buffer
+	if newGCCount > uint32(len(memoryStats.PauseNs)) {
+		newGCCount = uint32(len(memoryStats.PauseNs))
+	}
+
+	latestPause := getGCPause(memoryStats, gcCount)
+	GCPauseMetric := NewMetricStatistic("GC_Pause", latestPause, MetricUnitMilliseconds)
+	if newGCCount > 0 {
+		minimumPause, maximumPause := latestPause, latestPause
+		for gcIndex := gcCount - newGCCount + 1; gcIndex < gcCount; gcIndex++ {
+			pause := getGCPause(memoryStats, gcIndex)
+			if pause < minimumPause {
+				minimumPause = pause
+			}
+			if pause > maximumPause {
+				maximumPause = pause
+			}
+		}
+		GCPauseMetric = GCPauseMetric.WithRange(minimumPause, maximumPause)
+	}
+	SendMetric(r.reportingChannel, GCPauseMetric.WithMetric("go_gc_pause_milliseconds", nil))
+
+	SendMetric(r.reportingChannel, NewMetricStatistic("GC_Pause_Total", float64(memoryStats.PauseTotalNs)/float64(time.Second), MetricUnitSeconds).
+		WithMetric("go_gc_pause_seconds_total", nil))
+}
+
+// getGCPause returns the pause of a garbage collection, counting from 1, in milliseconds
+func getGCPause(memoryStats *runtime.MemStats, gcIndex uint32) float64 {
+	return float64(memoryStats.PauseNs[(gcIndex+255)%uint32(len(memoryStats.PauseNs))]) / float64(time.Millisecond)
+}
+
+/*
+reportCPUUsage sends the CPU time used by the adapter and, from the second
+report on, the CPU it used since the last report as a percentage of one
+core, out of 100 for each core
+*/
+func (r *RuntimeMetricsReporter) reportCPUUsage() {
+
+	CPUTime, ok := getProcessCPUTime()
+	if !ok {
+		return
+	}
+	reportTime := time.Now()
+
+	SendMetric(r.reportingChannel, NewMetricStatistic("CPU_Time", CPUTime.Seconds(), MetricUnitSeconds).
+		WithMetric("process_cpu_seconds_total", nil))
+
+	if !r.lastReportTime.IsZero() {
+		if elapsedTime := reportTime.Sub(r.lastReportTime); elapsedTime > 0 {
+			CPUUsage := float64(CPUTime-r.lastCPUTime) / float64(elapsedTime) * 100
+			SendMetric(r.reportingChannel, NewMetricStatistic("CPU_Usage", CPUUsage, MetricUnitPercent).WithCapacity(float64(100*runtime.NumCPU())).
+				WithMetric("process_cpu_usage_percent", nil))
+		}
+	}
+
+	r.lastCPUTime = CPUTime
+	r.lastReportTime = reportTime
+}
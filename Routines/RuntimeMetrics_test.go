@@ -0,0 +1,80 @@
+package Routines
+
+import (
+	"encoding/json"
+	"runtime"
+	"testing"
+)
+
+/*
+takeTestReport runs one runtime report, returning the metrics sent by name
+*/
+func takeTestReport(t *testing.T, runtimeMetricsReporter *RuntimeMetricsReporter, reportingChannel chan string) map[string]MetricStatistic {
+	runtimeMetricsReporter.Report()
+
+	metrics := make(map[string]MetricStatistic)
+	for len(reportingChannel) > 0 {
+		var systemMetric SystemMetric
+		if err := json.Unmarshal([]byte(<-reportingChannel), &systemMetric); err != nil {
+			t.Fatalf("could not read the report: %v", err)
+		}
+		metrics[systemMetric.Metric.StatName] = systemMetric.Metric
+	}
+	return metrics
+}
+
+func TestRuntimeMetricsReport(t *testing.T) {
+	reportingChannel := make(chan string, 100)
+	runtimeMetricsReporter := NewRuntimeMetricsReporter(reportingChannel)
+	runtime.GC()
+
+	metrics := takeTestReport(t, runtimeMetricsReporter, reportingChannel)
+	for _, statName := range []string{"Goroutines", "Heap_Allocated_Bytes", "Heap_In_Use_Bytes", "Heap_Objects", "GC_Cycles", "GC_Pause", "GC_Pause_Total"} {
+		if _, reported := metrics[statName]; !reported {
+			t.Errorf("%s was not reported", statName)
+		}
+	}
+	if metrics["Goroutines"].Value < 1 || metrics["GC_Cycles"].Value < 1 {
+		t.Errorf("reported %v goroutines and %v garbage collections, want at least one of each", metrics["Goroutines"].Value, metrics["GC_Cycles"].Value)
+	}
+	if metrics["GC_Pause"].Min == nil {
+		t.Error("GC_Pause was reported without the range of the collections since the last report")
+	}
+
+	// Usage is measured between reports so only comes with the second
+	if _, reported := metrics["CPU_Usage"]; reported {
+		t.Error("CPU_Usage was reported without a previous report")
+	}
+	if _, CPUTimeKnown := getProcessCPUTime(); CPUTimeKnown {
+		metrics = takeTestReport(t, runtimeMetricsReporter, reportingChannel)
+		if _, reported := metrics["CPU_Usage"]; !reported {
+			t.Error("CPU_Usage was not reported by the second report")
+		}
+	}
+}
+
+func TestParseProfilingConfig(t *testing.T) {
+	testCases := []struct {
+		name        string
+		configJson  map[string]interface{}
+		wantEnabled bool
+		wantAddress string
+		wantError   bool
+	}{
+		{"not configured", map[string]interface{}{}, false, "localhost:6060", false},
+		{"enabled", map[string]interface{}{"ProfilingConfig": map[string]interface{}{"Enabled": "True"}}, true, "localhost:6060", false},
+		{"other address", map[string]interface{}{"ProfilingConfig": map[string]interface{}{"Enabled": "True", "Address": "0.0.0.0:7070"}}, true, "0.0.0.0:7070", false},
+		{"empty address", map[string]interface{}{"ProfilingConfig": map[string]interface{}{"Address": ""}}, false, "", true},
+		{"enabled not a bool", map[string]interface{}{"ProfilingConfig": map[string]interface{}{"Enabled": "on"}}, false, "", true},
+	}
+	for _, testCase := range testCases {
+		profilingConfig, err := ParseProfilingConfig(testCase.configJson)
+		if (err != nil) != testCase.wantError {
+			t.Errorf("%s: got error %v, want error %v", testCase.name, err, testCase.wantError)
+			continue
+		}
+		if !testCase.wantError && (profilingConfig.Enabled != testCase.wantEnabled || profilingConfig.Address != testCase.wantAddress) {
+			t.Errorf("%s: got %+v, want enabled %v on %s", testCase.name, profilingConfig, testCase.wantEnabled, testCase.wantAddress)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package Routines
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+)
+
+// How often an idle event stream gets a comment so proxies keep it open
+const serverSentEventKeepAliveInterval = 15 * time.Second
+
+/*
+HandleServerSentEvents streams a chunk type to a client that cannot use
+WebSockets. Each event carries the chunk sequence number as its id so a
+reconnecting client can send Last-Event-ID and be replayed whatever it
+missed that is still in the chunk history
+*/
+func (s *ChunkTypeToChannelMap) HandleServerSentEvents(loggingChannel chan map[zerolog.Level]string, c *gin.Context, chunkTypeString string) {
+
+	loggingChannel <- CreateLogMessage(zerolog.InfoLevel, "Client opening event stream on "+s.serverSentEventsRoutePrefix+chunkTypeString)
+
+	lastEventID := GetLastEventID(c.Request)
+
+	// Sequence numbers start again when the adapter restarts so an id from
+	// the future means the client saw a previous run and should get everything
+	if lastEventID > s.GetSequenceNumber(chunkTypeString) {
+		lastEventID = 0
+	}
+
+	c.Header("Content-Type", sse.ContentType)
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	// Subscribe before replaying so nothing arriving during the replay is missed
+	subscriber := NewChunkSubscriber(GetClientHost(c.Request.RemoteAddr), chunkTypeString, s.serverConfig.SlowConsumer.ClientQueueCapacity)
+	s.AddSubscriber(subscriber)
+	defer s.RemoveSubscriber(subscriber)
+
+	// A reconnecting client gets everything after its last event and a new
+	// one gets the configured history
+	var replayChunks []*RoutedChunk
+	if lastEventID > 0 {
+		if chunkHistory, exists := s.TryGetChunkHistory(chunkTypeString); exists {
+			replayChunks = chunkHistory.GetAfterSequenceNumber(lastEventID)
+		}
+	} else {
+		replayChunks = s.GetReplayChunks(chunkTypeString)
+	}
+
+	for _, chunk := range replayChunks {
+		if err := WriteServerSentEvent(c.Writer, chunkTypeString, chunk); err != nil {
+			loggingChannel <- CreateLogMessage(zerolog.WarnLevel, "Issue replaying history to "+s.serverSentEventsRoutePrefix+chunkTypeString+":"+err.Error())
+			return
+		}
+		lastEventID = chunk.SequenceNumber
+	}
+	c.Writer.Flush()
+
+	// Stop proxies from timing out quiet streams
+	keepAliveTicker := time.NewTicker(serverSentEventKeepAliveInterval)
+	defer keepAliveTicker.Stop()
+
+	// Check the state straight away so clients joining a stale type are told
+	chunkTypeStale := false
+	var chunkTypeStateChanged <-chan struct{} = closedChannel
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			loggingChannel <- CreateLogMessage(zerolog.InfoLevel, "Client closed event stream on "+s.serverSentEventsRoutePrefix+chunkTypeString)
+			return
+
+		case <-subscriber.Disconnected():
+			// The slow consumer policy has given up on this client
+			return
+
+		case chunk := <-subscriber.Queue():
+			// The client already has this chunk from before it reconnected
+			if chunk.SequenceNumber <= lastEventID {
+				continue
+			}
+
+			if err := WriteServerSentEvent(c.Writer, chunkTypeString, chunk); err != nil {
+				loggingChannel <- CreateLogMessage(zerolog.WarnLevel, "Issue writing event to "+s.serverSentEventsRoutePrefix+chunkTypeString+":"+err.Error())
+				return
+			}
+			lastEventID = chunk.SequenceNumber
+
+		case <-chunkTypeStateChanged:
+			// Let the client know if this chunk type went idle or came back
+			var stale bool
+			stale, chunkTypeStateChanged = s.GetChunkTypeState(chunkTypeString)
+			if stale == chunkTypeStale {
+				continue
+			}
+			chunkTypeStale = stale
+
+			err := sse.Encode(c.Writer, sse.Event{
+				Event: "ChunkTypeStatus",
+				Data:  CreateChunkTypeStatusMessage(chunkTypeString, stale),
+			})
+			if err != nil {
+				return
+			}
+
+		case <-keepAliveTicker.C:
+			if _, err := io.WriteString(c.Writer, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+
+		c.Writer.Flush()
+	}
+}
+
+func WriteServerSentEvent(w io.Writer, chunkTypeString string, chunk *RoutedChunk) error {
+	return sse.Encode(w, sse.Event{
+		Id:    strconv.FormatUint(chunk.SequenceNumber, 10),
+		Event: chunkTypeString,
+		Data:  chunk.JSONString,
+	})
+}
+
+/*
+GetLastEventID reads the id a reconnecting client last saw. Browsers send it
+as a header but the query parameter lets scripts resume too
+
+returns zero when the client has not seen any events
+*/
+func GetLastEventID(request *http.Request) uint64 {
+	lastEventIDString := request.Header.Get("Last-Event-ID")
+	if lastEventIDString == "" {
+		lastEventIDString = request.URL.Query().Get("lastEventId")
+	}
+
+	lastEventID, err := strconv.ParseUint(lastEventIDString, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return lastEventID
+}
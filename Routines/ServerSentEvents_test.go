@@ -0,0 +1,103 @@
+package Routines
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetLastEventID(t *testing.T) {
+	testCases := []struct {
+		name            string
+		header          string
+		query           string
+		wantLastEventID uint64
+	}{
+		{"new client", "", "", 0},
+		{"header", "42", "", 42},
+		{"query parameter", "", "?lastEventId=7", 7},
+		{"header wins over query parameter", "42", "?lastEventId=7", 42},
+		{"not a number", "abc", "", 0},
+	}
+	for _, testCase := range testCases {
+		request := httptest.NewRequest(http.MethodGet, "/sse/TimeChunk"+testCase.query, nil)
+		if testCase.header != "" {
+			request.Header.Set("Last-Event-ID", testCase.header)
+		}
+		if lastEventID := GetLastEventID(request); lastEventID != testCase.wantLastEventID {
+			t.Errorf("%s: got %d, want %d", testCase.name, lastEventID, testCase.wantLastEventID)
+		}
+	}
+}
+
+/*
+receiveFirstEventID opens an event stream resuming from lastEventID and
+routes chunks until the first event arrives, returning its id
+*/
+func receiveFirstEventID(t *testing.T, chunkRouter *testChunkRouter, serverURL string, lastEventID string) uint64 {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	request, _ := http.NewRequestWithContext(ctx, http.MethodGet, serverURL+"/sse/TimeChunk", nil)
+	request.Header.Set("Last-Event-ID", lastEventID)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("could not open event stream: %v", err)
+	}
+	defer response.Body.Close()
+
+	eventIDs := make(chan uint64, 1)
+	go func() {
+		scanner := bufio.NewScanner(response.Body)
+		for scanner.Scan() {
+			if eventID, isID := strings.CutPrefix(scanner.Text(), "id:"); isID {
+				sequenceNumber, _ := strconv.ParseUint(eventID, 10, 64)
+				eventIDs <- sequenceNumber
+				return
+			}
+		}
+	}()
+
+	// Keep routing until the stream is reading so no event depends on timing
+	for i := 0; i < 100; i++ {
+		chunkRouter.sendChunk("TimeChunk", `{"TimeChunk":{"SourceIdentifier":"0a"}}`)
+		select {
+		case eventID := <-eventIDs:
+			return eventID
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	t.Fatal("no event was streamed")
+	return 0
+}
+
+func TestServerSentEventsResumeAfterLastEventID(t *testing.T) {
+	chunkRouter := newTestChunkRouter(t, newTestServerConfig(t, nil))
+
+	// Routes are registered with the first chunks, before the server starts
+	for i := 0; i < 3; i++ {
+		chunkRouter.sendChunk("TimeChunk", `{"TimeChunk":{"SourceIdentifier":"0a"}}`)
+	}
+	seenSequenceNumber := chunkRouter.chunkTypeRoutingMap.GetSequenceNumber("TimeChunk")
+	if seenSequenceNumber == 0 {
+		t.Fatal("no chunks were given sequence numbers")
+	}
+
+	server := httptest.NewServer(chunkRouter.router)
+	defer server.Close()
+
+	if eventID := receiveFirstEventID(t, chunkRouter, server.URL, strconv.FormatUint(seenSequenceNumber, 10)); eventID <= seenSequenceNumber {
+		t.Errorf("resumed client was sent event %d, it had already seen up to %d", eventID, seenSequenceNumber)
+	}
+
+	// An id from before a restart is ahead of the adapter and is ignored
+	futureSequenceNumber := chunkRouter.chunkTypeRoutingMap.GetSequenceNumber("TimeChunk") + 1000
+	if eventID := receiveFirstEventID(t, chunkRouter, server.URL, strconv.FormatUint(futureSequenceNumber, 10)); eventID >= futureSequenceNumber {
+		t.Errorf("client from a previous run was sent event %d, want the stream to start again", eventID)
+	}
+}
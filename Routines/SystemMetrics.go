@@ -0,0 +1,169 @@
+package Routines
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+SystemMetric is the typed form of SystemInfo. Values are numbers so UIs do
+not have to parse strings like "12/1000"
+
+	{ "SystemMetric": { "StatEnvironment": "TCP_WS_Adapter", "StatName": "TimeChunk_Channel",
+	  "Value": 12, "Unit": "chunks", "Capacity": 1000, "Timestamp": 1700000000000, "Severity": "Info" } }
+
+The reporting routine also routes every metric of the adapter as a legacy
+SystemInfo message for older UIs.
+Metrics that should be scraped by Prometheus also carry a Metric name and
+Labels, and those whose name ends in _total are exposed as counters
+*/
+
+type MetricSeverity string
+
+const (
+	MetricSeverityInfo    MetricSeverity = "Info"
+	MetricSeverityWarning MetricSeverity = "Warning"
+	MetricSeverityError   MetricSeverity = "Error"
+)
+
+// Environment the adapter reports its own statistics under
+const AdapterStatEnvironment = "TCP_WS_Adapter"
+
+// Units used by the adapter's own metrics
+const (
+	MetricUnitChunks          = "chunks"
+	MetricUnitClients         = "clients"
+	MetricUnitBytes           = "bytes"
+	MetricUnitChunksPerSecond = "chunks/s"
+	MetricUnitBytesPerSecond  = "bytes/s"
+	MetricUnitConnections     = "connections"
+	MetricUnitMilliseconds    = "ms"
+	MetricUnitSeconds         = "s"
+	MetricUnitPercent         = "%"
+)
+
+type MetricStatistic struct {
+	StatEnvironment string            `json:"StatEnvironment"`
+	StatName        string            `json:"StatName"`
+	Value           float64           `json:"Value"`
+	Unit            string            `json:"Unit,omitempty"`
+	Min             *float64          `json:"Min,omitempty"`
+	Max             *float64          `json:"Max,omitempty"`
+	Capacity        *float64          `json:"Capacity,omitempty"`
+	Timestamp       int64             `json:"Timestamp"` // Unix time in milliseconds
+	Severity        MetricSeverity    `json:"Severity"`
+	Metric          string            `json:"Metric,omitempty"` // Prometheus metric name
+	Labels          map[string]string `json:"Labels,omitempty"` // Prometheus labels
+}
+
+type SystemMetric struct {
+	Metric MetricStatistic `json:"SystemMetric"`
+}
+
+/*
+NewMetricStatistic creates an informational metric of the adapter stamped
+with the current time
+*/
+func NewMetricStatistic(statName string, value float64, unit string) MetricStatistic {
+	return MetricStatistic{
+		StatEnvironment: AdapterStatEnvironment,
+		StatName:        statName,
+		Value:           value,
+		Unit:            unit,
+		Timestamp:       time.Now().UnixMilli(),
+		Severity:        MetricSeverityInfo,
+	}
+}
+
+/*
+WithCapacity sets the capacity of a metric and raises its severity as the
+value approaches it
+*/
+func (m MetricStatistic) WithCapacity(capacity float64) MetricStatistic {
+	m.Capacity = &capacity
+	if capacity > 0 {
+		switch usage := m.Value / capacity; {
+		case usage >= 0.9:
+			m.Severity = MetricSeverityError
+		case usage >= 0.75:
+			m.Severity = MetricSeverityWarning
+		}
+	}
+	return m
+}
+
+func (m MetricStatistic) WithRange(min float64, max float64) MetricStatistic {
+	m.Min = &min
+	m.Max = &max
+	return m
+}
+
+func (m MetricStatistic) WithSeverity(severity MetricSeverity) MetricStatistic {
+	m.Severity = severity
+	return m
+}
+
+/*
+WithMetric names the Prometheus metric a value is exposed as. Names ending
+in _total are counters and everything else is a gauge
+*/
+func (m MetricStatistic) WithMetric(metric string, labels map[string]string) MetricStatistic {
+	m.Metric = metric
+	m.Labels = labels
+	return m
+}
+
+/*
+GetLegacyStatus formats a metric the way SystemInfo always has, as
+"value/capacity" when there is a capacity and just the value otherwise
+*/
+func (m MetricStatistic) GetLegacyStatus() string {
+	status := strconv.FormatFloat(m.Value, 'f', -1, 64)
+	if m.Capacity != nil {
+		status += "/" + strconv.FormatFloat(*m.Capacity, 'f', -1, 64)
+	}
+	return status
+}
+
+/*
+SendMetric sends a metric to reporting as a SystemMetric message. The
+legacy SystemInfo message is made from it by the reporting routine, so each
+metric only takes one place in the reporting channel
+*/
+func SendMetric(reportingChannel chan<- string, metric MetricStatistic) {
+
+	data, _ := json.Marshal(SystemMetric{Metric: metric})
+	reportingChannel <- string(data)
+}
+
+/*
+SystemStatRemoval tells the reporting routine that statistics will not be
+reported again, such as those of a client that has disconnected, so they are
+forgotten straight away rather than left to expire
+
+	{ "SystemStatRemoval": { "StatEnvironment": "TCP_WS_Adapter", "StatNamePrefix": "TimeChunk_Client_10.0.0.5_" } }
+
+Removals are consumed by the reporting routine and not routed to clients
+*/
+type SystemStatRemoval struct {
+	Removal StatRemoval `json:"SystemStatRemoval"`
+}
+
+type StatRemoval struct {
+	StatEnvironment string `json:"StatEnvironment"`
+	StatNamePrefix  string `json:"StatNamePrefix"` // Every statistic whose name starts with this is removed
+}
+
+/*
+Matches reports whether a statistic is one of those removed
+*/
+func (r StatRemoval) Matches(statEnvironment string, statName string) bool {
+	return statEnvironment == r.StatEnvironment && strings.HasPrefix(statName, r.StatNamePrefix)
+}
+
+func SendStatRemoval(reportingChannel chan<- string, statEnvironment string, statNamePrefix string) {
+	data, _ := json.Marshal(SystemStatRemoval{Removal: StatRemoval{StatEnvironment: statEnvironment, StatNamePrefix: statNamePrefix}})
+	reportingChannel <- string(data)
+}
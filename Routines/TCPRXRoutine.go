@@ -4,16 +4,48 @@ import (
 	"encoding/binary"
 	"net"
 	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
 	"github.com/rs/zerolog"
 )
 
+/*
+TCPReceiveCounters are reported every second so the health of the producer
+connections shows up on the reporting stream
+*/
+type TCPReceiveCounters struct {
+	OpenConnections		atomic.Int64	// Producer connections currently open
+	AcceptedConnections	atomic.Uint64	// Producer connections accepted since start up
+	ReassemblyResets	atomic.Uint64	// Times reassembly was abandoned after missing bytes
+}
+
+func (c *TCPReceiveCounters) Report(reportingChannel chan<- string) {
+	SendMetric(reportingChannel, NewMetricStatistic("TCP_Open_Connections", float64(c.OpenConnections.Load()), MetricUnitConnections).
+		WithMetric("tcp_connections", nil))
+	SendMetric(reportingChannel, NewMetricStatistic("TCP_Accepted_Connections", float64(c.AcceptedConnections.Load()), MetricUnitConnections).
+		WithMetric("tcp_connections_accepted_total", nil))
+	SendMetric(reportingChannel, NewMetricStatistic("TCP_Reassembly_Resets", float64(c.ReassemblyResets.Load()), "resets").
+		WithMetric("tcp_reassembly_resets_total", nil))
+}
+
+// RunReporter reports the counters every second
+func (c *TCPReceiveCounters) RunReporter(reportingChannel chan<- string) {
+	reportingTicker := time.NewTicker(1000 * time.Millisecond)
+	defer reportingTicker.Stop()
+
+	for range reportingTicker.C {
+		c.Report(reportingChannel)
+	}
+}
+
 /*
 getSessionStates is a partial implementation to extract transmission states of TCP and UDP Headers
 
 returns [transmissionState, sessionNumber, sequenceNumber, transmissionSize]
 */
 
-func HandleTCPReceivals(configJson map[string]interface{}, loggingChannel chan map[zerolog.Level]string, dataChannel chan<- string) {
+func HandleTCPReceivals(configJson map[string]interface{}, loggingChannel chan map[zerolog.Level]string, dataChannel chan<- ReceivedChunk, reportingChannel chan<- string, controlCommandChannel <-chan ControlCommand, healthRegistry *HealthRegistry) {
 
 	// Define the TCP port to listen on
 	var port string
@@ -28,144 +60,181 @@ func HandleTCPReceivals(configJson map[string]interface{}, loggingChannel chan m
 	// Create a TCP listener on the specified port
 	listener, err := net.Listen("tcp", ":"+port)
 	if err != nil {
+		healthRegistry.SetReady(HealthRoutineTCPRx, false, "Error listening on port "+port+":"+err.Error())
 		loggingChannel <- CreateLogMessage(zerolog.FatalLevel, "Error:"+err.Error())
 		os.Exit(1)
 	}
 	defer listener.Close()
 	loggingChannel <- CreateLogMessage(zerolog.InfoLevel, "TCP server is listening on port:"+port)
+	healthRegistry.SetReady(HealthRoutineTCPRx, true, "Listening on port "+port)
+
+	// Commands from the UI go back down whichever connection their producer was last seen on
+	controlConnections := NewControlConnectionRegistry()
+	go RunControlCommandWriter(loggingChannel, controlCommandChannel, controlConnections)
+
+	var receiveCounters TCPReceiveCounters
+	go receiveCounters.RunReporter(reportingChannel)
+
+	// The routine is alive while its read loops keep getting back to reading
+	readWatchdog := NewTCPReadWatchdog()
+	go readWatchdog.Run(healthRegistry)
 
 	for {
 
 		conn, err := listener.Accept()
 		if err != nil {
 			loggingChannel <- CreateLogMessage(zerolog.ErrorLevel, "Error:"+err.Error())
+			continue
 		}
 		loggingChannel <- CreateLogMessage(zerolog.InfoLevel, "TCP server is connected on port:"+port)
+		receiveCounters.AcceptedConnections.Add(1)
+
+		go handleTCPConnection(loggingChannel, conn, dataChannel, controlConnections, &receiveCounters, readWatchdog)
+	}
+}
+
+/*
+handleTCPConnection reassembles chunks from one producer connection until it
+is closed or fails to read, after which control commands for its producers
+are refused until they connect again
+*/
+func handleTCPConnection(loggingChannel chan map[zerolog.Level]string, conn net.Conn, dataChannel chan<- ReceivedChunk, controlConnections *ControlConnectionRegistry, receiveCounters *TCPReceiveCounters, readWatchdog *TCPReadWatchdog) {
+
+	receiveCounters.OpenConnections.Add(1)
+	defer receiveCounters.OpenConnections.Add(-1)
+	defer conn.Close()
 
-		// Accept incoming TCP connections
-		defer conn.Close()
+	readProgress := readWatchdog.Track()
+	defer readWatchdog.Forget(readProgress)
 
-		// Create a buffer to read incoming data
+	previousSessionNumber := uint32(0)
+	previousSequenceNumber := uint32(0)
+	sessionContinuous := false
+	newSequence := false
+	LastInSequence := false
 
-		previousSessionNumber := uint32(0)
-		previousSequenceNumber := uint32(0)
-		sessionContinuous := false
-		newSequence := false
-		LastInSequence := false
+	var JSONByteArray []byte
+	var byteArray []byte
+
+readLoop:
+	for {
 
+		// Read data from the connection into the buffer
+		buffer := make([]byte, 512)
+		readProgress.SetWaiting()
+		bytesRead, err := conn.Read(buffer)
+		readProgress.SetProcessing(time.Now())
+		if bytesRead == 0 {
+			loggingChannel <- CreateLogMessage(zerolog.ErrorLevel, "Connection from "+conn.RemoteAddr().String()+" closed")
+			break readLoop
+		} else if err != nil {
+			loggingChannel <- CreateLogMessage(zerolog.ErrorLevel, "Error reading:"+err.Error())
+			break readLoop
+		}
+
+		byteArray = append(byteArray, buffer[:bytesRead]...)
+
+		// check if byte array is large enough
 		for {
-			
-			var JSONByteArray []byte
-			var byteArray []byte	
-		
-			for {
-
-				if len(JSONByteArray) == 0 && len(byteArray) == 0{
-					break
-				}
 
-				// Read data from the connection into the buffer
-				buffer := make([]byte, 512)
-				bytesRead, err := conn.Read(buffer)
-				if bytesRead == 0 {
-					loggingChannel <- CreateLogMessage(zerolog.ErrorLevel, "Connection from "+conn.RemoteAddr().String()+" closed")
-					break
-				} else if err != nil {
-					loggingChannel <- CreateLogMessage(zerolog.ErrorLevel, "Error reading:"+err.Error())
-					break
-				}
+			if len(byteArray) < 512{
+				break
+			}
+
+			// Expected byte Format
+			// |Transport Header(2)| [Session Header(23)|Session Data(x)] |
 
-				byteArray = append(byteArray, buffer[:bytesRead]...)
-			
-				// check if byte array is large enough
-				for {
-
-					if len(byteArray) < 512{
-						break
-					}
-
-					// Expected byte Format
-					// |Transport Header(2)| [Session Header(23)|Session Data(x)] |
-
-					// Lets first check how many bytes in the transport layer message
-					TransportLayerHeaderSize_bytes := 2
-					TransportLayerDataSize := binary.LittleEndian.Uint16(byteArray[:TransportLayerHeaderSize_bytes])
-					if TransportLayerDataSize > 512 {
-						continue
-					}
-
-					//loggingChannel <- CreateLogMessage(zerolog.DebugLevel, "TransportLayerDataSize:"+fmt.Sprint(TransportLayerDataSize))
-
-					// The carry on and extract session state information (v1.0.0 of chunk types)
-					SessionLayerHeaderSize_bytes := 23
-					transmissionSize := TransportLayerDataSize
-					TCPHeaderBytes := byteArray[TransportLayerHeaderSize_bytes : SessionLayerHeaderSize_bytes+TransportLayerHeaderSize_bytes]
-					transmissionState, sessionNumber, sequenceNumber := ConvertBytesToSessionStates(TCPHeaderBytes)
-					// loggingChannel <- CreateLogMessage(zerolog.DebugLevel, "States: Transmission State "+string(transmissionState)+
-					// 	" Session Number "+fmt.Sprint(sessionNumber)+
-					// 	" Sequence Number "+fmt.Sprint(sequenceNumber)+
-					// 	" Transmission Size "+fmt.Sprint(transmissionSize))
-
-					// Now we check if the Session in continuous
-					sessionContinuous, newSequence, LastInSequence, previousSessionNumber, previousSequenceNumber =
-						CheckSessionContinuity(transmissionState, sessionNumber, sequenceNumber, previousSessionNumber, previousSequenceNumber)
-					// loggingChannel <- CreateLogMessage(zerolog.DebugLevel, "States: sessionContinuous "+fmt.Sprint(sessionContinuous)+
-					// 	" newSequence "+fmt.Sprint(newSequence)+
-					// 	" LastInSequence "+fmt.Sprint(LastInSequence))
-
-					if newSequence && LastInSequence {
-						JSONStartIndex := GetJSONStartIndex()
-
-						JSONByteArray = byteArray[TransportLayerHeaderSize_bytes+SessionLayerHeaderSize_bytes+JSONStartIndex : transmissionSize]
-						str := string(JSONByteArray)
-						dataChannel <- str
-
-						JSONByteArray = nil
-					} else if newSequence && sessionContinuous {
-						// Lets start a new receipt sequence
-						JSONStartIndex := GetJSONStartIndex()
-
-						JSONByteArray = byteArray[TransportLayerHeaderSize_bytes+SessionLayerHeaderSize_bytes+JSONStartIndex : transmissionSize]
-
-					} else if sessionContinuous && !LastInSequence {
-						// Lets keep accumulating data as we have not finished this continuos sequence
-						JSONStartIndex := 0
-						JSONByteArray = append(JSONByteArray,
-							byteArray[TransportLayerHeaderSize_bytes+SessionLayerHeaderSize_bytes+JSONStartIndex:transmissionSize]...)
-
-					} else if sessionContinuous && LastInSequence {
-						// We have finished the sequence so we can pass on
-						JSONStartIndex := 0
-						JSONByteArray = append(JSONByteArray,
-							byteArray[TransportLayerHeaderSize_bytes+SessionLayerHeaderSize_bytes+JSONStartIndex:transmissionSize]...)
-
-						str := string(JSONByteArray)
-						dataChannel <- str
-
-						JSONByteArray = nil
-					} else {
-						// There was some error so lets reset
-						JSONByteArray = nil
-
-						// The reset all states
-						previousSessionNumber = uint32(0)
-						previousSequenceNumber = uint32(0)
-						sessionContinuous = false
-						newSequence = false
-						LastInSequence = false
-
-						loggingChannel <- CreateLogMessage(zerolog.WarnLevel, "Missed bytes, resetting")
-					}
-
-					byteArray = byteArray[TransportLayerDataSize:]
+			// Lets first check how many bytes in the transport layer message
+			TransportLayerHeaderSize_bytes := 2
+			SessionLayerHeaderSize_bytes := 23
+			TransportLayerDataSize := binary.LittleEndian.Uint16(byteArray[:TransportLayerHeaderSize_bytes])
+
+			// A size outside the headers and buffer means we no longer know where frames start, so give up on the connection
+			if int(TransportLayerDataSize) < TransportLayerHeaderSize_bytes+SessionLayerHeaderSize_bytes+GetJSONStartIndex() || TransportLayerDataSize > 512 {
+				receiveCounters.ReassemblyResets.Add(1)
+				loggingChannel <- CreateLogMessage(zerolog.WarnLevel, "Invalid transmission size "+strconv.Itoa(int(TransportLayerDataSize))+" from "+conn.RemoteAddr().String()+", closing connection")
+				break readLoop
+			}
 
+			//loggingChannel <- CreateLogMessage(zerolog.DebugLevel, "TransportLayerDataSize:"+fmt.Sprint(TransportLayerDataSize))
+
+			// The carry on and extract session state information (v1.0.0 of chunk types)
+			transmissionSize := TransportLayerDataSize
+			TCPHeaderBytes := byteArray[TransportLayerHeaderSize_bytes : SessionLayerHeaderSize_bytes+TransportLayerHeaderSize_bytes]
+			transmissionState, sessionNumber, sequenceNumber := ConvertBytesToSessionStates(TCPHeaderBytes)
+
+			// loggingChannel <- CreateLogMessage(zerolog.DebugLevel, "States: Transmission State "+string(transmissionState)+
+			// 	" Session Number "+fmt.Sprint(sessionNumber)+
+			// 	" Sequence Number "+fmt.Sprint(sequenceNumber)+
+			// 	" Transmission Size "+fmt.Sprint(transmissionSize))
+
+			// Now we check if the Session in continuous
+			sessionContinuous, newSequence, LastInSequence, previousSessionNumber, previousSequenceNumber =
+				CheckSessionContinuity(transmissionState, sessionNumber, sequenceNumber, previousSessionNumber, previousSequenceNumber)
+			// loggingChannel <- CreateLogMessage(zerolog.DebugLevel, "States: sessionContinuous "+fmt.Sprint(sessionContinuous)+
+			// 	" newSequence "+fmt.Sprint(newSequence)+
+			// 	" LastInSequence "+fmt.Sprint(LastInSequence))
+
+			// Remember where this producer is so control commands can reach it, only trusting frames that start a sequence cleanly
+			if newSequence && sessionContinuous {
+				sourceIdentifier := GetSourceIdentifier(TCPHeaderBytes)
+				if controlConnections.RegisterConnection(sourceIdentifier, conn) {
+					loggingChannel <- CreateLogMessage(zerolog.InfoLevel, "Source "+sourceIdentifier+" seen on "+conn.RemoteAddr().String())
 				}
 			}
-			
+
+			if newSequence && LastInSequence {
+				JSONStartIndex := GetJSONStartIndex()
+
+				JSONByteArray = byteArray[TransportLayerHeaderSize_bytes+SessionLayerHeaderSize_bytes+JSONStartIndex : transmissionSize]
+				// Stamped as soon as the chunk is whole so latency covers everything after reassembly
+				dataChannel <- NewReceivedChunk(string(JSONByteArray))
+
+				JSONByteArray = nil
+			} else if newSequence && sessionContinuous {
+				// Lets start a new receipt sequence
+				JSONStartIndex := GetJSONStartIndex()
+
+				JSONByteArray = byteArray[TransportLayerHeaderSize_bytes+SessionLayerHeaderSize_bytes+JSONStartIndex : transmissionSize]
+
+			} else if sessionContinuous && !LastInSequence {
+				// Lets keep accumulating data as we have not finished this continuos sequence
+				JSONStartIndex := 0
+				JSONByteArray = append(JSONByteArray,
+					byteArray[TransportLayerHeaderSize_bytes+SessionLayerHeaderSize_bytes+JSONStartIndex:transmissionSize]...)
+
+			} else if sessionContinuous && LastInSequence {
+				// We have finished the sequence so we can pass on
+				JSONStartIndex := 0
+				JSONByteArray = append(JSONByteArray,
+					byteArray[TransportLayerHeaderSize_bytes+SessionLayerHeaderSize_bytes+JSONStartIndex:transmissionSize]...)
+
+				// Stamped as soon as the chunk is whole so latency covers everything after reassembly
+				dataChannel <- NewReceivedChunk(string(JSONByteArray))
+
+				JSONByteArray = nil
+			} else {
+				// There was some error so lets reset
+				JSONByteArray = nil
+
+				// The reset all states
+				previousSessionNumber = uint32(0)
+				previousSequenceNumber = uint32(0)
+				sessionContinuous = false
+				newSequence = false
+				LastInSequence = false
+
+				receiveCounters.ReassemblyResets.Add(1)
+				loggingChannel <- CreateLogMessage(zerolog.WarnLevel, "Missed bytes, resetting")
+			}
+
+			byteArray = byteArray[TransportLayerDataSize:]
+
 		}
-		loggingChannel <- CreateLogMessage(zerolog.ErrorLevel, "TCP server still listening on port:"+port)
 	}
 
+	// Commands must not be written to a connection that is being closed
+	controlConnections.RemoveConnection(conn)
 }
 
 func ConvertBytesToSessionStates(byteArray []byte) (byte, uint32, uint32) {
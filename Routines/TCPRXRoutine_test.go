@@ -0,0 +1,184 @@
+package Routines
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTCPConnectionIsCountedUntilItCloses(t *testing.T) {
+	loggingChannel := newTestLoggingChannel(t)
+	var receiveCounters TCPReceiveCounters
+
+	serverConnection, producerConnection := net.Pipe()
+	connectionHandled := make(chan struct{})
+	go func() {
+		handleTCPConnection(loggingChannel, serverConnection, make(chan ReceivedChunk, 1), NewControlConnectionRegistry(), &receiveCounters, NewTCPReadWatchdog())
+		close(connectionHandled)
+	}()
+
+	// The handler is reading once a write goes through
+	producerConnection.Write([]byte{0})
+	if openConnections := receiveCounters.OpenConnections.Load(); openConnections != 1 {
+		t.Fatalf("%d connections open while connected, want 1", openConnections)
+	}
+
+	producerConnection.Close()
+	select {
+	case <-connectionHandled:
+	case <-time.After(time.Second):
+		t.Fatal("handler did not return after the producer closed the connection")
+	}
+	if openConnections := receiveCounters.OpenConnections.Load(); openConnections != 0 {
+		t.Errorf("%d connections open after closing, want 0", openConnections)
+	}
+}
+
+func TestTCPConnectionIsForgottenForControlCommandsWhenItCloses(t *testing.T) {
+	loggingChannel := newTestLoggingChannel(t)
+	controlConnections := NewControlConnectionRegistry()
+	dataChannel := make(chan ReceivedChunk, 1)
+
+	serverConnection, producerConnection := net.Pipe()
+	connectionHandled := make(chan struct{})
+	go func() {
+		handleTCPConnection(loggingChannel, serverConnection, dataChannel, controlConnections, &TCPReceiveCounters{}, NewTCPReadWatchdog())
+		close(connectionHandled)
+	}()
+
+	// A single full frame, which the producer's source identifier is read from
+	frames, err := FrameControlCommand(make([]byte, controlFrameMaximumSize-controlTransportHeaderSize-controlSessionHeaderSize-controlCommandPrefixSize), 1, "0a0b0c0d0e0f")
+	if err != nil || len(frames) != 1 {
+		t.Fatalf("framing test data: %d frames, %v", len(frames), err)
+	}
+	producerConnection.Write(frames[0])
+	<-dataChannel
+
+	if conn, exists := controlConnections.TryGetConnection("0a0b0c0d0e0f"); !exists || conn != serverConnection {
+		t.Fatal("source was not registered against its connection")
+	}
+
+	producerConnection.Close()
+	<-connectionHandled
+	if _, exists := controlConnections.TryGetConnection("0a0b0c0d0e0f"); exists {
+		t.Error("source is still registered after its connection closed")
+	}
+}
+
+func TestTCPReadWatchdogNoticesStuckReadLoops(t *testing.T) {
+	loggingChannel := newTestLoggingChannel(t)
+	readWatchdog := NewTCPReadWatchdog()
+	// Nothing takes chunks off the data channel, so the read loop blocks handing one on
+	dataChannel := make(chan ReceivedChunk)
+
+	serverConnection, producerConnection := net.Pipe()
+	defer producerConnection.Close()
+	go handleTCPConnection(loggingChannel, serverConnection, dataChannel, NewControlConnectionRegistry(), &TCPReceiveCounters{}, readWatchdog)
+
+	// A quiet producer is not a stuck read loop
+	producerConnection.Write([]byte{0})
+	time.Sleep(10 * time.Millisecond)
+	if !readWatchdog.IsProgressing(time.Now().Add(tcpReadStallTimeout + time.Second)) {
+		t.Fatal("read loop waiting for data counted as stuck")
+	}
+
+	frames, err := FrameControlCommand(make([]byte, controlFrameMaximumSize-controlTransportHeaderSize-controlSessionHeaderSize-controlCommandPrefixSize), 1, "0a0b0c0d0e0f")
+	if err != nil || len(frames) != 1 {
+		t.Fatalf("framing test data: %d frames, %v", len(frames), err)
+	}
+	// The byte already sent is the first of the frame, the low byte of its 512 byte size
+	producerConnection.Write(frames[0][1:])
+
+	deadline := time.Now().Add(time.Second)
+	for readWatchdog.IsProgressing(time.Now().Add(tcpReadStallTimeout + time.Second)) {
+		if time.Now().After(deadline) {
+			t.Fatal("read loop blocked on the data channel was not noticed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// and it counts as progressing again once the chunk is taken
+	<-dataChannel
+	deadline = time.Now().Add(time.Second)
+	for !readWatchdog.IsProgressing(time.Now().Add(tcpReadStallTimeout + time.Second)) {
+		if time.Now().After(deadline) {
+			t.Fatal("read loop did not get back to reading")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestTCPConnectionWithAnInvalidTransmissionSizeIsClosed(t *testing.T) {
+	for _, transmissionSize := range []uint16{0, 10, 600} {
+		loggingChannel := newTestLoggingChannel(t)
+		controlConnections := NewControlConnectionRegistry()
+		dataChannel := make(chan ReceivedChunk, 1)
+		var receiveCounters TCPReceiveCounters
+
+		serverConnection, producerConnection := net.Pipe()
+		connectionHandled := make(chan struct{})
+		go func() {
+			handleTCPConnection(loggingChannel, serverConnection, dataChannel, controlConnections, &receiveCounters, NewTCPReadWatchdog())
+			close(connectionHandled)
+		}()
+
+		// A first frame of a session from a known source apart from its size
+		frames, err := FrameControlCommand(make([]byte, controlFrameMaximumSize-controlTransportHeaderSize-controlSessionHeaderSize-controlCommandPrefixSize), 1, "0a0b0c0d0e0f")
+		if err != nil || len(frames) != 1 {
+			t.Fatalf("framing test data: %d frames, %v", len(frames), err)
+		}
+		binary.LittleEndian.PutUint16(frames[0], transmissionSize)
+		go producerConnection.Write(frames[0])
+
+		select {
+		case <-connectionHandled:
+		case <-time.After(time.Second):
+			t.Fatalf("size %d: connection was not closed", transmissionSize)
+		}
+		producerConnection.Close()
+
+		if reassemblyResets := receiveCounters.ReassemblyResets.Load(); reassemblyResets != 1 {
+			t.Errorf("size %d: counted %d reassembly resets, want 1", transmissionSize, reassemblyResets)
+		}
+		if len(dataChannel) != 0 {
+			t.Errorf("size %d: a chunk was passed on", transmissionSize)
+		}
+		if _, exists := controlConnections.TryGetConnection("0a0b0c0d0e0f"); exists {
+			t.Errorf("size %d: source was registered from an invalid frame", transmissionSize)
+		}
+	}
+}
+
+func TestTCPConnectionIsOnlyRegisteredFromTheStartOfASequence(t *testing.T) {
+	loggingChannel := newTestLoggingChannel(t)
+	controlConnections := NewControlConnectionRegistry()
+	dataChannel := make(chan ReceivedChunk, 1)
+
+	serverConnection, producerConnection := net.Pipe()
+	defer producerConnection.Close()
+	go handleTCPConnection(loggingChannel, serverConnection, dataChannel, controlConnections, &TCPReceiveCounters{}, NewTCPReadWatchdog())
+
+	// Three full frames, as frames are only read once a whole buffer has arrived
+	maximumDataSize := controlFrameMaximumSize - controlTransportHeaderSize - controlSessionHeaderSize
+	frames, err := FrameControlCommand(make([]byte, 3*maximumDataSize-controlCommandPrefixSize), 1, "0a0b0c0d0e0f")
+	if err != nil || len(frames) != 3 {
+		t.Fatalf("framing test data: %d frames, %v", len(frames), err)
+	}
+
+	// A frame from the middle of a sequence cannot be told apart from noise. The
+	// next write only goes through once the handler is done with it
+	producerConnection.Write(frames[1])
+	producerConnection.Write(frames[0][:1])
+	if _, exists := controlConnections.TryGetConnection("0a0b0c0d0e0f"); exists {
+		t.Fatal("source was registered from a frame that does not start a sequence")
+	}
+
+	producerConnection.Write(frames[0][1:])
+	producerConnection.Write(frames[1])
+	producerConnection.Write(frames[2])
+	<-dataChannel
+	if conn, exists := controlConnections.TryGetConnection("0a0b0c0d0e0f"); !exists || conn != serverConnection {
+		t.Error("source was not registered from the first frame of a sequence")
+	}
+}
@@ -0,0 +1,108 @@
+package Routines
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+The TCP routine spends its time blocked in Accept and Read, so it cannot
+beat its own heartbeat on a timer. Instead each connection's read loop marks
+when it leaves Read to process what arrived and when it goes back to wait,
+and the watchdog only beats while no loop has been away from Read for longer
+than the stall timeout. A loop stuck on a full data channel or on a bad
+frame stops the heartbeat, while producers that are merely quiet do not
+*/
+
+const tcpReadStallTimeout = 5 * time.Second // Read loops processing for longer than this are stuck
+
+/*
+TCPReadProgress is where one connection's read loop is, either waiting in
+Read or processing since a time
+*/
+type TCPReadProgress struct {
+	processingSince atomic.Int64 // Unix time in nanoseconds the loop left Read, 0 while waiting in Read
+}
+
+// SetWaiting marks the read loop as waiting in Read for data from its producer
+func (p *TCPReadProgress) SetWaiting() {
+	p.processingSince.Store(0)
+}
+
+// SetProcessing marks the read loop as having left Read to process data
+func (p *TCPReadProgress) SetProcessing(now time.Time) {
+	p.processingSince.Store(now.UnixNano())
+}
+
+/*
+IsStalled reports whether the read loop has been processing for longer than
+the stall timeout
+*/
+func (p *TCPReadProgress) IsStalled(now time.Time) bool {
+	processingSince := p.processingSince.Load()
+	return processingSince != 0 && now.Sub(time.Unix(0, processingSince)) > tcpReadStallTimeout
+}
+
+/*
+TCPReadWatchdog tracks the read loops of every open producer connection
+*/
+type TCPReadWatchdog struct {
+	progressMap map[*TCPReadProgress]struct{} // Set of the progress of each open connection
+	mu          sync.Mutex                    // Mutex to protect access to the map
+}
+
+func NewTCPReadWatchdog() *TCPReadWatchdog {
+	p := new(TCPReadWatchdog)
+	p.progressMap = make(map[*TCPReadProgress]struct{})
+	return p
+}
+
+// Track starts watching the read loop of a new connection
+func (w *TCPReadWatchdog) Track() *TCPReadProgress {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	readProgress := new(TCPReadProgress)
+	w.progressMap[readProgress] = struct{}{}
+	return readProgress
+}
+
+// Forget stops watching the read loop of a closed connection
+func (w *TCPReadWatchdog) Forget(readProgress *TCPReadProgress) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	delete(w.progressMap, readProgress)
+}
+
+/*
+IsProgressing reports whether every read loop is waiting in Read or has
+been processing for less than the stall timeout
+*/
+func (w *TCPReadWatchdog) IsProgressing(now time.Time) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for readProgress := range w.progressMap {
+		if readProgress.IsStalled(now) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+Run beats the TCP routine's heartbeat every interval while its read loops
+are making progress
+*/
+func (w *TCPReadWatchdog) Run(healthRegistry *HealthRegistry) {
+	heartbeatTicker := time.NewTicker(healthHeartbeatInterval)
+	defer heartbeatTicker.Stop()
+
+	for now := range heartbeatTicker.C {
+		if w.IsProgressing(now) {
+			healthRegistry.Heartbeat(HealthRoutineTCPRx)
+		}
+	}
+}
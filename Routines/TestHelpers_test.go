@@ -0,0 +1,96 @@
+package Routines
+
+import (
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+)
+
+/*
+newTestServerConfig parses a server config section the way Config.json is
+read, so tests run with the same defaults as the adapter
+*/
+func newTestServerConfig(t testing.TB, serverConfigSection map[string]interface{}) WebSocketServerConfig {
+	t.Helper()
+
+	if serverConfigSection == nil {
+		serverConfigSection = map[string]interface{}{}
+	}
+	serverConfigSection["Port"] = "0"
+
+	serverConfig, err := ParseWebSocketServerConfig(map[string]interface{}{"TestConfig": serverConfigSection}, "TestConfig")
+	if err != nil {
+		t.Fatalf("parsing test server config: %v", err)
+	}
+	return serverConfig
+}
+
+/*
+newTestLoggingChannel returns a logging channel that is drained until the
+test ends so routines never block on it
+*/
+func newTestLoggingChannel(t testing.TB) chan map[zerolog.Level]string {
+	loggingChannel := make(chan map[zerolog.Level]string, 100)
+	drainTestChannel(t, loggingChannel)
+	return loggingChannel
+}
+
+/*
+newTestReportingChannel returns a reporting channel that is drained until
+the test ends so statistics never block the router
+*/
+func newTestReportingChannel(t testing.TB) chan string {
+	reportingChannel := make(chan string, 100)
+	drainTestChannel(t, reportingChannel)
+	return reportingChannel
+}
+
+func drainTestChannel[T any](t testing.TB, channel chan T) {
+	testFinished := make(chan struct{})
+	t.Cleanup(func() { close(testFinished) })
+
+	go func() {
+		for {
+			select {
+			case <-channel:
+			case <-testFinished:
+				return
+			}
+		}
+	}()
+}
+
+/*
+testChunkRouter is a chunk router serving its routes on its own gin engine
+*/
+type testChunkRouter struct {
+	chunkTypeRoutingMap *ChunkTypeToChannelMap
+	loggingChannel      chan map[zerolog.Level]string
+	router              *gin.Engine
+}
+
+func newTestChunkRouter(t testing.TB, serverConfig WebSocketServerConfig) *testChunkRouter {
+	loggingChannel := newTestLoggingChannel(t)
+	chunkRouter := &testChunkRouter{
+		chunkTypeRoutingMap: NewChunkTypeToChannelMap(loggingChannel, newTestReportingChannel(t), serverConfig),
+		loggingChannel:      loggingChannel,
+		router:              gin.New(),
+	}
+	chunkRouter.chunkTypeRoutingMap.RegisterRoutes(loggingChannel, chunkRouter.router)
+	return chunkRouter
+}
+
+// sendChunk routes a chunk the way the data routine does
+func (r *testChunkRouter) sendChunk(chunkTypeString string, data string) {
+	r.chunkTypeRoutingMap.SendChunkToWebSocket(r.loggingChannel, chunkTypeString, data)
+}
+
+// registerKnownChunkTypes registers the configured chunk types as the server does at startup
+func (r *testChunkRouter) registerKnownChunkTypes() {
+	r.chunkTypeRoutingMap.RegisterKnownChunkTypes(r.loggingChannel)
+}
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
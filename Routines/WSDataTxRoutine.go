@@ -2,100 +2,114 @@ package Routines
 
 import (
 	"encoding/json"
-	"net/http"
 	"os"
 	"time"
-	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog"
-	"strconv"
 )
 
-func HandleWSDataChunkTx(configJson map[string]interface{}, loggingChannel chan map[zerolog.Level]string, incomingDataChannel <-chan string, OutgoingReportingChannel chan string) {
+func HandleWSDataChunkTx(configJson map[string]interface{}, loggingChannel chan map[zerolog.Level]string, incomingDataChannel <-chan ReceivedChunk, OutgoingReportingChannel chan string, controlCommandChannel chan<- ControlCommand, healthRegistry *HealthRegistry) {
 	
-	// Create websocket variables
-	var port string
-
-	// And then try parse the JSON string
-	if WebSocketTxConfig, exists := configJson["WebSocketDataTxConfig"].(map[string]interface{}); exists {
-		port = WebSocketTxConfig["Port"].(string)
-		loggingChannel <- CreateLogMessage(zerolog.InfoLevel, "WebSocketDataTxConfig opening on port"  + port)
-	} else {
-		loggingChannel <- CreateLogMessage(zerolog.FatalLevel, "WebSocketDataTxConfig Config not found or not correct")
+	// Try parse the JSON string
+	serverConfig, err := ParseWebSocketServerConfig(configJson, "WebSocketDataTxConfig")
+	if err != nil {
+		loggingChannel <- CreateLogMessage(zerolog.FatalLevel, err.Error())
 		os.Exit(1)
 		return
 	}
+	serverConfig.AuthorizationScope = AuthorizationScopeChunkTypes
+	loggingChannel <- CreateLogMessage(zerolog.InfoLevel, "WebSocketDataTxConfig opening on port"  + serverConfig.Port)
+
+	// Then we run the HTTP router, keeping tokens out of its request log
+	router := NewHTTPRouter()
 
-	// Then we run the HTTP router
-	router := gin.Default()
-	// Allow all origins to connect
-	// Note that is is not safe
-	upgrader.CheckOrigin = func(r *http.Request) bool {
-		return true
+	// Only let configured browser origins use the REST endpoints
+	router.Use(serverConfig.OriginPolicy.CORSMiddleware())
+	if serverConfig.OriginPolicy.AllowsAllOrigins() {
+		loggingChannel <- CreateLogMessage(zerolog.WarnLevel, "WebSocketDataTxConfig allows all origins, set AllowedOrigins to restrict them")
 	}
 
-	go RunChunkRoutingRoutine(loggingChannel, incomingDataChannel, router, OutgoingReportingChannel)
+	// Let clients send commands back to the producers
+	RegisterControlRoutes(loggingChannel, router, controlCommandChannel, serverConfig)
+
+	// Routes of known chunk types exist before any data so early clients do not get a 404
+	chunkTypeRoutingMap := NewChunkTypeToChannelMap(loggingChannel, OutgoingReportingChannel, serverConfig)
+	chunkTypeRoutingMap.RegisterKnownChunkTypes(loggingChannel)
+	chunkTypeRoutingMap.RegisterRoutes(loggingChannel, router)
+	chunkTypeRoutingMap.RegisterAllChunkTypesRoute(loggingChannel, router)
+
+	// Orchestrators probe these without a token
+	RegisterHealthRoutes(router, healthRegistry)
+
+	go RunChunkRoutingRoutine(loggingChannel, incomingDataChannel, OutgoingReportingChannel, chunkTypeRoutingMap, healthRegistry)
 	loggingChannel <- CreateLogMessage(zerolog.InfoLevel, "Starting http router")
-	router.Run(":" + port)
+	RunHTTPServer(loggingChannel, router, serverConfig.Port, healthRegistry, HealthRoutineDataServer)
 
 }
 
-func RunChunkRoutingRoutine(loggingChannel chan map[zerolog.Level]string, incomingDataChannel <-chan string, router *gin.Engine, OutgoingReportingChannel chan string) {
+func RunChunkRoutingRoutine(loggingChannel chan map[zerolog.Level]string, incomingDataChannel <-chan ReceivedChunk, OutgoingReportingChannel chan string, chunkTypeRoutingMap *ChunkTypeToChannelMap, healthRegistry *HealthRegistry) {
 	
-	chunkTypeRoutingMap := NewChunkTypeToChannelMap(loggingChannel, OutgoingReportingChannel)
-	currentTime := time.Now()	
+	reportingTicker := time.NewTicker(1000 * time.Millisecond)
+	defer reportingTicker.Stop()
+	healthRegistry.SetReady(HealthRoutineDataRouter, true, "Routing chunks")
 
 	for {
 
-		bSendData := false
-		var strJSONData string
-		timeoutCh := time.After(5 * time.Millisecond)
-
-		// Try get data while waiting for a timeout
+		// Sleep until there is data to route or it is time to report
 		select {
-		case strJSONData = <-incomingDataChannel:
-			bSendData = true
-		case <-timeoutCh:
-		}
+		case receivedChunk := <-incomingDataChannel:
+			RouteJSONChunk(loggingChannel, chunkTypeRoutingMap, receivedChunk, OutgoingReportingChannel)
 
-		// Then try send the data
-		if bSendData {
-
-			var JSONData map[string]interface{}
-			
-			if err := json.Unmarshal([]byte(strJSONData), &JSONData); err != nil {
-				loggingChannel <- CreateLogMessage(zerolog.ErrorLevel, "Error unmarshaling JSON in routing routine:"+err.Error()+" - Got " + strJSONData)
-				continue
-			}
-
-			// Then try forward the JSON data onwards
-			// By first getting the root JSON Key (ChunkType)
-			var chunkTypeStringKey string
-			for key := range JSONData {
-				chunkTypeStringKey = key
-				break // We assume there's only one root key
-			}
-
-			// And checking if it exists and trying to route it
-			if (chunkTypeStringKey == "SystemInfo") {
-				OutgoingReportingChannel <- string(strJSONData)
-			} else {
-				chunkTypeRoutingMap.SendChunkToWebSocket(loggingChannel, chunkTypeStringKey, strJSONData, router)
-			}
-		}
+		case <-reportingTicker.C:
+			healthRegistry.Heartbeat(HealthRoutineDataRouter)
+
+			SendMetric(OutgoingReportingChannel, NewMetricStatistic("Routing_Output_Channel", float64(len(incomingDataChannel)), MetricUnitChunks).
+				WithCapacity(float64(cap(incomingDataChannel))).
+				WithMetric("routing_input_queue_depth", nil))
+
+			// How much of each chunk type is flowing and to how many clients
+			chunkTypeRoutingMap.ReportChunkTypeMetrics()
+			chunkTypeRoutingMap.ReportChunkThroughput()
+			chunkTypeRoutingMap.ReportChunkLatency()
+
+			// Queues overflow silently so report how much each chunk type lost
+			chunkTypeRoutingMap.ReportDroppedChunks(loggingChannel)
 
-		if time.Since(currentTime) > 1000*time.Millisecond {
-
-			currentTime= time.Now()
-			
-			QueueLogMessage := SystemInfo{SystemStat:SystemStatistic{
-				StatEnvironment: "TCP_WS_Adapter",
-				StatName: "Routing_Output_Channel",
-				StatStaus: strconv.Itoa(len(incomingDataChannel)) + "/" + strconv.Itoa(cap(incomingDataChannel)),
-			}}
-			
-			data, _ := json.Marshal(QueueLogMessage)
-			OutgoingReportingChannel <- string(data)
+			// Clients that cannot keep up
+			chunkTypeRoutingMap.ReportSlowConsumers()
+
+			// And free up chunk types that have stopped arriving
+			chunkTypeRoutingMap.ExpireIdleChunkTypes(loggingChannel)
 		}
 	}
 }
 
+/*
+RouteJSONChunk sends system information on to reporting and every other
+chunk to the websockets of its chunk type
+*/
+func RouteJSONChunk(loggingChannel chan map[zerolog.Level]string, chunkTypeRoutingMap *ChunkTypeToChannelMap, receivedChunk ReceivedChunk, OutgoingReportingChannel chan string) {
+
+	strJSONData := receivedChunk.JSONString
+	var JSONData map[string]interface{}
+	
+	if err := json.Unmarshal([]byte(strJSONData), &JSONData); err != nil {
+		loggingChannel <- CreateLogMessage(zerolog.ErrorLevel, "Error unmarshaling JSON in routing routine:"+err.Error()+" - Got " + strJSONData)
+		return
+	}
+
+	// Then try forward the JSON data onwards
+	// By first getting the root JSON Key (ChunkType)
+	var chunkTypeStringKey string
+	for key := range JSONData {
+		chunkTypeStringKey = key
+		break // We assume there's only one root key
+	}
+
+	// And checking if it exists and trying to route it
+	if (chunkTypeStringKey == "SystemInfo" || chunkTypeStringKey == "SystemMetric") {
+		OutgoingReportingChannel <- string(strJSONData)
+	} else {
+		chunkTypeRoutingMap.SendReceivedChunkToWebSocket(loggingChannel, chunkTypeStringKey, receivedChunk)
+	}
+}
+
@@ -1,75 +1,144 @@
 package Routines
 
 import (
-	"encoding/json"
-	"net/http"
 	"os"
-	"github.com/gin-gonic/gin"
+	"time"
 	"github.com/rs/zerolog"
 )
 
 
-func HandleWSReportingTx(configJson map[string]interface{}, routineCompleteChannel chan bool, loggingChannel chan map[zerolog.Level]string, incomingDataChannel chan string) {
+func HandleWSReportingTx(configJson map[string]interface{}, routineCompleteChannel chan bool, loggingChannel chan map[zerolog.Level]string, incomingDataChannel chan string, healthRegistry *HealthRegistry) {
 
-	// Create websocket variables
-	var port string
-
-	// And then try parse the JSON string
-	if WebSocketTxConfig, exists := configJson["WebSocketReportingTxConfig"].(map[string]interface{}); exists {
-		port = WebSocketTxConfig["Port"].(string)
-		loggingChannel <- CreateLogMessage(zerolog.InfoLevel, "WebSocketReportingTxConfig opening on port"  + port)
-	} else {
-		
-		loggingChannel <- CreateLogMessage(zerolog.FatalLevel, "WebSocketReportingTxConfig Config not found or not correct")
+	// Try parse the JSON string
+	serverConfig, err := ParseWebSocketServerConfig(configJson, "WebSocketReportingTxConfig")
+	if err != nil {
+		loggingChannel <- CreateLogMessage(zerolog.FatalLevel, err.Error())
 		os.Exit(1)
 		return
 	}
+	serverConfig.AuthorizationScope = AuthorizationScopeReportingStreams
+	loggingChannel <- CreateLogMessage(zerolog.InfoLevel, "WebSocketReportingTxConfig opening on port"  + serverConfig.Port)
+
+	// Then we run the HTTP router, keeping tokens out of its request log
+	router := NewHTTPRouter()
+
+	// Only let configured browser origins use the REST endpoints
+	router.Use(serverConfig.OriginPolicy.CORSMiddleware())
+	if serverConfig.OriginPolicy.AllowsAllOrigins() {
+		loggingChannel <- CreateLogMessage(zerolog.WarnLevel, "WebSocketReportingTxConfig allows all origins, set AllowedOrigins to restrict them")
+	}
 
-	// Then we run the HTTP router
-	router := gin.Default()
-	// Allow all origins to connect
-	// Note that is is not safe
-	upgrader.CheckOrigin = func(r *http.Request) bool {
-		return true
+	// Routes of known reporting streams exist before any data so early clients do not get a 404
+	chunkTypeRoutingMap := NewChunkTypeToChannelMap(loggingChannel, incomingDataChannel, serverConfig)
+	// and new clients are sent the latest value of every statistic before live updates
+	chunkTypeRoutingMap.EnableLastKnownValues()
+	chunkTypeRoutingMap.RegisterKnownChunkTypes(loggingChannel)
+	chunkTypeRoutingMap.RegisterRoutes(loggingChannel, router)
+
+	// Reporting from each environment can also be followed on its own
+	environmentRoutingMap := NewReportingEnvironmentMap(loggingChannel, incomingDataChannel, serverConfig)
+	environmentRoutingMap.RegisterRoutes(loggingChannel, router)
+	RegisterReportingEnvironmentsRoute(router, environmentRoutingMap, serverConfig)
+
+	// Keep the latest metrics for Prometheus to scrape
+	metricCache := NewMetricCache()
+	RegisterMetricsRoute(router, metricCache, serverConfig)
+
+	// And the latest value of every statistic for anyone asking over REST
+	statusCache := NewReportingStatusCache()
+	RegisterStatusRoute(router, statusCache, serverConfig)
+
+	// Warn when statistics cross their configured thresholds
+	var alertRules []AlertRule
+	WebSocketReportingTxConfig, _ := GetConfigSection(configJson, "WebSocketReportingTxConfig")
+	if AlertConfig, exists := GetConfigSection(WebSocketReportingTxConfig, "AlertConfig"); exists {
+		if alertRules, err = ParseAlertConfig(AlertConfig); err != nil {
+			loggingChannel <- CreateLogMessage(zerolog.FatalLevel, "AlertConfig "+err.Error())
+			os.Exit(1)
+			return
+		}
 	}
+	alertEvaluator := NewAlertEvaluator(alertRules)
+	RegisterAlertsRoute(router, alertEvaluator, serverConfig)
+	go RunRuntimeMetricsReporter(incomingDataChannel)
+
+	// Orchestrators probe these without a token
+	RegisterHealthRoutes(router, healthRegistry)
 
-	go RunReportingRoutine(loggingChannel, routineCompleteChannel, incomingDataChannel, router)
+	go RunReportingRoutine(loggingChannel, incomingDataChannel, chunkTypeRoutingMap, environmentRoutingMap, metricCache, statusCache, alertEvaluator, healthRegistry)
 	loggingChannel <- CreateLogMessage(zerolog.InfoLevel, "Starting http router")
-	router.Run(":" + port)
+	RunHTTPServer(loggingChannel, router, serverConfig.Port, healthRegistry, HealthRoutineReportingServer)
 
 }
 
-func RunReportingRoutine(loggingChannel chan map[zerolog.Level]string, routineCompleteChannel chan bool, incomingDataChannel chan string, router *gin.Engine) {
+func RunReportingRoutine(loggingChannel chan map[zerolog.Level]string, incomingDataChannel chan string, chunkTypeRoutingMap *ChunkTypeToChannelMap, environmentRoutingMap *ChunkTypeToChannelMap, metricCache *MetricCache, statusCache *ReportingStatusCache, alertEvaluator *AlertEvaluator, healthRegistry *HealthRegistry) {
 
-	chunkTypeRoutingMap := NewChunkTypeToChannelMap(loggingChannel, incomingDataChannel)
+	heartbeatTicker := time.NewTicker(healthHeartbeatInterval)
+	defer heartbeatTicker.Stop()
+	pruneTicker := time.NewTicker(reportingCachePruneInterval)
+	defer pruneTicker.Stop()
+	alertTicker := time.NewTicker(alertEvaluationInterval)
+	defer alertTicker.Stop()
+	healthRegistry.SetReady(HealthRoutineReportingRouter, true, "Routing reporting messages")
 
 	for {
 
-		// Unmarshal the JSON string into a map
-		JSONDataString := <-incomingDataChannel
-		var JSONData map[string]interface{}
+		// Sleep until there is something to route or it is time to beat
+		var JSONDataString string
+		select {
+		case JSONDataString = <-incomingDataChannel:
+		case <-heartbeatTicker.C:
+			healthRegistry.Heartbeat(HealthRoutineReportingRouter)
+			continue
+		case <-pruneTicker.C:
+			// Expired statistics are forgotten even if nobody asks for them
+			metricCache.Prune()
+			statusCache.Prune()
+			chunkTypeRoutingMap.PruneLastKnownValues()
+			environmentRoutingMap.PruneLastKnownValues()
+			continue
+		case <-alertTicker.C:
+			// Alerts also change while statistics are quiet or no longer reported
+			PublishAlerts(loggingChannel, alertEvaluator.EvaluateSeries(time.Now()), chunkTypeRoutingMap, environmentRoutingMap)
+			continue
+		}
 
-		// Try convert the JSON doc to a string
-		if err := json.Unmarshal([]byte(JSONDataString), &JSONData); err != nil {
+		// Decode the message once, everything after works from the parsed statistic
+		message, err := ParseReportingMessage(JSONDataString)
+		if err != nil {
 			// If it fails, then skip to next interation
 			loggingChannel <- CreateLogMessage(zerolog.ErrorLevel, "Error unmarshaling JSON in routing routine:"+err.Error())
 			continue
-		} 
-		
-		// Then try forward the JSON data onwards
-		// By first getting the root JSON Key (ChunkType)
-		var chunkTypeStringKey string
-
-		// We assume there's only one root key
-		for key := range JSONData {
-			chunkTypeStringKey = key
-			break
 		}
-			
+
+		// Statistics that will not be reported again are forgotten rather than routed
+		if message.ChunkType == "SystemStatRemoval" {
+			if message.Removal != nil {
+				ForgetStatistics(*message.Removal, chunkTypeRoutingMap, environmentRoutingMap, metricCache, statusCache)
+			}
+			continue
+		}
+
+		if message.SystemMetric != nil {
+			metricCache.Update(*message.SystemMetric)
+			statusCache.UpdateMetric(*message.SystemMetric)
+		}
+		if message.SystemInfo != nil {
+			statusCache.UpdateStatus(*message.SystemInfo)
+		}
+
 		// And try tranmit it on the routing threads
-		chunkTypeRoutingMap.SendChunkToWebSocket(loggingChannel, chunkTypeStringKey, JSONDataString, router)
-	}
+		RouteReportingMessage(loggingChannel, message, chunkTypeRoutingMap, environmentRoutingMap)
+
+		// The adapter's own metrics also go out in the legacy shape, which the status cache already holds
+		if message.SystemMetric != nil && message.SystemMetric.StatEnvironment == AdapterStatEnvironment {
+			RouteReportingMessage(loggingChannel, NewLegacyReportingMessage(*message.SystemMetric), chunkTypeRoutingMap, environmentRoutingMap)
+		}
 
-	routineCompleteChannel <- true
+		// Alerts follow the statistic that raised them
+		if message.SystemMetric != nil {
+			PublishAlerts(loggingChannel, alertEvaluator.Evaluate(*message.SystemMetric, message.ReceivedTime), chunkTypeRoutingMap, environmentRoutingMap)
+		}
+	}
 }
 
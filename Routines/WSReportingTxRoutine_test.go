@@ -0,0 +1,72 @@
+package Routines
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+/*
+startTestReportingRoutine runs a reporting routine with the given alert
+rules, returning the channel it reads and its router by type
+*/
+func startTestReportingRoutine(t *testing.T, alertRules []AlertRule) (chan string, *ChunkTypeToChannelMap) {
+	loggingChannel := newTestLoggingChannel(t)
+	incomingDataChannel := make(chan string, 100)
+	serverConfig := newTestServerConfig(t, nil)
+
+	chunkTypeRoutingMap := NewChunkTypeToChannelMap(loggingChannel, incomingDataChannel, serverConfig)
+	chunkTypeRoutingMap.EnableLastKnownValues()
+	environmentRoutingMap := NewReportingEnvironmentMap(loggingChannel, incomingDataChannel, serverConfig)
+
+	go RunReportingRoutine(loggingChannel, incomingDataChannel, chunkTypeRoutingMap, environmentRoutingMap, NewMetricCache(), NewReportingStatusCache(), NewAlertEvaluator(alertRules), NewHealthRegistry())
+	return incomingDataChannel, chunkTypeRoutingMap
+}
+
+/*
+receiveTestStatNames collects the statistic names of the messages a
+subscriber is sent until none arrive for a while
+*/
+func receiveTestStatNames(t *testing.T, subscriber *ChunkSubscriber) []string {
+	var statNames []string
+	for {
+		select {
+		case chunk := <-subscriber.Queue():
+			var JSONData map[string]struct{ StatName string }
+			if err := json.Unmarshal([]byte(chunk.JSONString), &JSONData); err != nil {
+				t.Fatalf("subscriber was sent %s: %v", chunk.JSONString, err)
+			}
+			for _, statistic := range JSONData {
+				statNames = append(statNames, statistic.StatName)
+			}
+		case <-time.After(100 * time.Millisecond):
+			return statNames
+		}
+	}
+}
+
+func TestAdapterMetricsAreSentOnceAndRoutedInBothShapes(t *testing.T) {
+	incomingDataChannel, chunkTypeRoutingMap := startTestReportingRoutine(t, nil)
+
+	systemMetricSubscriber := NewChunkSubscriber("client", "SystemMetric", 10)
+	systemInfoSubscriber := NewChunkSubscriber("client", "SystemInfo", 10)
+	chunkTypeRoutingMap.AddSubscriber(systemMetricSubscriber)
+	chunkTypeRoutingMap.AddSubscriber(systemInfoSubscriber)
+
+	reportingChannel := make(chan string, 10)
+	SendMetric(reportingChannel, NewMetricStatistic("TimeChunk_Channel", 12, MetricUnitChunks))
+	if len(reportingChannel) != 1 {
+		t.Fatalf("SendMetric queued %d messages, want 1", len(reportingChannel))
+	}
+	incomingDataChannel <- <-reportingChannel
+
+	// Metrics forwarded from producers are left in the shape they were sent in
+	incomingDataChannel <- `{"SystemMetric":{"StatEnvironment":"Node1","StatName":"Producer_Rate","Value":1}}`
+
+	if statNames := receiveTestStatNames(t, systemMetricSubscriber); len(statNames) != 2 {
+		t.Errorf("SystemMetric clients were sent %v, want both metrics", statNames)
+	}
+	if statNames := receiveTestStatNames(t, systemInfoSubscriber); len(statNames) != 1 || statNames[0] != "TimeChunk_Channel" {
+		t.Errorf("SystemInfo clients were sent %v, want only TimeChunk_Channel", statNames)
+	}
+}
@@ -0,0 +1,281 @@
+package Routines
+
+import (
+	"bufio"
+	"compress/flate"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+/*
+SlowConsumerPolicy decides what happens to a client that cannot keep up
+*/
+type SlowConsumerPolicy string
+
+const (
+	SlowConsumerPolicyDrop       SlowConsumerPolicy = "Drop"       // Drop chunks for that client only
+	SlowConsumerPolicyDisconnect SlowConsumerPolicy = "Disconnect" // Disconnect the client once it lags for too long
+)
+
+/*
+SlowConsumerConfig sets how far a client may fall behind. Lag is the number
+of chunks waiting in the client's send queue
+*/
+type SlowConsumerConfig struct {
+	ClientQueueCapacity int                // Chunks each client can have waiting before they are dropped
+	Policy              SlowConsumerPolicy // What to do with a lagging client
+	LagThreshold        int                // Queued chunks above which a client counts as lagging
+	LagDuration         time.Duration      // How long a client may lag before it is disconnected
+}
+
+func NewSlowConsumerConfig() SlowConsumerConfig {
+	return SlowConsumerConfig{
+		ClientQueueCapacity: 100,
+		Policy:              SlowConsumerPolicyDrop,
+		LagThreshold:        80,
+		LagDuration:         5 * time.Second,
+	}
+}
+
+func ParseSlowConsumerConfig(configSection map[string]interface{}) (SlowConsumerConfig, error) {
+
+	slowConsumerConfig := NewSlowConsumerConfig()
+	var err error
+
+	if slowConsumerConfig.ClientQueueCapacity, err = GetConfigInt(configSection, "ClientQueueCapacity", slowConsumerConfig.ClientQueueCapacity); err != nil {
+		return slowConsumerConfig, err
+	}
+	if slowConsumerConfig.ClientQueueCapacity < 1 {
+		return slowConsumerConfig, errors.New("ClientQueueCapacity should be at least 1")
+	}
+
+	policyString, err := GetConfigString(configSection, "Policy", string(slowConsumerConfig.Policy))
+	if err != nil {
+		return slowConsumerConfig, err
+	}
+	switch strings.ToUpper(policyString) {
+	case "DROP":
+		slowConsumerConfig.Policy = SlowConsumerPolicyDrop
+	case "DISCONNECT":
+		slowConsumerConfig.Policy = SlowConsumerPolicyDisconnect
+	default:
+		return slowConsumerConfig, errors.New("Policy should be Drop or Disconnect, got " + policyString)
+	}
+
+	if slowConsumerConfig.LagThreshold, err = GetConfigInt(configSection, "LagThreshold", slowConsumerConfig.LagThreshold); err != nil {
+		return slowConsumerConfig, err
+	}
+	if slowConsumerConfig.LagThreshold < 1 || slowConsumerConfig.LagThreshold > slowConsumerConfig.ClientQueueCapacity {
+		return slowConsumerConfig, errors.New("LagThreshold should be between 1 and ClientQueueCapacity")
+	}
+
+	lagDurationSeconds, err := GetConfigInt(configSection, "LagDurationSeconds", int(slowConsumerConfig.LagDuration/time.Second))
+	if err != nil {
+		return slowConsumerConfig, err
+	}
+	if lagDurationSeconds < 0 {
+		return slowConsumerConfig, errors.New("LagDurationSeconds should not be negative")
+	}
+	slowConsumerConfig.LagDuration = time.Duration(lagDurationSeconds) * time.Second
+
+	return slowConsumerConfig, nil
+}
+
+/*
+WebSocketServerConfig holds the settings shared by the data and reporting
+WebSocket servers. Each server reads its own section of Config.json
+*/
+type WebSocketServerConfig struct {
+	ServerName                    string             // Config section this was read from, used in logs
+	Port                          string             // Port the HTTP router listens on
+	CompressionEnabled            bool               // Whether permessage-deflate is offered to clients
+	CompressionLevel              int                // flate compression level used when compressing
+	CompressionMinimumMessageSize int                // Messages smaller than this are sent uncompressed
+	RecentChunkBufferSize         int                // Number of recent chunks kept per chunk type
+	ChunkRouting                  ChunkRoutingConfig // Per chunk type routing settings
+	SlowConsumer                  SlowConsumerConfig // How lagging clients are handled
+	PingInterval                  time.Duration      // How often clients are pinged, 0 to disable
+	PongTimeout                   time.Duration      // How long a client may go without answering before it is closed
+	WriteTimeout                  time.Duration      // How long a single write to a client may take
+	OriginPolicy                  OriginPolicy       // Browser origins allowed to connect
+	Authenticator                 *Authenticator     // Verifies client tokens, shared by both servers
+	AuthorizationScope            AuthorizationScope // Which token claims list this server's streams are checked against
+}
+
+func ParseWebSocketServerConfig(configJson map[string]interface{}, serverName string) (WebSocketServerConfig, error) {
+
+	serverConfig := WebSocketServerConfig{
+		ServerName:            serverName,
+		CompressionLevel:      flate.DefaultCompression,
+		RecentChunkBufferSize: 100,
+		ChunkRouting:          NewChunkRoutingConfig(),
+		SlowConsumer:          NewSlowConsumerConfig(),
+		PingInterval:          10 * time.Second,
+		PongTimeout:           30 * time.Second,
+		WriteTimeout:          10 * time.Second,
+		OriginPolicy:          NewOriginPolicy([]string{"*"}),
+	}
+
+	WebSocketTxConfig, exists := GetConfigSection(configJson, serverName)
+	if !exists {
+		return serverConfig, errors.New(serverName + " Config not found or not correct")
+	}
+
+	port, err := GetConfigString(WebSocketTxConfig, "Port", "")
+	if err != nil || port == "" {
+		return serverConfig, errors.New(serverName + " Port not found or not correct")
+	}
+	serverConfig.Port = port
+
+	if serverConfig.RecentChunkBufferSize, err = GetConfigInt(WebSocketTxConfig, "RecentChunkBufferSize", 100); err != nil {
+		return serverConfig, err
+	}
+	if serverConfig.RecentChunkBufferSize < 1 {
+		return serverConfig, errors.New("RecentChunkBufferSize should be at least 1")
+	}
+
+	// Authentication is configured once for both servers
+	if serverConfig.Authenticator, err = ParseAuthenticationConfig(configJson); err != nil {
+		return serverConfig, errors.New("AuthenticationConfig " + err.Error())
+	}
+
+	// Without a list every origin is allowed as before
+	allowedOrigins, err := GetConfigStringList(WebSocketTxConfig, "AllowedOrigins", []string{"*"})
+	if err != nil {
+		return serverConfig, err
+	}
+	serverConfig.OriginPolicy = NewOriginPolicy(allowedOrigins)
+
+	if ChunkRoutingConfig, exists := GetConfigSection(WebSocketTxConfig, "ChunkRoutingConfig"); exists {
+		if serverConfig.ChunkRouting, err = ParseChunkRoutingConfig(ChunkRoutingConfig); err != nil {
+			return serverConfig, errors.New("ChunkRoutingConfig " + err.Error())
+		}
+	}
+
+	if SlowConsumerConfig, exists := GetConfigSection(WebSocketTxConfig, "SlowConsumerConfig"); exists {
+		if serverConfig.SlowConsumer, err = ParseSlowConsumerConfig(SlowConsumerConfig); err != nil {
+			return serverConfig, errors.New("SlowConsumerConfig " + err.Error())
+		}
+	}
+
+	if HeartbeatConfig, exists := GetConfigSection(WebSocketTxConfig, "HeartbeatConfig"); exists {
+		if err = parseHeartbeatConfig(HeartbeatConfig, &serverConfig); err != nil {
+			return serverConfig, errors.New("HeartbeatConfig " + err.Error())
+		}
+	}
+
+	// Compression is optional and stays off unless configured
+	if CompressionConfig, exists := GetConfigSection(WebSocketTxConfig, "CompressionConfig"); exists {
+
+		if serverConfig.CompressionEnabled, err = GetConfigBool(CompressionConfig, "Enabled", false); err != nil {
+			return serverConfig, err
+		}
+		if serverConfig.CompressionLevel, err = GetConfigInt(CompressionConfig, "Level", flate.DefaultCompression); err != nil {
+			return serverConfig, err
+		}
+		if serverConfig.CompressionLevel < flate.HuffmanOnly || serverConfig.CompressionLevel > flate.BestCompression {
+			return serverConfig, errors.New("Compression level should be between " + strconv.Itoa(flate.HuffmanOnly) + " and " + strconv.Itoa(flate.BestCompression))
+		}
+		if serverConfig.CompressionMinimumMessageSize, err = GetConfigInt(CompressionConfig, "MinimumMessageSize", 0); err != nil {
+			return serverConfig, err
+		}
+	}
+
+	return serverConfig, nil
+}
+
+func parseHeartbeatConfig(configSection map[string]interface{}, serverConfig *WebSocketServerConfig) error {
+
+	pingIntervalSeconds, err := GetConfigInt(configSection, "PingIntervalSeconds", int(serverConfig.PingInterval/time.Second))
+	if err != nil {
+		return err
+	}
+	pongTimeoutSeconds, err := GetConfigInt(configSection, "PongTimeoutSeconds", int(serverConfig.PongTimeout/time.Second))
+	if err != nil {
+		return err
+	}
+	writeTimeoutSeconds, err := GetConfigInt(configSection, "WriteTimeoutSeconds", int(serverConfig.WriteTimeout/time.Second))
+	if err != nil {
+		return err
+	}
+
+	if pingIntervalSeconds < 0 {
+		return errors.New("PingIntervalSeconds should not be negative")
+	}
+	if pingIntervalSeconds > 0 && pongTimeoutSeconds <= pingIntervalSeconds {
+		return errors.New("PongTimeoutSeconds should be longer than PingIntervalSeconds")
+	}
+	if writeTimeoutSeconds < 1 {
+		return errors.New("WriteTimeoutSeconds should be at least 1")
+	}
+
+	serverConfig.PingInterval = time.Duration(pingIntervalSeconds) * time.Second
+	serverConfig.PongTimeout = time.Duration(pongTimeoutSeconds) * time.Second
+	serverConfig.WriteTimeout = time.Duration(writeTimeoutSeconds) * time.Second
+	return nil
+}
+
+/*
+NewWebSocketUpgrader creates the upgrader for a single server so that each
+server can negotiate its own extensions
+*/
+func NewWebSocketUpgrader(serverConfig WebSocketServerConfig) *websocket.Upgrader {
+	return &websocket.Upgrader{
+		ReadBufferSize:    8096,
+		WriteBufferSize:   8096,
+		Subprotocols:      supportedChunkEncodings,
+		EnableCompression: serverConfig.CompressionEnabled,
+		CheckOrigin:       serverConfig.OriginPolicy.CheckOrigin,
+	}
+}
+
+/*
+WebSocketClientByteCounters tracks how many bytes were handed to a WebSocket
+connection versus how many actually went out on the network. With
+compression on the difference is the saving
+*/
+type WebSocketClientByteCounters struct {
+	UncompressedBytes atomic.Uint64 // Message payload bytes written by the router
+	WireBytes         atomic.Uint64 // Bytes written to the network including framing
+}
+
+/*
+byteCountingResponseWriter hands out a byte counting connection when the
+WebSocket upgrade hijacks the HTTP connection
+*/
+type byteCountingResponseWriter struct {
+	http.ResponseWriter
+	byteCounters *WebSocketClientByteCounters
+}
+
+func (w *byteCountingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+
+	conn, readWriter, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &byteCountingConn{Conn: conn, byteCounters: w.byteCounters}, readWriter, nil
+}
+
+type byteCountingConn struct {
+	net.Conn
+	byteCounters *WebSocketClientByteCounters
+}
+
+func (c *byteCountingConn) Write(p []byte) (int, error) {
+	bytesWritten, err := c.Conn.Write(p)
+	c.byteCounters.WireBytes.Add(uint64(bytesWritten))
+	return bytesWritten, err
+}
@@ -0,0 +1,140 @@
+package Routines
+
+import (
+	"compress/flate"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestParseWebSocketServerConfigCompression(t *testing.T) {
+	testCases := []struct {
+		name            string
+		serverSection   map[string]interface{}
+		wantEnabled     bool
+		wantLevel       int
+		wantMinimumSize int
+		wantError       bool
+	}{
+		{"compression not configured", map[string]interface{}{"Port": "10100"}, false, flate.DefaultCompression, 0, false},
+		{"compression configured", map[string]interface{}{"Port": "10100", "CompressionConfig": map[string]interface{}{"Enabled": "True", "Level": "9", "MinimumMessageSize": "256"}}, true, flate.BestCompression, 256, false},
+		{"level out of range", map[string]interface{}{"Port": "10100", "CompressionConfig": map[string]interface{}{"Enabled": "True", "Level": "10"}}, false, 0, 0, true},
+		{"enabled not a bool", map[string]interface{}{"Port": "10100", "CompressionConfig": map[string]interface{}{"Enabled": "yes"}}, false, 0, 0, true},
+		{"port missing", map[string]interface{}{}, false, 0, 0, true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			serverConfig, err := ParseWebSocketServerConfig(map[string]interface{}{"WebSocketTxConfig": testCase.serverSection}, "WebSocketTxConfig")
+			if (err != nil) != testCase.wantError {
+				t.Fatalf("got error %v, want error %v", err, testCase.wantError)
+			}
+			if testCase.wantError {
+				return
+			}
+			if serverConfig.CompressionEnabled != testCase.wantEnabled || serverConfig.CompressionLevel != testCase.wantLevel || serverConfig.CompressionMinimumMessageSize != testCase.wantMinimumSize {
+				t.Errorf("got compression %v level %d minimum size %d, want %v level %d minimum size %d",
+					serverConfig.CompressionEnabled, serverConfig.CompressionLevel, serverConfig.CompressionMinimumMessageSize,
+					testCase.wantEnabled, testCase.wantLevel, testCase.wantMinimumSize)
+			}
+		})
+	}
+
+	if _, err := ParseWebSocketServerConfig(map[string]interface{}{}, "WebSocketTxConfig"); err == nil {
+		t.Error("missing server section did not fail")
+	}
+}
+
+func TestParseWebSocketServerConfigHeartbeat(t *testing.T) {
+	testCases := []struct {
+		name             string
+		heartbeatSection map[string]interface{}
+		wantPingInterval time.Duration
+		wantPongTimeout  time.Duration
+		wantWriteTimeout time.Duration
+		wantError        bool
+	}{
+		{"not configured", nil, 10 * time.Second, 30 * time.Second, 10 * time.Second, false},
+		{"configured", map[string]interface{}{"PingIntervalSeconds": "5", "PongTimeoutSeconds": "15", "WriteTimeoutSeconds": "2"}, 5 * time.Second, 15 * time.Second, 2 * time.Second, false},
+		{"pings disabled", map[string]interface{}{"PingIntervalSeconds": "0"}, 0, 30 * time.Second, 10 * time.Second, false},
+		{"pong timeout within ping interval", map[string]interface{}{"PingIntervalSeconds": "10", "PongTimeoutSeconds": "10"}, 0, 0, 0, true},
+		{"negative ping interval", map[string]interface{}{"PingIntervalSeconds": "-1"}, 0, 0, 0, true},
+		{"no write timeout", map[string]interface{}{"WriteTimeoutSeconds": "0"}, 0, 0, 0, true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			serverSection := map[string]interface{}{"Port": "10100"}
+			if testCase.heartbeatSection != nil {
+				serverSection["HeartbeatConfig"] = testCase.heartbeatSection
+			}
+
+			serverConfig, err := ParseWebSocketServerConfig(map[string]interface{}{"WebSocketTxConfig": serverSection}, "WebSocketTxConfig")
+			if (err != nil) != testCase.wantError {
+				t.Fatalf("got error %v, want error %v", err, testCase.wantError)
+			}
+			if testCase.wantError {
+				return
+			}
+			if serverConfig.PingInterval != testCase.wantPingInterval || serverConfig.PongTimeout != testCase.wantPongTimeout || serverConfig.WriteTimeout != testCase.wantWriteTimeout {
+				t.Errorf("got ping %v pong %v write %v, want ping %v pong %v write %v",
+					serverConfig.PingInterval, serverConfig.PongTimeout, serverConfig.WriteTimeout,
+					testCase.wantPingInterval, testCase.wantPongTimeout, testCase.wantWriteTimeout)
+			}
+		})
+	}
+}
+
+/*
+sendCountedMessage sends one message to a client through a server with the
+given compression setting, returning the bytes that went out on the network
+*/
+func sendCountedMessage(t *testing.T, compressionEnabled bool, message []byte) uint64 {
+	serverConfig := WebSocketServerConfig{CompressionEnabled: compressionEnabled, CompressionLevel: flate.BestCompression}
+	upgrader := NewWebSocketUpgrader(serverConfig)
+
+	var byteCounters WebSocketClientByteCounters
+	messageSent := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(messageSent)
+		WebSocketConnection, err := upgrader.Upgrade(&byteCountingResponseWriter{ResponseWriter: w, byteCounters: &byteCounters}, r, nil)
+		if err != nil {
+			return
+		}
+		defer WebSocketConnection.Close()
+
+		// Only count what is sent after the handshake
+		byteCounters.WireBytes.Store(0)
+		WebSocketConnection.EnableWriteCompression(compressionEnabled)
+		WebSocketConnection.WriteMessage(websocket.TextMessage, message)
+	}))
+	defer server.Close()
+
+	dialer := websocket.Dialer{EnableCompression: true}
+	WebSocketConnection, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	defer WebSocketConnection.Close()
+
+	if _, receivedMessage, err := WebSocketConnection.ReadMessage(); err != nil || string(receivedMessage) != string(message) {
+		t.Fatalf("client did not get the message back intact: %v", err)
+	}
+	<-messageSent
+	return byteCounters.WireBytes.Load()
+}
+
+func TestCompressionIsCountedOnTheWire(t *testing.T) {
+	message := []byte(`{"TimeChunk":{"Samples":[` + strings.Repeat("0,", 4000) + `0]}}`)
+
+	if wireBytes := sendCountedMessage(t, false, message); wireBytes < uint64(len(message)) {
+		t.Errorf("uncompressed message took %d bytes on the wire, want at least %d", wireBytes, len(message))
+	}
+	if wireBytes := sendCountedMessage(t, true, message); wireBytes == 0 || wireBytes >= uint64(len(message))/10 {
+		t.Errorf("compressed message took %d bytes on the wire, want a fraction of %d", wireBytes, len(message))
+	}
+}
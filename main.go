@@ -7,17 +7,10 @@ import (
 	"time"
 	"github.com/Sense-Scape/Go_TCP_Websocket_Adapter/v2/Routines"
 	"github.com/rs/zerolog"
-	// _ "net/http/pprof"
-    // "net/http"
 )
 
 func main() {
 
-	// uncomment to allow remote memory debugging
-	// go func() {
-	// 	log.Println(http.ListenAndServe("localhost:6060", nil))
-	// }()
-	
 	// Create a decoder to read JSON data from the file
 	// Open the JSON file for reading
 	routineCompleteChannel := make(chan bool)
@@ -41,21 +34,28 @@ func main() {
 		return
 	}
 
+	// Every routine beats into this so /healthz and /readyz can report on them
+	HealthRegistry := Routines.NewAdapterHealthRegistry()
+
 	routineCount = routineCount + 1
 	LoggingChannel := make(chan map[zerolog.Level]string, 1000)
 
-	go Routines.HandleLogging(serverConfigStringMap, routineCompleteChannel, LoggingChannel)
+	go Routines.HandleLogging(serverConfigStringMap, routineCompleteChannel, LoggingChannel, HealthRegistry)
+
+	// Profiling is only served when turned on in ProfilingConfig
+	go Routines.HandleProfiling(serverConfigStringMap, LoggingChannel)
 
 	routineCount = routineCount + 1
 	ReportingChannel := make(chan string, 1000)
-	go Routines.HandleWSReportingTx(serverConfigStringMap,routineCompleteChannel,LoggingChannel,ReportingChannel)
+	go Routines.HandleWSReportingTx(serverConfigStringMap,routineCompleteChannel,LoggingChannel,ReportingChannel,HealthRegistry)
 
 	routineCount = routineCount + 1
-	GenericChunkChannel := make(chan string, 1000)
-	go Routines.HandleTCPReceivals(serverConfigStringMap, LoggingChannel, GenericChunkChannel)
+	GenericChunkChannel := make(chan Routines.ReceivedChunk, 1000)
+	ControlCommandChannel := make(chan Routines.ControlCommand, 100)
+	go Routines.HandleTCPReceivals(serverConfigStringMap, LoggingChannel, GenericChunkChannel, ReportingChannel, ControlCommandChannel, HealthRegistry)
 
 	routineCount = routineCount + 1
-	go Routines.HandleWSDataChunkTx(serverConfigStringMap, LoggingChannel, GenericChunkChannel, ReportingChannel)
+	go Routines.HandleWSDataChunkTx(serverConfigStringMap, LoggingChannel, GenericChunkChannel, ReportingChannel, ControlCommandChannel, HealthRegistry)
 
 	for {
 		time.Sleep(60 * time.Second)